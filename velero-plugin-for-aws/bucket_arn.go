@@ -0,0 +1,77 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/pkg/errors"
+)
+
+// bucketARN is an access point ARN used in place of a bucket name. The S3
+// client resolves the access point endpoint from the ARN itself.
+type bucketARN struct {
+	arn.ARN
+	// multiRegion is set for multi-region access points, which have no
+	// region and must be signed with SigV4a.
+	multiRegion bool
+}
+
+// parseBucketARN returns the parsed ARN if bucket is an access point,
+// Outposts access point or multi-region access point ARN, or nil if bucket
+// is a plain bucket name.
+func parseBucketARN(bucket string) (*bucketARN, error) {
+	if !arn.IsARN(bucket) {
+		return nil, nil
+	}
+	parsed, err := arn.Parse(bucket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid bucket ARN %s", bucket)
+	}
+
+	resource := strings.Split(parsed.Resource, "/")
+	switch parsed.Service {
+	case "s3":
+		if len(resource) != 2 || resource[0] != "accesspoint" || resource[1] == "" {
+			return nil, errors.Errorf("invalid bucket ARN %s: expected an access point ARN", bucket)
+		}
+		return &bucketARN{ARN: parsed, multiRegion: parsed.Region == ""}, nil
+	case "s3-outposts":
+		if len(resource) == 4 && resource[0] == "outpost" && resource[2] == "bucket" {
+			return nil, errors.Errorf("invalid bucket ARN %s: Outposts buckets must be accessed through an Outposts access point ARN", bucket)
+		}
+		if len(resource) != 4 || resource[0] != "outpost" || resource[2] != "accesspoint" || resource[3] == "" {
+			return nil, errors.Errorf("invalid bucket ARN %s: expected an Outposts access point ARN", bucket)
+		}
+		if parsed.Region == "" {
+			return nil, errors.Errorf("invalid bucket ARN %s: Outposts access point ARNs must include a region", bucket)
+		}
+		return &bucketARN{ARN: parsed}, nil
+	}
+	return nil, errors.Errorf("invalid bucket ARN %s: unsupported service %s", bucket, parsed.Service)
+}
+
+// copySource returns the CopySource of a CopyObject request that copies key
+// from bucket, which may be an access point ARN.
+func copySource(bucket, key string) string {
+	if arn.IsARN(bucket) {
+		return bucket + "/object/" + url.PathEscape(key)
+	}
+	return bucket + "/" + url.PathEscape(key)
+}
@@ -0,0 +1,183 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testAccessPointARN    = "arn:aws:s3:us-west-2:123456789012:accesspoint/backups"
+	testOutpostsARN       = "arn:aws:s3-outposts:us-west-2:123456789012:outpost/op-01234567890123456/accesspoint/backups"
+	testMultiRegionARN    = "arn:aws:s3::123456789012:accesspoint/mfzwi23gnjvgw.mrap"
+	testOutpostsBucketARN = "arn:aws:s3-outposts:us-west-2:123456789012:outpost/op-01234567890123456/bucket/backups"
+	testUnsupportedARN    = "arn:aws:s3:us-west-2:123456789012:bucket/backups"
+	testUnsupportedSvcARN = "arn:aws:ec2:us-west-2:123456789012:volume/vol-1"
+	testAccessPointHost   = "backups-123456789012.s3-accesspoint.us-west-2.amazonaws.com"
+	testMultiRegionHost   = "mfzwi23gnjvgw.mrap.accesspoint.s3-global.amazonaws.com"
+)
+
+func TestParseBucketARN(t *testing.T) {
+	tests := []struct {
+		bucket      string
+		expectARN   bool
+		multiRegion bool
+		expectedErr string
+	}{
+		{bucket: "backups"},
+		{bucket: testAccessPointARN, expectARN: true},
+		{bucket: testOutpostsARN, expectARN: true},
+		{bucket: testMultiRegionARN, expectARN: true, multiRegion: true},
+		{bucket: testOutpostsBucketARN, expectedErr: "must be accessed through an Outposts access point ARN"},
+		{bucket: testUnsupportedARN, expectedErr: "expected an access point ARN"},
+		{bucket: testUnsupportedSvcARN, expectedErr: "unsupported service ec2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.bucket, func(t *testing.T) {
+			parsed, err := parseBucketARN(test.bucket)
+			if test.expectedErr != "" {
+				assert.ErrorContains(t, err, test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			if !test.expectARN {
+				assert.Nil(t, parsed)
+				return
+			}
+			require.NotNil(t, parsed)
+			assert.Equal(t, test.multiRegion, parsed.multiRegion)
+		})
+	}
+}
+
+func TestInitWithBucketARN(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         map[string]string
+		expectedRegion string
+		expectedSigVer string
+		expectedErr    string
+	}{
+		{
+			name:           "access point takes its region from the ARN",
+			config:         map[string]string{"bucket": testAccessPointARN},
+			expectedRegion: "us-west-2",
+			expectedSigVer: signatureVersion4,
+		},
+		{
+			name:           "multi-region access point uses SigV4a",
+			config:         map[string]string{"bucket": testMultiRegionARN},
+			expectedRegion: "us-east-1",
+			expectedSigVer: signatureVersion4a,
+		},
+		{
+			name:           "multi-region access point with SigV4a set",
+			config:         map[string]string{"bucket": testMultiRegionARN, "signatureVersion": "4a"},
+			expectedRegion: "us-east-1",
+			expectedSigVer: signatureVersion4a,
+		},
+		{
+			name:        "multi-region access point with SigV4 set is rejected",
+			config:      map[string]string{"bucket": testMultiRegionARN, "signatureVersion": "4"},
+			expectedErr: `multi-region access points require signatureVersion "4a", got "4"`,
+		},
+		{
+			name:        "path style is rejected",
+			config:      map[string]string{"bucket": testAccessPointARN, "s3ForcePathStyle": "true"},
+			expectedErr: "s3ForcePathStyle cannot be used when the bucket is an access point ARN",
+		},
+		{
+			name:        "publicUrl is rejected",
+			config:      map[string]string{"bucket": testAccessPointARN, "publicUrl": "https://public.example.com"},
+			expectedErr: "publicUrl cannot be used when the bucket is an access point ARN",
+		},
+		{
+			name:        "SigV2 is rejected",
+			config:      map[string]string{"bucket": testAccessPointARN, "signatureVersion": "2"},
+			expectedErr: `access point ARNs do not support signatureVersion "2"`,
+		},
+		{
+			name:        "Outposts bucket ARN is rejected",
+			config:      map[string]string{"bucket": testOutpostsBucketARN},
+			expectedErr: "Outposts access point ARN",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := newObjectStore(newLogger())
+			err := o.Init(test.config)
+			if test.expectedErr != "" {
+				assert.ErrorContains(t, err, test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedSigVer, o.signatureVersion)
+
+			options := o.s3.(*s3.Client).Options()
+			assert.Equal(t, test.expectedRegion, options.Region)
+			assert.True(t, options.UseARNRegion)
+		})
+	}
+}
+
+func TestAccessPointRequests(t *testing.T) {
+	tests := []struct {
+		bucket       string
+		expectedHost string
+	}{
+		{bucket: testAccessPointARN, expectedHost: testAccessPointHost},
+		{bucket: testMultiRegionARN, expectedHost: testMultiRegionHost},
+	}
+
+	for _, test := range tests {
+		t.Run(test.bucket, func(t *testing.T) {
+			var hosts []string
+			client := newTestS3Client(t, func(req *http.Request) (*http.Response, error) {
+				hosts = append(hosts, req.URL.Host)
+				return newTestResponse(req, http.StatusOK, "<ListBucketResult><Contents><Key>a</Key></Contents><Contents><Key>b</Key></Contents></ListBucketResult>"), nil
+			})
+			client = s3.New(client.Options(), func(o *s3.Options) { o.UseARNRegion = true })
+			o := &ObjectStore{log: newLogger(), s3: client, preSignS3: s3.NewPresignClient(client)}
+
+			keys, err := o.ListObjects(test.bucket, "backups/")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"b", "a"}, keys)
+			assert.Equal(t, []string{test.expectedHost}, hosts)
+
+			signedURL, err := o.CreateSignedURL(test.bucket, "backups/a", time.Minute)
+			require.NoError(t, err)
+			u, err := url.Parse(signedURL)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedHost, u.Host)
+			assert.Equal(t, "/backups/a", u.Path)
+		})
+	}
+}
+
+func TestCopySource(t *testing.T) {
+	assert.Equal(t, "bucket/a%20b", copySource("bucket", "a b"))
+	assert.Equal(t, testAccessPointARN+"/object/a%20b", copySource(testAccessPointARN, "a b"))
+}
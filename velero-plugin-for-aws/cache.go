@@ -0,0 +1,166 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	listCacheTTLKey = "listCacheTTL"
+
+	// listCacheSweepSize is the number of entries from which expired
+	// entries are removed when an entry is added.
+	listCacheSweepSize = 1000
+
+	cacheResultHit  = "hit"
+	cacheResultMiss = "miss"
+)
+
+// listingCache caches the results of ListCommonPrefixes, ListObjects and
+// ObjectExists for a TTL. Velero's backup sync controller repeats these
+// calls on the same prefixes every minute. Writes and deletes made by this
+// instance invalidate the results they change; changes made by others are
+// seen once the results expire.
+type listingCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[listingCacheKey]listingCacheEntry
+	// generation is incremented by each invalidation, so that a result
+	// read before an invalidation is not cached after it.
+	generation uint64
+}
+
+type listingCacheKey struct {
+	operation string
+	bucket    string
+	// key is the prefix of a listing or the key of an existence check.
+	key       string
+	delimiter string
+}
+
+type listingCacheEntry struct {
+	keys    []string
+	exists  bool
+	expires time.Time
+}
+
+// newListingCache returns a cache with the TTL set in config, or nil if
+// caching is disabled.
+func newListingCache(config map[string]string) (*listingCache, error) {
+	ttl, err := parsePositiveDuration(config, listCacheTTLKey)
+	if err != nil || ttl == 0 {
+		return nil, err
+	}
+	return &listingCache{ttl: ttl, now: time.Now, entries: map[listingCacheKey]listingCacheEntry{}}, nil
+}
+
+// get returns the cached entry for key, counting the lookup as a hit or a
+// miss, and the generation to pass to set with the result of a miss.
+func (c *listingCache) get(key listingCacheKey) (listingCacheEntry, bool, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if ok && !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	if ok {
+		listCacheRequests.WithLabelValues(key.operation, cacheResultHit).Inc()
+	} else {
+		listCacheRequests.WithLabelValues(key.operation, cacheResultMiss).Inc()
+	}
+	return entry, ok, c.generation
+}
+
+// set caches entry for key, unless the cache was invalidated since the
+// lookup that returned generation.
+func (c *listingCache) set(key listingCacheKey, entry listingCacheEntry, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	now := c.now()
+	if len(c.entries) >= listCacheSweepSize {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	entry.expires = now.Add(c.ttl)
+	c.entries[key] = entry
+}
+
+// keys returns the cached keys or common prefixes of a listing, or calls
+// list and caches its result. The returned slice is not shared with the
+// cache.
+func (c *listingCache) keys(key listingCacheKey, list func() ([]string, error)) ([]string, error) {
+	if c == nil {
+		return list()
+	}
+	entry, ok, generation := c.get(key)
+	if ok {
+		return append([]string(nil), entry.keys...), nil
+	}
+	keys, err := list()
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, listingCacheEntry{keys: append([]string(nil), keys...)}, generation)
+	return keys, nil
+}
+
+// exists returns the cached result of an existence check, or calls check
+// and caches its result.
+func (c *listingCache) exists(bucket, key string, check func() (bool, error)) (bool, error) {
+	if c == nil {
+		return check()
+	}
+	cacheKey := listingCacheKey{operation: "ObjectExists", bucket: bucket, key: key}
+	entry, ok, generation := c.get(cacheKey)
+	if ok {
+		return entry.exists, nil
+	}
+	exists, err := check()
+	if err != nil {
+		return false, err
+	}
+	c.set(cacheKey, listingCacheEntry{exists: exists}, generation)
+	return exists, nil
+}
+
+// invalidate drops the cached results that a write or delete of key can
+// change: its existence, and the listings of its parent prefixes.
+func (c *listingCache) invalidate(bucket, key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for k := range c.entries {
+		if k.bucket == bucket && strings.HasPrefix(key, k.key) && (k.operation != "ObjectExists" || k.key == key) {
+			delete(c.entries, k)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewListingCache(t *testing.T) {
+	cache, err := newListingCache(map[string]string{})
+	require.NoError(t, err)
+	assert.Nil(t, cache)
+
+	cache, err = newListingCache(map[string]string{listCacheTTLKey: "30s"})
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, cache.ttl)
+
+	_, err = newListingCache(map[string]string{listCacheTTLKey: "0s"})
+	assert.EqualError(t, err, `could not parse listCacheTTL "0s" (expected a positive duration, e.g. "30s")`)
+}
+
+func TestListingCache(t *testing.T) {
+	bucket := newTestBucket(map[string]string{"backups/b1/b1.tar.gz": "b1"})
+	requests := map[string]int{}
+	client := newTestS3Client(t, func(req *http.Request) (*http.Response, error) {
+		requests[req.Method]++
+		return bucket.do(req)
+	})
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	cache := &listingCache{ttl: time.Minute, now: func() time.Time { return now }, entries: map[listingCacheKey]listingCacheEntry{}}
+	o := &ObjectStore{log: newLogger(), s3: client, s3Uploader: manager.NewUploader(client), cache: cache}
+
+	hits := testutil.ToFloat64(listCacheRequests.WithLabelValues("ListObjects", cacheResultHit))
+	for i := 0; i < 3; i++ {
+		keys, err := o.ListObjects("bucket", "backups/")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"backups/b1/b1.tar.gz"}, keys)
+		exists, err := o.ObjectExists("bucket", "backups/b2/b2.tar.gz")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	}
+	assert.Equal(t, 2, requests[http.MethodGet]+requests[http.MethodHead])
+	assert.Equal(t, hits+2, testutil.ToFloat64(listCacheRequests.WithLabelValues("ListObjects", cacheResultHit)))
+
+	// writes and deletes of this instance are seen right away
+	require.NoError(t, o.PutObject("bucket", "backups/b2/b2.tar.gz", strings.NewReader("b2")))
+	keys, err := o.ListObjects("bucket", "backups/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups/b2/b2.tar.gz", "backups/b1/b1.tar.gz"}, keys)
+	exists, err := o.ObjectExists("bucket", "backups/b2/b2.tar.gz")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	require.NoError(t, o.DeleteObject("bucket", "backups/b1/b1.tar.gz"))
+	keys, err = o.ListObjects("bucket", "backups/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups/b2/b2.tar.gz"}, keys)
+
+	// other changes are seen once the TTL has passed
+	bucket.objects["backups/b3/b3.tar.gz"] = "b3"
+	keys, err = o.ListObjects("bucket", "backups/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups/b2/b2.tar.gz"}, keys)
+	now = now.Add(time.Minute)
+	keys, err = o.ListObjects("bucket", "backups/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups/b3/b3.tar.gz", "backups/b2/b2.tar.gz"}, keys)
+}
+
+func TestListingCacheInvalidate(t *testing.T) {
+	cache := &listingCache{ttl: time.Minute, now: time.Now, entries: map[listingCacheKey]listingCacheEntry{}}
+	keys := []listingCacheKey{
+		{operation: "ListCommonPrefixes", bucket: "bucket", key: "backups/", delimiter: "/"},
+		{operation: "ListObjects", bucket: "bucket", key: ""},
+		{operation: "ListObjects", bucket: "bucket", key: "restores/"},
+		{operation: "ListObjects", bucket: "other", key: "backups/"},
+		{operation: "ObjectExists", bucket: "bucket", key: "backups/b1/b1.tar.gz"},
+		{operation: "ObjectExists", bucket: "bucket", key: "backups/b1/b1-logs.gz"},
+	}
+	for _, key := range keys {
+		cache.set(key, listingCacheEntry{}, 0)
+	}
+
+	cache.invalidate("bucket", "backups/b1/b1.tar.gz")
+	assert.Len(t, cache.entries, 3)
+	assert.Contains(t, cache.entries, keys[2])
+	assert.Contains(t, cache.entries, keys[3])
+	assert.Contains(t, cache.entries, keys[5])
+
+	// a result read before an invalidation is not cached
+	cache.set(keys[0], listingCacheEntry{}, 0)
+	assert.NotContains(t, cache.entries, keys[0])
+}
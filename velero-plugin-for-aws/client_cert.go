@@ -0,0 +1,195 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	tlsClientCertKey       = "tlsClientCert"
+	tlsClientKeyKey        = "tlsClientKey"
+	tlsClientCertFileKey   = "tlsClientCertFile"
+	tlsClientKeyFileKey    = "tlsClientKeyFile"
+	tlsClientCertSecretKey = "tlsClientCertSecret"
+	tlsClientKeySecretKey  = "tlsClientKeySecret"
+	tlsMinVersionKey       = "tlsMinVersion"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSMinVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, errors.Errorf("invalid %s %q, expected one of \"1.0\", \"1.1\", \"1.2\" or \"1.3\"", tlsMinVersionKey, version)
+	}
+	return v, nil
+}
+
+// pemSource is where a PEM block of the client certificate comes from.
+// Exactly one of its fields is set.
+type pemSource struct {
+	inline []byte
+	file   string
+}
+
+// clientCertificate is the TLS client certificate of a location. A
+// certificate or key read from a file is reloaded when the file changes,
+// so that a rotated certificate is used without restarting Velero.
+type clientCertificate struct {
+	log       logrus.FieldLogger
+	certPEM   pemSource
+	keyPEM    pemSource
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	loadedFor [2]time.Time
+}
+
+// newClientCertificate returns the client certificate configured in config,
+// or nil if none is.
+func newClientCertificate(config map[string]string, log logrus.FieldLogger) (*clientCertificate, error) {
+	certPEM, err := readPEMSource(config, "certificate", tlsClientCertKey, tlsClientCertFileKey, tlsClientCertSecretKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := readPEMSource(config, "key", tlsClientKeyKey, tlsClientKeyFileKey, tlsClientKeySecretKey)
+	if err != nil {
+		return nil, err
+	}
+	if certPEM == nil && keyPEM == nil {
+		return nil, nil
+	}
+	if certPEM == nil || keyPEM == nil {
+		return nil, errors.Errorf("a TLS client certificate requires both a certificate (%s, %s or %s) and a key (%s, %s or %s)",
+			tlsClientCertKey, tlsClientCertFileKey, tlsClientCertSecretKey, tlsClientKeyKey, tlsClientKeyFileKey, tlsClientKeySecretKey)
+	}
+
+	c := &clientCertificate{log: log, certPEM: *certPEM, keyPEM: *keyPEM}
+	if err := c.load(c.modTimes()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readPEMSource returns the source set by one of the inline, file and
+// secret keys, reading inline and secret values right away.
+func readPEMSource(config map[string]string, what, inlineKey, fileKey, secretKey string) (*pemSource, error) {
+	inline, file, secret := config[inlineKey], config[fileKey], config[secretKey]
+	set := 0
+	for _, val := range []string{inline, file, secret} {
+		if val != "" {
+			set++
+		}
+	}
+	switch {
+	case set == 0:
+		return nil, nil
+	case set > 1:
+		return nil, errors.Errorf("you can only use one of: %s, %s, or %s", inlineKey, fileKey, secretKey)
+	case inline != "":
+		return &pemSource{inline: []byte(inline)}, nil
+	case file != "":
+		return &pemSource{file: file}, nil
+	}
+	data, err := readSecretKey(secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading TLS client %s from %s", what, secretKey)
+	}
+	return &pemSource{inline: data}, nil
+}
+
+func (s pemSource) read() ([]byte, error) {
+	if s.file == "" {
+		return s.inline, nil
+	}
+	data, err := os.ReadFile(s.file)
+	return data, errors.WithStack(err)
+}
+
+// modTimes returns the modification times of the certificate and key
+// files, which are zero for sources that are not files.
+func (c *clientCertificate) modTimes() [2]time.Time {
+	var times [2]time.Time
+	for i, source := range []pemSource{c.certPEM, c.keyPEM} {
+		if source.file == "" {
+			continue
+		}
+		// a missing file keeps its last time, and the certificate loaded
+		// from it, until it is back
+		if info, err := os.Stat(source.file); err == nil {
+			times[i] = info.ModTime()
+		} else {
+			times[i] = c.loadedFor[i]
+		}
+	}
+	return times
+}
+
+func (c *clientCertificate) load(modTimes [2]time.Time) error {
+	certPEM, err := c.certPEM.read()
+	if err != nil {
+		return errors.Wrap(err, "error reading TLS client certificate")
+	}
+	keyPEM, err := c.keyPEM.read()
+	if err != nil {
+		return errors.Wrap(err, "error reading TLS client key")
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return errors.Wrap(err, "error loading TLS client certificate")
+	}
+	c.cert = &cert
+	c.loadedFor = modTimes
+	return nil
+}
+
+// getClientCertificate is the tls.Config.GetClientCertificate callback. It
+// reloads the certificate if one of its files changed. While the new files
+// cannot be loaded, e.g. because only one of them has been replaced yet,
+// the previous certificate is used.
+func (c *clientCertificate) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if modTimes := c.modTimes(); modTimes != c.loadedFor {
+		file := c.certPEM.file
+		if file == "" {
+			file = c.keyPEM.file
+		}
+		err := c.load(modTimes)
+		if err != nil {
+			// try again once the files change again
+			c.loadedFor = modTimes
+		}
+		recordReload(c.log, reloadKindTLSClientCert, file, err)
+	}
+	return c.cert, nil
+}
@@ -0,0 +1,272 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns the PEM certificate and key of a client certificate.
+func (ca *testCA) issue(t *testing.T, commonName string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func certCommonName(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return parsed.Subject.CommonName
+}
+
+// writeFileAt writes a file with the given modification time, since the
+// writes of a test can fall within the resolution of the file system.
+func writeFileAt(t *testing.T, file, content string, modTime time.Time) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(file, []byte(content), 0600))
+	require.NoError(t, os.Chtimes(file, modTime, modTime))
+}
+
+func TestParseTLSMinVersion(t *testing.T) {
+	v, err := parseTLSMinVersion("")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(0), v)
+
+	v, err = parseTLSMinVersion("1.3")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), v)
+
+	_, err = parseTLSMinVersion("TLS1.3")
+	assert.EqualError(t, err, `invalid tlsMinVersion "TLS1.3", expected one of "1.0", "1.1", "1.2" or "1.3"`)
+}
+
+func TestNewClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "velero")
+	_, otherKeyPEM := ca.issue(t, "other")
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certFile, []byte(certPEM), 0600))
+	require.NoError(t, os.WriteFile(keyFile, []byte(keyPEM), 0600))
+
+	tests := []struct {
+		name        string
+		config      map[string]string
+		expectNil   bool
+		expectedErr string
+	}{
+		{
+			name:      "not configured",
+			config:    map[string]string{},
+			expectNil: true,
+		},
+		{
+			name:   "inline",
+			config: map[string]string{tlsClientCertKey: certPEM, tlsClientKeyKey: keyPEM},
+		},
+		{
+			name:   "files",
+			config: map[string]string{tlsClientCertFileKey: certFile, tlsClientKeyFileKey: keyFile},
+		},
+		{
+			name:   "inline certificate and key file",
+			config: map[string]string{tlsClientCertKey: certPEM, tlsClientKeyFileKey: keyFile},
+		},
+		{
+			name:        "certificate without key",
+			config:      map[string]string{tlsClientCertFileKey: certFile},
+			expectedErr: "a TLS client certificate requires both a certificate",
+		},
+		{
+			name:        "two certificate sources",
+			config:      map[string]string{tlsClientCertKey: certPEM, tlsClientCertFileKey: certFile, tlsClientKeyKey: keyPEM},
+			expectedErr: "you can only use one of: tlsClientCert, tlsClientCertFile, or tlsClientCertSecret",
+		},
+		{
+			name:        "missing file",
+			config:      map[string]string{tlsClientCertFileKey: filepath.Join(dir, "missing"), tlsClientKeyFileKey: keyFile},
+			expectedErr: "error reading TLS client certificate",
+		},
+		{
+			name:        "key does not match",
+			config:      map[string]string{tlsClientCertKey: certPEM, tlsClientKeyKey: otherKeyPEM},
+			expectedErr: "error loading TLS client certificate",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := newClientCertificate(test.config, newLogger())
+			if test.expectedErr != "" {
+				assert.ErrorContains(t, err, test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			if test.expectNil {
+				assert.Nil(t, c)
+				return
+			}
+			cert, err := c.getClientCertificate(nil)
+			require.NoError(t, err)
+			assert.Equal(t, "velero", certCommonName(t, cert))
+		})
+	}
+}
+
+func TestClientCertificateReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	modTime := time.Now().Add(-time.Hour)
+
+	certPEM, keyPEM := ca.issue(t, "v1")
+	writeFileAt(t, certFile, certPEM, modTime)
+	writeFileAt(t, keyFile, keyPEM, modTime)
+	c, err := newClientCertificate(map[string]string{tlsClientCertFileKey: certFile, tlsClientKeyFileKey: keyFile}, newLogger())
+	require.NoError(t, err)
+
+	cert, err := c.getClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", certCommonName(t, cert))
+
+	// only the certificate has been rotated so far: keep using v1
+	certPEM, keyPEM = ca.issue(t, "v2")
+	writeFileAt(t, certFile, certPEM, modTime.Add(time.Minute))
+	cert, err = c.getClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", certCommonName(t, cert))
+
+	writeFileAt(t, keyFile, keyPEM, modTime.Add(time.Minute))
+	cert, err = c.getClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "v2", certCommonName(t, cert))
+
+	// a removed file keeps the loaded certificate
+	require.NoError(t, os.Remove(certFile))
+	cert, err = c.getClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "v2", certCommonName(t, cert))
+}
+
+func TestObjectStoreMutualTLS(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+
+	ca := newTestCA(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+		MaxVersion: tls.VersionTLS12,
+	}
+	server.StartTLS()
+	defer server.Close()
+	serverCA := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	certPEM, keyPEM := ca.issue(t, "velero")
+	config := func(extra map[string]string) map[string]string {
+		config := map[string]string{
+			bucketKey:           "bucket",
+			regionKey:           "us-east-1",
+			s3URLKey:            server.URL,
+			s3ForcePathStyleKey: "true",
+			caCertKey:           serverCA,
+		}
+		for key, val := range extra {
+			config[key] = val
+		}
+		return config
+	}
+
+	o := newObjectStore(newLogger())
+	require.NoError(t, o.Init(config(map[string]string{tlsClientCertKey: certPEM, tlsClientKeyKey: keyPEM})))
+	exists, err := o.ObjectExists("bucket", "key")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	o = newObjectStore(newLogger())
+	require.NoError(t, o.Init(config(nil)))
+	_, err = o.ObjectExists("bucket", "key")
+	assert.Error(t, err, "the server requires a client certificate")
+
+	// the server only supports TLS 1.2
+	o = newObjectStore(newLogger())
+	require.NoError(t, o.Init(config(map[string]string{tlsClientCertKey: certPEM, tlsClientKeyKey: keyPEM, tlsMinVersionKey: "1.3"})))
+	_, err = o.ObjectExists("bucket", "key")
+	assert.ErrorContains(t, err, "protocol version")
+}
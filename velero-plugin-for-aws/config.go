@@ -3,13 +3,13 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	"os"
 )
@@ -18,6 +18,24 @@ type configBuilder struct {
 	log       logrus.FieldLogger
 	opts      []func(*config.LoadOptions) error
 	credsFlag bool
+	// credentialsFile is watched for changes when credsFlag is set
+	credentialsFile string
+	// credentialsSync updates credentialsFile before it is checked
+	credentialsSync func() error
+	// credentialsLoaded, if set, is called once the credentials were
+	// loaded from credentialsFile
+	credentialsLoaded func() error
+	// credentialsWatch, if set, is given the credentials so that they are
+	// retrieved again as soon as their source changes
+	credentialsWatch func(*aws.CredentialsCache)
+	// webIdentity, if set, replaces the credentials of the files
+	webIdentity *webIdentitySettings
+	// roots are the trusted authorities, if not the system pool
+	roots *rootCAs
+	// transportOpts and dialerOpts configure the HTTP client shared by
+	// all settings that need one
+	transportOpts []func(*http.Transport)
+	dialerOpts    []func(*net.Dialer)
 }
 
 func newConfigBuilder(logger logrus.FieldLogger) *configBuilder {
@@ -51,44 +69,129 @@ func (cb *configBuilder) WithCredentialsFile(credentialsFile string) *configBuil
 		os.Setenv("AWS_ROLE_SESSION_NAME", "")
 		os.Setenv("AWS_ROLE_ARN", "")
 		cb.credsFlag = true
+		cb.credentialsFile = credentialsFile
 	}
 	return cb
 }
 
-func (cb *configBuilder) WithTLSSettings(insecureSkipTLSVerify bool, caCert string) *configBuilder {
-	cb.opts = append(cb.opts, config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+// WithSharedFiles reads the credentials and config of file, if set. Unlike
+// WithCredentialsFile, it neither falls back to AWS_SHARED_CREDENTIALS_FILE
+// nor changes the environment of the process, which is shared by the other
+// locations.
+func (cb *configBuilder) WithSharedFiles(file string) *configBuilder {
+	if file != "" {
+		cb.opts = append(cb.opts, config.WithSharedCredentialsFiles([]string{file}),
+			config.WithSharedConfigFiles([]string{file}))
+		cb.credsFlag = true
+		cb.credentialsFile = file
+	}
+	return cb
+}
+
+// WithCredentialsSecret uses the credentials of a secret, if not nil, and
+// refreshes them from the secret.
+func (cb *configBuilder) WithCredentialsSecret(secret *secretCredentials) *configBuilder {
+	if secret != nil {
+		cb.WithCredentialsFile(secret.file)
+		cb.credentialsSync = secret.sync
+		cb.credentialsLoaded = secret.remove
+		cb.credentialsWatch = secret.invalidateOnChange
+	}
+	return cb
+}
+
+// WithWebIdentity obtains temporary credentials from STS with a web
+// identity token, if settings is not nil.
+func (cb *configBuilder) WithWebIdentity(settings *webIdentitySettings) *configBuilder {
+	cb.webIdentity = settings
+	return cb
+}
+
+func (cb *configBuilder) WithTLSSettings(insecureSkipTLSVerify bool, roots *rootCAs, clientCert *clientCertificate, minVersion uint16) *configBuilder {
+	if !insecureSkipTLSVerify {
+		cb.roots = roots
+	}
+	cb.transportOpts = append(cb.transportOpts, func(tr *http.Transport) {
 		if tr.TLSClientConfig == nil {
 			tr.TLSClientConfig = &tls.Config{}
 		}
-		if len(caCert) > 0 {
-			var caCertPool *x509.CertPool
-			caCertPool, err := x509.SystemCertPool()
-			if err != nil {
-				cb.log.Warnf("Failed to load system cert pool, using empty cert pool, err: %v", err)
-				caCertPool = x509.NewCertPool()
-			}
-			caCertPool.AppendCertsFromPEM([]byte(caCert))
-			tr.TLSClientConfig.RootCAs = caCertPool
-		}
 		tr.TLSClientConfig.InsecureSkipVerify = insecureSkipTLSVerify
-	})))
+		if cb.roots != nil {
+			// a copy, as the SDK adds the bundle of AWS_CA_BUNDLE to it
+			tr.TLSClientConfig.RootCAs = cb.roots.current().Clone()
+		}
+		if clientCert != nil {
+			tr.TLSClientConfig.GetClientCertificate = clientCert.getClientCertificate
+		}
+		if minVersion != 0 {
+			tr.TLSClientConfig.MinVersion = minVersion
+		}
+	})
+	return cb
+}
+
+func (cb *configBuilder) WithTransportSettings(settings transportSettings) *configBuilder {
+	cb.transportOpts = append(cb.transportOpts, settings.applyTransport)
+	cb.dialerOpts = append(cb.dialerOpts, settings.applyDialer)
 	return cb
 }
 
 func (cb *configBuilder) Build() (aws.Config, error) {
+	if cb.credentialsSync != nil {
+		if err := cb.credentialsSync(); err != nil {
+			return aws.Config{}, err
+		}
+	}
+	if cb.credentialsLoaded != nil {
+		defer func() {
+			if err := cb.credentialsLoaded(); err != nil {
+				cb.log.WithError(err).Warn("Failed to clean up the credentials file")
+			}
+		}()
+	}
+	if len(cb.transportOpts) > 0 || len(cb.dialerOpts) > 0 {
+		cb.opts = append(cb.opts, config.WithHTTPClient(awshttp.NewBuildableClient().
+			WithTransportOptions(cb.transportOpts...).
+			WithDialerOptions(cb.dialerOpts...)))
+	}
 	conf, err := config.LoadDefaultConfig(context.Background(), cb.opts...)
 	if err != nil {
 		return aws.Config{}, err
 	}
-	if cb.credsFlag {
+	if client, ok := conf.HTTPClient.(*awshttp.BuildableClient); ok && cb.roots != nil && cb.roots.file != "" {
+		conf.HTTPClient = newReloadingHTTPClient(cb.roots, client)
+	}
+	if cb.webIdentity != nil {
+		// STS is called with the HTTP client of the location, so that it
+		// trusts the same CAs and uses the same proxy
+		conf.Credentials = cb.webIdentity.provider(conf)
 		if _, err := conf.Credentials.Retrieve(context.Background()); err != nil {
 			return aws.Config{}, errors.WithStack(err)
 		}
+	} else if cb.credsFlag {
+		if _, err := conf.Credentials.Retrieve(context.Background()); err != nil {
+			return aws.Config{}, errors.WithStack(err)
+		}
+		opts := cb.opts
+		credentials := newReloadingCredentials(cb.log, cb.credentialsFile, cb.credentialsSync, cb.credentialsLoaded, conf.Credentials, func(ctx context.Context) (aws.CredentialsProvider, error) {
+			reloaded, err := config.LoadDefaultConfig(ctx, opts...)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if reloaded.Credentials == nil {
+				return nil, errors.New("no credentials found")
+			}
+			return reloaded.Credentials, nil
+		})
+		if cb.credentialsWatch != nil {
+			cb.credentialsWatch(credentials)
+		}
+		conf.Credentials = credentials
 	}
 	return conf, nil
 }
 
-func newS3Client(cfg aws.Config, url string, forcePathStyle bool) (*s3.Client, error) {
+func newS3Client(cfg aws.Config, url string, forcePathStyle bool, optFns ...func(*s3.Options)) (*s3.Client, error) {
 	opts := []func(*s3.Options){
 		func(o *s3.Options) {
 			o.UsePathStyle = forcePathStyle
@@ -103,5 +206,5 @@ func newS3Client(cfg aws.Config, url string, forcePathStyle bool) (*s3.Client, e
 		})
 	}
 
-	return s3.NewFromConfig(cfg, opts...), nil
+	return s3.NewFromConfig(cfg, append(opts, optFns...)...), nil
 }
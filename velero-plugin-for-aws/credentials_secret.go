@@ -0,0 +1,264 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"weak"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	credentialsSecretKey = "credentialsSecret"
+
+	// secretWatchSyncTimeout is how long Init waits for the first list of
+	// the secret of a credentialsSecret.
+	secretWatchSyncTimeout = 30 * time.Second
+)
+
+// secretCredentials are the AWS credentials and config, in the INI format
+// of a credentials file, stored in a key of a Kubernetes secret. The SDK
+// only reads them from files, so they are written to a file while the SDK
+// loads them, and the file is removed once they are loaded. The secret is
+// watched, and the credentials are refreshed when it changes.
+type secretCredentials struct {
+	secretRef string
+	name      string
+	key       string
+	file      string
+	// client returns the Kubernetes client and the namespace of the secret
+	client func() (kubernetes.Interface, string, error)
+	watch  *secretWatch
+	// data is what was last written to file
+	data []byte
+}
+
+// locationSecretCredentials returns the credentials of the credentialsSecret
+// of a location, or nil if it has none.
+func locationSecretCredentials(config map[string]string) (*secretCredentials, error) {
+	secretRef := config[credentialsSecretKey]
+	if secretRef == "" {
+		return nil, nil
+	}
+	if config[credentialsFileKey] != "" {
+		return nil, errors.Errorf("you can only use one of: %s or %s", credentialsFileKey, credentialsSecretKey)
+	}
+	return newSecretCredentials(secretRef, inClusterClient)
+}
+
+// newSecretCredentials returns the credentials of secretRef
+// (secretName/key) in the namespace of client. The secret is only watched,
+// and the credentials written to their file, when the config is built.
+func newSecretCredentials(secretRef string, client func() (kubernetes.Interface, string, error)) (*secretCredentials, error) {
+	parts := strings.Split(secretRef, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.Errorf("invalid %s %q, expected secretName/key", credentialsSecretKey, secretRef)
+	}
+	if parts[0] == "." || parts[0] == ".." || parts[1] == "." || parts[1] == ".." {
+		return nil, errors.Errorf("invalid %s %q, expected secretName/key", credentialsSecretKey, secretRef)
+	}
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s := &secretCredentials{
+		secretRef: secretRef,
+		name:      parts[0],
+		key:       parts[1],
+		// secret names cannot contain '/', and every location has a file of
+		// its own, which it removes independently of the others
+		file:   filepath.Join(os.TempDir(), "velero-plugin-for-aws", "credentials", parts[0], parts[1]+"-"+hex.EncodeToString(suffix[:])),
+		client: client,
+	}
+	return s, nil
+}
+
+// sync writes the file if the credentials in the watched secret changed,
+// which makes the credentials of the file be reloaded. The secret is
+// watched the first time.
+func (s *secretCredentials) sync() error {
+	if s.watch == nil {
+		client, namespace, err := s.client()
+		if err != nil {
+			return errors.Wrapf(err, "error reading %s", credentialsSecretKey)
+		}
+		if s.watch, err = watchSecret(client, namespace, s.name); err != nil {
+			return errors.Wrapf(err, "error reading %s", credentialsSecretKey)
+		}
+	}
+	data, err := s.watch.get(s.key)
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", credentialsSecretKey)
+	}
+	if s.data != nil && bytes.Equal(s.data, data) {
+		return nil
+	}
+
+	dir := filepath.Dir(s.file)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.WithStack(err)
+	}
+	// the file is replaced rather than written in place, so that it is
+	// never read half written
+	tmp, err := os.CreateTemp(dir, ".credentials-*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(tmp.Name(), s.file); err != nil {
+		return errors.WithStack(err)
+	}
+	s.data = data
+	return nil
+}
+
+// remove removes the file once the SDK has loaded the credentials from it,
+// so that they are not left in plain text on disk.
+func (s *secretCredentials) remove() error {
+	if err := os.Remove(s.file); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// invalidateOnChange makes credentials be retrieved again as soon as the
+// secret changes, rather than when they expire.
+func (s *secretCredentials) invalidateOnChange(credentials *aws.CredentialsCache) {
+	if s.watch != nil {
+		s.watch.invalidateOnChange(credentials)
+	}
+}
+
+var (
+	// secretWatches are the watches of the secrets of credentialsSecret,
+	// by namespace and name. They are shared by all the locations of the
+	// plugin process, since Velero initializes their object stores again
+	// and again, and they last as long as the process.
+	secretWatches   = map[string]*secretWatch{}
+	secretWatchesMu sync.Mutex
+)
+
+// secretWatch keeps the current version of a secret with an informer that
+// lists and watches only that secret.
+type secretWatch struct {
+	namespace string
+	name      string
+	store     cache.Store
+
+	mu sync.Mutex
+	// caches are invalidated when the secret changes. They are held
+	// weakly, so that the credentials of object stores that are no longer
+	// used are not kept by the watch.
+	caches []weak.Pointer[aws.CredentialsCache]
+}
+
+// watchSecret returns the watch of a secret, starting it and waiting for
+// the first list of the secret if it was not watched yet.
+func watchSecret(client kubernetes.Interface, namespace, name string) (*secretWatch, error) {
+	secretWatchesMu.Lock()
+	defer secretWatchesMu.Unlock()
+
+	id := namespace + "/" + name
+	if w, ok := secretWatches[id]; ok {
+		return w, nil
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	informer := factory.Core().V1().Secrets().Informer()
+	w := &secretWatch{namespace: namespace, name: name, store: informer.GetStore()}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { w.changed() },
+		UpdateFunc: func(interface{}, interface{}) { w.changed() },
+		DeleteFunc: func(interface{}) { w.changed() },
+	}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	stop := make(chan struct{})
+	factory.Start(stop)
+	ctx, cancel := context.WithTimeout(context.Background(), secretWatchSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		close(stop)
+		return nil, errors.Errorf("timed out watching secret %s", id)
+	}
+	secretWatches[id] = w
+	return w, nil
+}
+
+// get returns a key of the current version of the secret.
+func (w *secretWatch) get(key string) ([]byte, error) {
+	obj, exists, err := w.store.GetByKey(w.namespace + "/" + w.name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !exists {
+		return nil, errors.Errorf("secret %s/%s not found", w.namespace, w.name)
+	}
+	data, ok := obj.(*corev1.Secret).Data[key]
+	if !ok {
+		return nil, errors.Errorf("key %s not found in secret %s/%s", key, w.namespace, w.name)
+	}
+	return data, nil
+}
+
+func (w *secretWatch) invalidateOnChange(credentials *aws.CredentialsCache) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.caches = append(w.caches, weak.Make(credentials))
+}
+
+// changed invalidates the credentials of the secret, and forgets those
+// that are no longer used.
+func (w *secretWatch) changed() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	caches := w.caches[:0]
+	for _, ptr := range w.caches {
+		if credentials := ptr.Value(); credentials != nil {
+			credentials.Invalidate()
+			caches = append(caches, ptr)
+		}
+	}
+	w.caches = caches
+}
@@ -0,0 +1,150 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLocationSecretCredentials(t *testing.T) {
+	secretCreds, err := locationSecretCredentials(map[string]string{})
+	require.NoError(t, err)
+	assert.Nil(t, secretCreds)
+
+	_, err = locationSecretCredentials(map[string]string{credentialsSecretKey: "creds/cloud", credentialsFileKey: "/credentials/cloud"})
+	assert.EqualError(t, err, "you can only use one of: credentialsFile or credentialsSecret")
+
+	_, err = locationSecretCredentials(map[string]string{credentialsSecretKey: "creds"})
+	assert.EqualError(t, err, `invalid credentialsSecret "creds", expected secretName/key`)
+}
+
+// fakeSecretClient returns a client for a fake cluster with secrets in the
+// velero namespace.
+func fakeSecretClient(secrets ...*corev1.Secret) (*fake.Clientset, func() (kubernetes.Interface, string, error)) {
+	client := fake.NewSimpleClientset()
+	for _, secret := range secrets {
+		secret.Namespace = "velero"
+		client.Tracker().Add(secret)
+	}
+	return client, func() (kubernetes.Interface, string, error) { return client, "velero", nil }
+}
+
+func TestSecretCredentialsFiles(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	_, client := fakeSecretClient(
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "files-a-b"}, Data: map[string][]byte{"c": []byte("files-a-b/c")}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "files-a"}, Data: map[string][]byte{"b-c": []byte("files-a/b-c")}},
+	)
+
+	// secret files-a-b with key c and secret files-a with key b-c
+	first, err := newSecretCredentials("files-a-b/c", client)
+	require.NoError(t, err)
+	second, err := newSecretCredentials("files-a/b-c", client)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.file, second.file)
+	require.NoError(t, first.sync())
+	data, err := os.ReadFile(first.file)
+	require.NoError(t, err)
+	assert.Equal(t, "files-a-b/c", string(data))
+
+	// locations using the same secret do not remove each other's file
+	third, err := newSecretCredentials("files-a-b/c", client)
+	require.NoError(t, err)
+	require.NoError(t, third.sync())
+	require.NoError(t, first.remove())
+	assert.FileExists(t, third.file)
+	// and share the watch of the secret
+	assert.Same(t, first.watch, third.watch)
+
+	_, err = newSecretCredentials("../c", client)
+	assert.EqualError(t, err, `invalid credentialsSecret "../c", expected secretName/key`)
+}
+
+func TestSecretCredentials(t *testing.T) {
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_PROFILE", "AWS_SHARED_CREDENTIALS_FILE",
+		"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_SESSION_NAME", "AWS_ROLE_ARN"} {
+		t.Setenv(env, "")
+	}
+	t.Setenv("TMPDIR", t.TempDir())
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "creds"},
+		Data:       map[string][]byte{"cloud": []byte("[default]\naws_access_key_id = AKID1\naws_secret_access_key = SECRET1\n")},
+	}
+	kube, client := fakeSecretClient(secret)
+	secrets := kube.CoreV1().Secrets("velero")
+	update := func(data string) {
+		secret.Data["cloud"] = []byte(data)
+		_, err := secrets.Update(context.Background(), secret, metav1.UpdateOptions{})
+		require.NoError(t, err)
+	}
+
+	secretCreds, err := newSecretCredentials("creds/cloud", client)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(os.TempDir(), "velero-plugin-for-aws", "credentials", "creds"), filepath.Dir(secretCreds.file))
+	assert.NoFileExists(t, secretCreds.file)
+
+	cfg, err := newConfigBuilder(newLogger()).WithRegion("us-east-1").WithCredentialsSecret(secretCreds).Build()
+	require.NoError(t, err)
+	// the credentials are not left on disk once they are loaded
+	assert.NoFileExists(t, secretCreds.file)
+	cache, ok := cfg.Credentials.(*aws.CredentialsCache)
+	require.True(t, ok)
+	retrieve := func() string {
+		creds, err := cache.Retrieve(context.Background())
+		require.NoError(t, err)
+		return creds.AccessKeyID
+	}
+	assert.Equal(t, "AKID1", retrieve())
+
+	// a rotated secret is picked up as soon as the watch sees it, without
+	// waiting for the credentials to expire
+	update("[default]\naws_access_key_id = AKID2\naws_secret_access_key = SECRET2\n")
+	assert.Eventually(t, func() bool { return retrieve() == "AKID2" }, 10*time.Second, 10*time.Millisecond)
+	assert.NoFileExists(t, secretCreds.file)
+
+	// a secret that no longer contains credentials keeps the previous ones
+	failures := reloads(reloadKindCredentials, reloadResultFailure)
+	update("[default]\nregion = us-east-1\n")
+	assert.Eventually(t, func() bool {
+		return retrieve() == "AKID2" && reloads(reloadKindCredentials, reloadResultFailure) == failures+1
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// the previous credentials are used while the secret is missing
+	require.NoError(t, secrets.Delete(context.Background(), "creds", metav1.DeleteOptions{}))
+	assert.Eventually(t, func() bool {
+		return retrieve() == "AKID2" && reloads(reloadKindCredentials, reloadResultFailure) == failures+2
+	}, 10*time.Second, 10*time.Millisecond)
+
+	_, client = fakeSecretClient()
+	secretCreds, err = newSecretCredentials("missing/cloud", client)
+	require.NoError(t, err)
+	_, err = newConfigBuilder(newLogger()).WithRegion("us-east-1").WithCredentialsSecret(secretCreds).Build()
+	assert.EqualError(t, err, `error reading credentialsSecret: secret velero/missing not found`)
+}
@@ -0,0 +1,308 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// maxCopyObjectSize is the largest object S3 can copy with a single
+	// CopyObject request.
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+
+	// reencryptCommand is the first argument that re-encrypts the objects
+	// of a location with the current SSE-C key instead of running the
+	// plugin server.
+	reencryptCommand = "reencrypt"
+)
+
+// customerKey is an SSE-C key in the form S3 expects it in request headers.
+type customerKey struct {
+	// key is the base64-encoded 256-bit key.
+	key string
+	// md5 is the base64-encoded MD5 digest of the key, which S3 stores with
+	// each object and which identifies the key in logs.
+	md5 string
+}
+
+func newCustomerKey(rawKey string) customerKey {
+	hash := md5.Sum([]byte(rawKey))
+	return customerKey{
+		key: base64.StdEncoding.EncodeToString([]byte(rawKey)),
+		md5: base64.StdEncoding.EncodeToString(hash[:]),
+	}
+}
+
+// readPreviousCustomerKeys loads the retired SSE-C keys from the
+// comma-separated lists of files and secret references, in that order.
+func readPreviousCustomerKeys(files, secrets string) ([]customerKey, error) {
+	var keys []customerKey
+	for _, file := range splitList(files) {
+		rawKey, err := readCustomerKey(file)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, newCustomerKey(rawKey))
+	}
+	for _, secretRef := range splitList(secrets) {
+		rawKey, err := readCustomerKeyFromSecret(secretRef)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, newCustomerKey(rawKey))
+	}
+	return keys, nil
+}
+
+// splitList splits a comma-separated config value, ignoring blank entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// customerKeys returns the SSE-C keyring: the current key followed by the
+// previous keys, or nil if SSE-C is not in use.
+func (o *ObjectStore) customerKeys() []customerKey {
+	if o.sseCustomerKey == "" {
+		return nil
+	}
+	return append([]customerKey{{key: o.sseCustomerKey, md5: o.sseCustomerKeyMd5}}, o.previousCustomerKeys...)
+}
+
+// withCustomerKeys calls fn with each key of the keyring in order until fn
+// succeeds or fails for a reason other than a key mismatch. If no key
+// matches, the error for the current key is returned. fn is called once with
+// an empty key when SSE-C is not in use.
+//
+// S3 rejects a wrong key with the same status as a denied or invalid
+// request, so when the current key is rejected, object, a HeadObject
+// request for the object without SSE-C headers, is sent to tell them
+// apart: S3 answers it with 400 only if the object is encrypted with SSE-C.
+// If it succeeds, the object is not encrypted with SSE-C, e.g. because it
+// was written before SSE-C was configured, and fn is called with an empty
+// key.
+func (o *ObjectStore) withCustomerKeys(ctx context.Context, log logrus.FieldLogger, client s3Interface, object *s3.HeadObjectInput, fn func(customerKey) error) error {
+	keys := o.customerKeys()
+	if len(keys) == 0 {
+		return fn(customerKey{})
+	}
+
+	var firstErr error
+	for i, key := range keys {
+		err := fn(key)
+		if err == nil {
+			if i > 0 {
+				log.WithField("customerKeyMD5", key.md5).Info("Object is encrypted with a previous SSE-C key")
+			}
+			return nil
+		}
+		if !isCustomerKeyRejected(err) {
+			return err
+		}
+		if firstErr != nil {
+			continue
+		}
+		firstErr = err
+
+		_, headErr := client.HeadObject(ctx, object)
+		if headErr == nil {
+			log.Debug("Object is not encrypted with SSE-C")
+			return fn(customerKey{})
+		}
+		if !hasStatus(headErr, http.StatusBadRequest) {
+			// the request failed for another reason than the key
+			return err
+		}
+	}
+	return firstErr
+}
+
+// isCustomerKeyRejected reports whether err has the status S3 responds with
+// when a request has SSE-C headers that do not match the object: 403 for a
+// key other than the one the object was written with, and 400 for an
+// object that is not encrypted with SSE-C.
+func isCustomerKeyRejected(err error) bool {
+	return hasStatus(err, http.StatusBadRequest) || hasStatus(err, http.StatusForbidden)
+}
+
+func hasStatus(err error, status int) bool {
+	var respErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == status
+}
+
+// headObjectInput returns the input of a HeadObject request for key,
+// without SSE-C headers.
+func (o *ObjectStore) headObjectInput(bucket, key string) *s3.HeadObjectInput {
+	return &s3.HeadObjectInput{
+		Bucket:              aws.String(bucket),
+		Key:                 aws.String(key),
+		RequestPayer:        o.requestPayer,
+		ExpectedBucketOwner: o.expectedBucketOwner,
+	}
+}
+
+func setCustomerKey(algorithm, key, keyMD5 **string, ck customerKey) {
+	if ck.key == "" {
+		return
+	}
+	*algorithm = aws.String("AES256")
+	*key = aws.String(ck.key)
+	*keyMD5 = aws.String(ck.md5)
+}
+
+// findCustomerKey returns the keyring entry that the object was encrypted
+// with, or an empty key if the object is not encrypted with SSE-C.
+func (o *ObjectStore) findCustomerKey(ctx context.Context, log logrus.FieldLogger, bucket, key string) (customerKey, error) {
+	found, _, err := o.headObject(ctx, log, bucket, key)
+	return found, err
+}
+
+// headObject reads the metadata of an object with the keyring entry it was
+// encrypted with, and returns that entry along with the metadata.
+func (o *ObjectStore) headObject(ctx context.Context, log logrus.FieldLogger, bucket, key string) (customerKey, *s3.HeadObjectOutput, error) {
+	var found customerKey
+	var output *s3.HeadObjectOutput
+	object := o.headObjectInput(bucket, key)
+	err := o.withCustomerKeys(ctx, log, o.s3, object, func(ck customerKey) error {
+		input := *object
+		setCustomerKey(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5, ck)
+		var err error
+		if output, err = o.s3.HeadObject(ctx, &input); err != nil {
+			return err
+		}
+		found = ck
+		return nil
+	})
+	return found, output, err
+}
+
+// reencryptObjects rewrites every object under prefix that is not encrypted
+// with the current SSE-C key, including objects without SSE-C, so that it
+// is encrypted with the current key. Objects are copied in place on the
+// server, keeping their metadata and tags. It returns the number of objects
+// that were rewritten.
+func (o *ObjectStore) reencryptObjects(bucket, prefix string) (int, error) {
+	if o.sseCustomerKey == "" {
+		return 0, errors.New("SSE-C is not configured")
+	}
+	ctx := context.Background()
+	current := o.customerKeys()[0]
+
+	rewritten := 0
+	p := s3.NewListObjectsV2Paginator(o.s3, &s3.ListObjectsV2Input{
+		Bucket:              aws.String(bucket),
+		Prefix:              aws.String(prefix),
+		RequestPayer:        o.requestPayer,
+		ExpectedBucketOwner: o.expectedBucketOwner,
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return rewritten, errors.WithStack(err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			log := o.log.WithFields(logrus.Fields{"bucket": bucket, "key": key})
+
+			sourceKey, err := o.findCustomerKey(ctx, log, bucket, key)
+			if err != nil {
+				return rewritten, errors.Wrapf(err, "error finding SSE-C key of object %s", key)
+			}
+			if sourceKey.md5 == current.md5 {
+				continue
+			}
+			if aws.ToInt64(obj.Size) > maxCopyObjectSize {
+				return rewritten, errors.Errorf("object %s is larger than 5 GiB and cannot be re-encrypted with CopyObject", key)
+			}
+
+			input := &s3.CopyObjectInput{
+				Bucket:                    aws.String(bucket),
+				Key:                       aws.String(key),
+				CopySource:                aws.String(copySource(bucket, key)),
+				MetadataDirective:         types.MetadataDirectiveCopy,
+				TaggingDirective:          types.TaggingDirectiveCopy,
+				RequestPayer:              o.requestPayer,
+				ExpectedBucketOwner:       o.expectedBucketOwner,
+				ExpectedSourceBucketOwner: o.expectedBucketOwner,
+			}
+			setCustomerKey(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5, current)
+			setCustomerKey(&input.CopySourceSSECustomerAlgorithm, &input.CopySourceSSECustomerKey, &input.CopySourceSSECustomerKeyMD5, sourceKey)
+			if _, err := o.s3.CopyObject(ctx, input); err != nil {
+				return rewritten, errors.Wrapf(err, "error re-encrypting object %s", key)
+			}
+			log.WithField("customerKeyMD5", sourceKey.md5).Info("Re-encrypted object with the current SSE-C key")
+			rewritten++
+		}
+	}
+	return rewritten, nil
+}
+
+// runReencrypt re-encrypts the objects of a location with its current SSE-C
+// key and returns the process exit code.
+func runReencrypt(args []string, stdout, stderr io.Writer) int {
+	flags := pflag.NewFlagSet(reencryptCommand, pflag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		bslFile         = flags.String("backup-location", "", `path to a BackupStorageLocation YAML file, or "-" for stdin`)
+		credentialsFile = flags.String("credentials-file", "", "path to an AWS credentials file, as referenced by the location's credential")
+		prefix          = flags.String("prefix", "", `only re-encrypt the objects under this prefix of the location, e.g. "backups/"`)
+		logLevel        = flags.String("log-level", "warning", "level of the plugin logs written to stderr")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: velero-plugin-for-aws %s [flags]\n\nRewrites the objects of a location that are not encrypted with its current SSE-C key.\n\n", reencryptCommand)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *bslFile == "" {
+		fmt.Fprintln(stderr, "--backup-location is required")
+		return 2
+	}
+
+	o, config, err := initBackupStorageLocation(*bslFile, *credentialsFile, *logLevel, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	count, err := o.reencryptObjects(config[bucketKey], locationRoot(config[prefixKey])+*prefix)
+	fmt.Fprintf(stdout, "Re-encrypted %d objects\n", count)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
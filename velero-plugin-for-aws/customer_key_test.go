@@ -0,0 +1,214 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	currentTestKey  = newCustomerKey("0123456789abcdef0123456789abcdef")
+	previousTestKey = newCustomerKey("fedcba9876543210fedcba9876543210")
+)
+
+func newTestResponseError(status int) error {
+	return &awshttp.ResponseError{
+		ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+			Err:      errors.New(http.StatusText(status)),
+		},
+	}
+}
+
+func newKeyringObjectStore(s *mockS3) *ObjectStore {
+	return &ObjectStore{
+		log:                  newLogger(),
+		s3:                   s,
+		sseCustomerKey:       currentTestKey.key,
+		sseCustomerKeyMd5:    currentTestKey.md5,
+		previousCustomerKeys: []customerKey{previousTestKey},
+	}
+}
+
+func headWithKey(key string, ck customerKey) interface{} {
+	return mock.MatchedBy(func(input *s3.HeadObjectInput) bool {
+		return aws.ToString(input.Key) == key && aws.ToString(input.SSECustomerKeyMD5) == ck.md5
+	})
+}
+
+func TestGetObjectWithPreviousCustomerKey(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := newKeyringObjectStore(s)
+
+	getWithKey := func(ck customerKey) interface{} {
+		return mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+			return aws.ToString(input.SSECustomerKey) == ck.key && aws.ToString(input.SSECustomerKeyMD5) == ck.md5
+		})
+	}
+	s.On("GetObject", mock.Anything, getWithKey(currentTestKey)).Return(&s3.GetObjectOutput{}, newTestResponseError(http.StatusForbidden))
+	s.On("HeadObject", mock.Anything, headWithKey("k", customerKey{})).Return(&s3.HeadObjectOutput{}, newTestResponseError(http.StatusBadRequest))
+	s.On("GetObject", mock.Anything, getWithKey(previousTestKey)).Return(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("data"))}, nil)
+
+	body, err := o.GetObject("b", "k")
+	require.NoError(t, err)
+	data, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestObjectExistsWithCustomerKeys(t *testing.T) {
+	tests := []struct {
+		name           string
+		currentErr     error
+		previousErr    error
+		expectHead     bool
+		headErr        error
+		expectPrevious bool
+		expectedExists bool
+		expectedError  string
+	}{
+		{
+			name:           "current key matches",
+			expectedExists: true,
+		},
+		{
+			name:           "previous key matches",
+			currentErr:     newTestResponseError(http.StatusForbidden),
+			expectHead:     true,
+			headErr:        newTestResponseError(http.StatusBadRequest),
+			expectPrevious: true,
+			expectedExists: true,
+		},
+		{
+			name:           "no key matches returns the current key error",
+			currentErr:     newTestResponseError(http.StatusForbidden),
+			expectHead:     true,
+			headErr:        newTestResponseError(http.StatusBadRequest),
+			previousErr:    newTestResponseError(http.StatusForbidden),
+			expectPrevious: true,
+			expectedError:  "Forbidden",
+		},
+		{
+			name:          "access denied is not retried",
+			currentErr:    newTestResponseError(http.StatusForbidden),
+			expectHead:    true,
+			headErr:       newTestResponseError(http.StatusForbidden),
+			expectedError: "Forbidden",
+		},
+		{
+			name:           "object without SSE-C",
+			currentErr:     newTestResponseError(http.StatusBadRequest),
+			expectHead:     true,
+			expectedExists: true,
+		},
+		{
+			name:          "other errors are not retried",
+			currentErr:    errors.New("connection reset"),
+			expectedError: "connection reset",
+		},
+		{
+			name:           "missing object",
+			currentErr:     &types.NotFound{},
+			expectedExists: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := new(mockS3)
+			defer s.AssertExpectations(t)
+			o := newKeyringObjectStore(s)
+
+			s.On("HeadObject", mock.Anything, headWithKey("k", currentTestKey)).Return(&s3.HeadObjectOutput{}, tc.currentErr)
+			if tc.expectHead {
+				s.On("HeadObject", mock.Anything, headWithKey("k", customerKey{})).Return(&s3.HeadObjectOutput{}, tc.headErr)
+			}
+			if tc.expectPrevious {
+				s.On("HeadObject", mock.Anything, headWithKey("k", previousTestKey)).Return(&s3.HeadObjectOutput{}, tc.previousErr)
+			}
+
+			exists, err := o.ObjectExists("b", "k")
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedExists, exists)
+		})
+	}
+}
+
+func TestReencryptObjects(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := newKeyringObjectStore(s)
+
+	s.On("ListObjectsV2", mock.Anything, mock.Anything).Return(&s3.ListObjectsV2Output{
+		Contents: []types.Object{
+			{Key: aws.String("backups/b1/current"), Size: aws.Int64(10)},
+			{Key: aws.String("backups/b1/old file"), Size: aws.Int64(10)},
+		},
+	}, nil)
+	s.On("HeadObject", mock.Anything, headWithKey("backups/b1/current", currentTestKey)).Return(&s3.HeadObjectOutput{}, nil)
+	s.On("HeadObject", mock.Anything, headWithKey("backups/b1/old file", currentTestKey)).Return(&s3.HeadObjectOutput{}, newTestResponseError(http.StatusForbidden))
+	s.On("HeadObject", mock.Anything, headWithKey("backups/b1/old file", customerKey{})).Return(&s3.HeadObjectOutput{}, newTestResponseError(http.StatusBadRequest))
+	s.On("HeadObject", mock.Anything, headWithKey("backups/b1/old file", previousTestKey)).Return(&s3.HeadObjectOutput{}, nil)
+	s.On("CopyObject", mock.Anything, &s3.CopyObjectInput{
+		Bucket:                         aws.String("b"),
+		Key:                            aws.String("backups/b1/old file"),
+		CopySource:                     aws.String("b/backups%2Fb1%2Fold%20file"),
+		MetadataDirective:              types.MetadataDirectiveCopy,
+		TaggingDirective:               types.TaggingDirectiveCopy,
+		SSECustomerAlgorithm:           aws.String("AES256"),
+		SSECustomerKey:                 aws.String(currentTestKey.key),
+		SSECustomerKeyMD5:              aws.String(currentTestKey.md5),
+		CopySourceSSECustomerAlgorithm: aws.String("AES256"),
+		CopySourceSSECustomerKey:       aws.String(previousTestKey.key),
+		CopySourceSSECustomerKeyMD5:    aws.String(previousTestKey.md5),
+	}).Return(&s3.CopyObjectOutput{}, nil)
+
+	rewritten, err := o.reencryptObjects("b", "backups/b1/")
+	require.NoError(t, err)
+	assert.Equal(t, 1, rewritten)
+}
+
+func TestReencryptObjectsRequiresCustomerKey(t *testing.T) {
+	o := &ObjectStore{log: newLogger()}
+	_, err := o.reencryptObjects("b", "")
+	assert.EqualError(t, err, "SSE-C is not configured")
+}
+
+func TestRunReencryptRequiresBackupLocation(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 2, runReencrypt([]string{"--prefix", "backups/"}, &stdout, &stderr))
+	assert.Equal(t, "--backup-location is required\n", stderr.String())
+}
@@ -0,0 +1,89 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// directoryBucketDelimiter is the only delimiter directory buckets
+	// support.
+	directoryBucketDelimiter = "/"
+
+	// directoryBucketSessionAction authorizes the sessions of a directory
+	// bucket, and with them every request made in the session.
+	directoryBucketSessionAction = "s3express:CreateSession"
+)
+
+// directoryBucketName matches the names of S3 Express One Zone directory
+// buckets, bucket_base_name--zone-id--x-s3, e.g. "velero--use1-az4--x-s3".
+var directoryBucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*--[a-z0-9-]+--x-s3$`)
+
+// isDirectoryBucket reports whether bucket is a directory bucket. The S3
+// client authenticates requests to directory buckets with sessions from
+// CreateSession, which it creates and caches on its own.
+func isDirectoryBucket(bucket string) bool {
+	return directoryBucketName.MatchString(bucket)
+}
+
+// validateDirectoryBucket returns an error for the settings in config that
+// directory buckets do not support.
+func validateDirectoryBucket(config map[string]string) error {
+	bucket := config[bucketKey]
+	for _, key := range []string{taggingKey, taggingByPrefixKey, trashPrefixKey, kmsKeyIDKey, customerKeyEncryptionFileKey, customerKeyEncryptionSecretKey, s3URLKey} {
+		if config[key] != "" {
+			return errors.Errorf("%s cannot be used with directory bucket %s", key, bucket)
+		}
+	}
+	for _, key := range []string{s3ForcePathStyleKey, useAccelerateKey, useDualStackKey, versionedDeletesKey, readDeletedObjectsKey, requesterPaysKey} {
+		// invalid values are reported by Init
+		if enabled, _ := strconv.ParseBool(config[key]); enabled {
+			return errors.Errorf("%s cannot be used with directory bucket %s", key, bucket)
+		}
+	}
+
+	// the region cannot be looked up with HeadBucket
+	if config[regionKey] == "" {
+		return errors.Errorf("directory bucket %s requires %s", bucket, regionKey)
+	}
+	if sse := config[serverSideEncryptionKey]; sse != "" && sse != "AES256" {
+		return errors.Errorf("directory bucket %s only supports %s \"AES256\"", bucket, serverSideEncryptionKey)
+	}
+	if alg, ok := config[checksumAlgKey]; ok && alg == "" {
+		return errors.Errorf("directory bucket %s requires a %s, since directory buckets do not support Content-MD5", bucket, checksumAlgKey)
+	}
+	if version := config[signatureVersionKey]; version != "" && version != signatureVersion4 {
+		return errors.Errorf("directory bucket %s requires %s %q", bucket, signatureVersionKey, signatureVersion4)
+	}
+	return nil
+}
+
+// directoryBucketListPrefix returns the prefix to list in bucket to find
+// the keys under prefix. Directory buckets only list prefixes that end in
+// the delimiter, so keys under other prefixes are listed from the parent
+// prefix and filtered.
+func directoryBucketListPrefix(bucket, prefix string) string {
+	if !isDirectoryBucket(bucket) || prefix == "" || strings.HasSuffix(prefix, directoryBucketDelimiter) {
+		return prefix
+	}
+	return prefix[:strings.LastIndex(prefix, directoryBucketDelimiter)+1]
+}
@@ -0,0 +1,168 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDirectoryBucket = "velero--use1-az4--x-s3"
+
+func TestIsDirectoryBucket(t *testing.T) {
+	assert.True(t, isDirectoryBucket(testDirectoryBucket))
+	assert.True(t, isDirectoryBucket("backups--usw2-lax1-az1--x-s3"))
+	assert.False(t, isDirectoryBucket("velero"))
+	assert.False(t, isDirectoryBucket("velero--x-s3"))
+	assert.False(t, isDirectoryBucket(testAccessPointARN))
+}
+
+func TestDirectoryBucketInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]string
+		expectedErr string
+	}{
+		{
+			name:   "supported settings",
+			config: map[string]string{regionKey: "us-east-1", serverSideEncryptionKey: "AES256", checksumAlgKey: "CRC32C", useFIPSKey: "true"},
+		},
+		{
+			name:        "no region",
+			config:      map[string]string{},
+			expectedErr: "directory bucket velero--use1-az4--x-s3 requires region",
+		},
+		{
+			name:        "tagging",
+			config:      map[string]string{regionKey: "us-east-1", taggingKey: "team=backup"},
+			expectedErr: "tagging cannot be used with directory bucket velero--use1-az4--x-s3",
+		},
+		{
+			name:        "trash",
+			config:      map[string]string{regionKey: "us-east-1", trashPrefixKey: "trash"},
+			expectedErr: "trashPrefix cannot be used with directory bucket velero--use1-az4--x-s3",
+		},
+		{
+			name:        "SSE-KMS",
+			config:      map[string]string{regionKey: "us-east-1", kmsKeyIDKey: "alias/velero"},
+			expectedErr: "kmsKeyId cannot be used with directory bucket velero--use1-az4--x-s3",
+		},
+		{
+			name:        "path style",
+			config:      map[string]string{regionKey: "us-east-1", s3ForcePathStyleKey: "true"},
+			expectedErr: "s3ForcePathStyle cannot be used with directory bucket velero--use1-az4--x-s3",
+		},
+		{
+			name:        "versioning",
+			config:      map[string]string{regionKey: "us-east-1", versionedDeletesKey: "true"},
+			expectedErr: "versionedDeletes cannot be used with directory bucket velero--use1-az4--x-s3",
+		},
+		{
+			name:        "no checksum",
+			config:      map[string]string{regionKey: "us-east-1", checksumAlgKey: ""},
+			expectedErr: "directory bucket velero--use1-az4--x-s3 requires a checksumAlgorithm, since directory buckets do not support Content-MD5",
+		},
+		{
+			name:        "other encryption",
+			config:      map[string]string{regionKey: "us-east-1", serverSideEncryptionKey: "aws:kms"},
+			expectedErr: `directory bucket velero--use1-az4--x-s3 only supports serverSideEncryption "AES256"`,
+		},
+		{
+			name:        "SigV2",
+			config:      map[string]string{regionKey: "us-east-1", signatureVersionKey: "2"},
+			expectedErr: `directory bucket velero--use1-az4--x-s3 requires signatureVersion "4"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config[bucketKey] = testDirectoryBucket
+			err := newObjectStore(newLogger()).Init(test.config)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDirectoryBucketRequests(t *testing.T) {
+	var prefixes, sessionTokens []string
+	sessions := 0
+	client := newTestS3Client(t, func(req *http.Request) (*http.Response, error) {
+		assert.Equal(t, testDirectoryBucket+".s3express-use1-az4.us-east-1.amazonaws.com", req.URL.Host)
+		if req.URL.Query().Has("session") {
+			sessions++
+			return newTestResponse(req, http.StatusOK, `<CreateSessionResult><Credentials>`+
+				`<AccessKeyId>SESSIONKEY</AccessKeyId><SecretAccessKey>SESSIONSECRET</SecretAccessKey>`+
+				`<SessionToken>SESSIONTOKEN</SessionToken><Expiration>2099-01-01T00:00:00Z</Expiration>`+
+				`</Credentials></CreateSessionResult>`), nil
+		}
+		prefixes = append(prefixes, req.URL.Query().Get("prefix"))
+		sessionTokens = append(sessionTokens, req.Header.Get("X-Amz-S3session-Token"))
+		// directory buckets do not list keys in order
+		return newTestResponse(req, http.StatusOK, "<ListBucketResult>"+
+			"<Contents><Key>velero/backups-old</Key></Contents>"+
+			"<Contents><Key>velero/backups/b2/b2.tar.gz</Key></Contents>"+
+			"<Contents><Key>velero/restores/r1/r1.tar.gz</Key></Contents>"+
+			"<Contents><Key>velero/backups/b1/b1.tar.gz</Key></Contents>"+
+			"<CommonPrefixes><Prefix>velero/restores/</Prefix></CommonPrefixes>"+
+			"<CommonPrefixes><Prefix>velero/backups/</Prefix></CommonPrefixes>"+
+			"<CommonPrefixes><Prefix>velero/backups-archive/</Prefix></CommonPrefixes>"+
+			"</ListBucketResult>"), nil
+	})
+	o := &ObjectStore{log: newLogger(), s3: client}
+
+	keys, err := o.ListObjects(testDirectoryBucket, "velero/backups/b")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"velero/backups/b2/b2.tar.gz", "velero/backups/b1/b1.tar.gz"}, keys)
+
+	commonPrefixes, err := o.ListCommonPrefixes(testDirectoryBucket, "velero/backups", "/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"velero/backups-archive/", "velero/backups/"}, commonPrefixes)
+
+	_, err = o.ListCommonPrefixes(testDirectoryBucket, "velero/", "-")
+	assert.EqualError(t, err, `directory bucket velero--use1-az4--x-s3 only supports the delimiter "/"`)
+
+	assert.Equal(t, 1, sessions)
+	assert.Equal(t, []string{"velero/backups/", "velero/"}, prefixes)
+	assert.Equal(t, []string{"SESSIONTOKEN", "SESSIONTOKEN"}, sessionTokens)
+}
+
+func TestBackupStorageLocationPolicyDirectoryBucket(t *testing.T) {
+	policy := newIAMPolicy()
+	require.NoError(t, backupStorageLocationPolicy(policy, map[string]string{
+		bucketKey:        testDirectoryBucket,
+		regionKey:        "us-east-1",
+		prefixKey:        "velero",
+		replicaBucketKey: "velero-replica",
+		replicaRegionKey: "us-west-2",
+	}))
+	sids := make([]string, 0, len(policy.Statement))
+	for _, statement := range policy.Statement {
+		sids = append(sids, statement.Sid)
+	}
+	assert.Equal(t, []string{"S3ReplicaListPrefix", "S3ReplicaObjects", "S3ExpressSession"}, sids)
+	assert.Equal(t, []string{"s3express:CreateSession"}, policy.statement(policyTarget{
+		Sid:       "S3ExpressSession",
+		Resources: []string{"arn:aws:s3express:us-east-1:*:bucket/velero--use1-az4--x-s3"},
+	}).Action)
+}
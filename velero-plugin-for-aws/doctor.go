@@ -0,0 +1,380 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// doctorCommand is the first argument that runs the diagnostics instead
+// of the plugin server. The diagnostics live in the plugin binary so that
+// they run exactly the code that Velero runs, and can be used from the
+// plugin image without deploying Velero.
+const doctorCommand = "doctor"
+
+// doctorReport is the outcome of the diagnostics of one or both locations.
+type doctorReport struct {
+	BackupStorageLocation  *locationReport `json:"backupStorageLocation,omitempty"`
+	VolumeSnapshotLocation *locationReport `json:"volumeSnapshotLocation,omitempty"`
+}
+
+// locationReport is the outcome of the diagnostics of a location.
+type locationReport struct {
+	Name string `json:"name"`
+	// Identity is the ARN of the principal the credentials belong to.
+	Identity      string            `json:"identity,omitempty"`
+	IdentityError string            `json:"identityError,omitempty"`
+	InitError     string            `json:"initError,omitempty"`
+	Encryption    string            `json:"encryption,omitempty"`
+	Checks        []permissionCheck `json:"checks,omitempty"`
+	OK            bool              `json:"ok"`
+}
+
+// runDoctor runs the diagnostics for the locations given in args and
+// returns the process exit code.
+func runDoctor(args []string, stdout, stderr io.Writer) int {
+	flags := pflag.NewFlagSet(doctorCommand, pflag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		bslFile         = flags.String("backup-location", "", `path to a BackupStorageLocation YAML file, or "-" for stdin`)
+		vslFile         = flags.String("snapshot-location", "", `path to a VolumeSnapshotLocation YAML file, or "-" for stdin`)
+		credentialsFile = flags.String("credentials-file", "", "path to an AWS credentials file, as referenced by the location's credential")
+		output          = flags.StringP("output", "o", "text", `output format, "text" or "json"`)
+		logLevel        = flags.String("log-level", "warning", "level of the plugin logs written to stderr")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: velero-plugin-for-aws %s [flags]\n\nChecks connectivity, credentials, encryption and permissions of AWS locations.\n\n", doctorCommand)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *bslFile == "" && *vslFile == "" {
+		fmt.Fprintln(stderr, "at least one of --backup-location and --snapshot-location is required")
+		return 2
+	}
+	if *bslFile == "-" && *vslFile == "-" {
+		fmt.Fprintln(stderr, "only one of --backup-location and --snapshot-location can be read from stdin")
+		return 2
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(stderr, "invalid --output %q, expected \"text\" or \"json\"\n", *output)
+		return 2
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(stderr)
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	logger.SetLevel(level)
+
+	report := &doctorReport{}
+	if *bslFile != "" {
+		name, config, err := loadBackupStorageLocation(*bslFile, *credentialsFile)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		report.BackupStorageLocation = diagnoseBackupStorageLocation(name, config, logger)
+	}
+	if *vslFile != "" {
+		name, config, err := loadVolumeSnapshotLocation(*vslFile, *credentialsFile)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		report.VolumeSnapshotLocation = diagnoseVolumeSnapshotLocation(name, config, logger)
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	} else {
+		report.writeText(stdout)
+	}
+
+	if !report.ok() {
+		return 1
+	}
+	return 0
+}
+
+// loadBackupStorageLocation reads a BackupStorageLocation and returns the
+// config that Velero would pass to ObjectStore.Init.
+func loadBackupStorageLocation(file, credentialsFile string) (string, map[string]string, error) {
+	location := &velerov1.BackupStorageLocation{}
+	if err := readLocation(file, location); err != nil {
+		return "", nil, err
+	}
+	if err := checkProvider(location.Spec.Provider); err != nil {
+		return "", nil, err
+	}
+	if location.Spec.ObjectStorage == nil || location.Spec.ObjectStorage.Bucket == "" {
+		return "", nil, errors.Errorf("%s: spec.objectStorage.bucket is required", file)
+	}
+
+	config := map[string]string{}
+	for key, val := range location.Spec.Config {
+		config[key] = val
+	}
+	config[bucketKey] = location.Spec.ObjectStorage.Bucket
+	config[prefixKey] = location.Spec.ObjectStorage.Prefix
+	if location.Spec.ObjectStorage.CACert != nil {
+		config[caCertKey] = string(location.Spec.ObjectStorage.CACert)
+	}
+	if credentialsFile != "" {
+		config[credentialsFileKey] = credentialsFile
+	}
+	return location.Name, config, nil
+}
+
+// initBackupStorageLocation reads a BackupStorageLocation and initializes
+// the object store for it, with the plugin logs at logLevel written to
+// stderr.
+func initBackupStorageLocation(file, credentialsFile, logLevel string, stderr io.Writer) (*ObjectStore, map[string]string, error) {
+	logger := logrus.New()
+	logger.SetOutput(stderr)
+	level, err := logrus.ParseLevel(logLevel)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	logger.SetLevel(level)
+
+	_, config, err := loadBackupStorageLocation(file, credentialsFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	o := newObjectStore(logger)
+	if err := o.Init(config); err != nil {
+		return nil, nil, err
+	}
+	return o, config, nil
+}
+
+// loadVolumeSnapshotLocation reads a VolumeSnapshotLocation and returns the
+// config that Velero would pass to VolumeSnapshotter.Init.
+func loadVolumeSnapshotLocation(file, credentialsFile string) (string, map[string]string, error) {
+	location := &velerov1.VolumeSnapshotLocation{}
+	if err := readLocation(file, location); err != nil {
+		return "", nil, err
+	}
+	if err := checkProvider(location.Spec.Provider); err != nil {
+		return "", nil, err
+	}
+
+	config := map[string]string{}
+	for key, val := range location.Spec.Config {
+		config[key] = val
+	}
+	if credentialsFile != "" {
+		config[credentialsFileKey] = credentialsFile
+	}
+	return location.Name, config, nil
+}
+
+func readLocation(file string, location interface{}) error {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := yaml.UnmarshalStrict(data, location); err != nil {
+		return errors.Wrapf(err, "error parsing %s", file)
+	}
+	return nil
+}
+
+func checkProvider(provider string) error {
+	if provider != "velero.io/aws" && provider != "aws" {
+		return errors.Errorf("provider %q is not handled by this plugin", provider)
+	}
+	return nil
+}
+
+func diagnoseBackupStorageLocation(name string, config map[string]string, logger logrus.FieldLogger) *locationReport {
+	report := &locationReport{Name: name}
+
+	// An s3Url usually points at an S3-compatible service without STS.
+	if config[s3URLKey] == "" {
+		report.setIdentity(config[regionKey], config, logger)
+	}
+
+	config[validatePermissionsKey] = "true"
+	o := newObjectStore(logger)
+	if err := o.Init(config); err != nil {
+		report.InitError = err.Error()
+	}
+	// the permission check runs last, once the whole config is parsed
+	if o.permissionReport != nil {
+		report.Encryption = o.encryptionDescription()
+		report.Checks = o.permissionReport.Checks
+	}
+	report.OK = report.InitError == "" && report.IdentityError == ""
+	return report
+}
+
+func diagnoseVolumeSnapshotLocation(name string, config map[string]string, logger logrus.FieldLogger) *locationReport {
+	report := &locationReport{Name: name}
+	report.setIdentity(config[regionKey], config, logger)
+
+	config[validatePermissionsKey] = "true"
+	b := newVolumeSnapshotter(logger)
+	if err := b.Init(config); err != nil {
+		report.InitError = err.Error()
+	}
+	if b.ebsKmsKeyId != "" {
+		report.Encryption = "restored volumes encrypted with KMS key " + b.ebsKmsKeyId
+	}
+	if b.permissionReport != nil {
+		report.Checks = b.permissionReport.Checks
+	}
+	report.OK = report.InitError == "" && report.IdentityError == ""
+	return report
+}
+
+// setIdentity looks up the principal of the location's credentials with
+// STS, which needs no permissions.
+func (r *locationReport) setIdentity(region string, config map[string]string, logger logrus.FieldLogger) {
+	if region == "" {
+		region = "us-east-1"
+	}
+	// invalid settings are reported by Init
+	transport, _ := parseTransportSettings(config)
+	insecureSkipTLSVerify, _ := strconv.ParseBool(config[insecureSkipTLSVerifyKey])
+	secretCreds, err := locationSecretCredentials(config)
+	if err != nil {
+		r.IdentityError = err.Error()
+		return
+	}
+	webIdentity, err := parseWebIdentitySettings(config)
+	if err != nil {
+		r.IdentityError = err.Error()
+		return
+	}
+	roots, err := newRootCAs(logger, config[caCertKey], config[caCertFileKey])
+	if err != nil {
+		r.IdentityError = err.Error()
+		return
+	}
+	cfg, err := newConfigBuilder(logger).WithRegion(region).
+		WithProfile(config[credentialProfileKey]).
+		WithCredentialsFile(config[credentialsFileKey]).
+		WithCredentialsSecret(secretCreds).
+		WithWebIdentity(webIdentity).
+		WithTLSSettings(insecureSkipTLSVerify, roots, nil, 0).
+		WithTransportSettings(transport).Build()
+	if err != nil {
+		r.IdentityError = err.Error()
+		return
+	}
+	if webIdentity != nil && webIdentity.stsURL != "" {
+		// S3-compatible STS services may not implement GetCallerIdentity,
+		// and Build has already assumed the role
+		r.Identity = fmt.Sprintf("role %q assumed with %s", webIdentity.roleARN, webIdentity.stsURL)
+		return
+	}
+	identity, err := sts.NewFromConfig(cfg).GetCallerIdentity(context.Background(), &sts.GetCallerIdentityInput{})
+	if err != nil {
+		r.IdentityError = err.Error()
+		return
+	}
+	r.Identity = aws.ToString(identity.Arn)
+}
+
+// encryptionDescription describes how the object store encrypts objects.
+func (o *ObjectStore) encryptionDescription() string {
+	switch {
+	case o.kmsKeyID != "":
+		return "SSE-KMS with key " + o.kmsKeyID
+	case o.sseCustomerKey != "":
+		description := "SSE-C with key MD5 " + o.sseCustomerKeyMd5
+		if len(o.previousCustomerKeys) > 0 {
+			description += fmt.Sprintf(" and %d previous keys", len(o.previousCustomerKeys))
+		}
+		return description
+	case o.serverSideEncryption != "":
+		return "SSE with " + o.serverSideEncryption
+	}
+	return "bucket default"
+}
+
+func (r *doctorReport) ok() bool {
+	return (r.BackupStorageLocation == nil || r.BackupStorageLocation.OK) &&
+		(r.VolumeSnapshotLocation == nil || r.VolumeSnapshotLocation.OK)
+}
+
+func (r *doctorReport) writeText(w io.Writer) {
+	if r.BackupStorageLocation != nil {
+		r.BackupStorageLocation.writeText(w, "BackupStorageLocation")
+	}
+	if r.VolumeSnapshotLocation != nil {
+		r.VolumeSnapshotLocation.writeText(w, "VolumeSnapshotLocation")
+	}
+}
+
+func (r *locationReport) writeText(w io.Writer, kind string) {
+	status := "OK"
+	if !r.OK {
+		status = "PROBLEMS FOUND"
+	}
+	fmt.Fprintf(w, "%s %s: %s\n", kind, r.Name, status)
+	switch {
+	case r.IdentityError != "":
+		fmt.Fprintf(w, "  credentials: %s\n", r.IdentityError)
+	case r.Identity != "":
+		fmt.Fprintf(w, "  credentials: %s\n", r.Identity)
+	}
+	if r.Encryption != "" {
+		fmt.Fprintf(w, "  encryption:  %s\n", r.Encryption)
+	}
+	for _, check := range r.Checks {
+		fmt.Fprintf(w, "  %-10s  %-17s  %s on %s\n", check.Result, check.Operation, strings.Join(check.Actions, ", "), check.Resource)
+		if check.Error != "" {
+			fmt.Fprintf(w, "              %s\n", check.Error)
+		}
+	}
+	if r.InitError != "" {
+		fmt.Fprintf(w, "  error: %s\n", r.InitError)
+	}
+	fmt.Fprintln(w)
+}
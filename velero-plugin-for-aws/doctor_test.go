@@ -0,0 +1,161 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "location.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(content), 0600))
+	return file
+}
+
+func TestLoadBackupStorageLocation(t *testing.T) {
+	file := writeTestFile(t, `
+apiVersion: velero.io/v1
+kind: BackupStorageLocation
+metadata:
+  name: default
+  namespace: velero
+spec:
+  provider: velero.io/aws
+  objectStorage:
+    bucket: my-bucket
+    prefix: my-prefix
+  config:
+    region: us-west-2
+    kmsKeyId: alias/backups
+`)
+
+	name, config, err := loadBackupStorageLocation(file, "/credentials/cloud")
+	require.NoError(t, err)
+	assert.Equal(t, "default", name)
+	assert.Equal(t, map[string]string{
+		"bucket":          "my-bucket",
+		"prefix":          "my-prefix",
+		"region":          "us-west-2",
+		"kmsKeyId":        "alias/backups",
+		"credentialsFile": "/credentials/cloud",
+	}, config)
+}
+
+func TestLoadBackupStorageLocationErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		expectedErr string
+	}{
+		{
+			name:        "other provider",
+			content:     "spec:\n  provider: velero.io/gcp\n  objectStorage:\n    bucket: b\n",
+			expectedErr: `provider "velero.io/gcp" is not handled by this plugin`,
+		},
+		{
+			name:        "missing bucket",
+			content:     "spec:\n  provider: aws\n",
+			expectedErr: "spec.objectStorage.bucket is required",
+		},
+		{
+			name:        "unknown field",
+			content:     "spec:\n  provider: aws\n  bucket: b\n",
+			expectedErr: `unknown field "bucket"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := loadBackupStorageLocation(writeTestFile(t, test.content), "")
+			assert.ErrorContains(t, err, test.expectedErr)
+		})
+	}
+}
+
+func TestLoadVolumeSnapshotLocation(t *testing.T) {
+	file := writeTestFile(t, `
+apiVersion: velero.io/v1
+kind: VolumeSnapshotLocation
+metadata:
+  name: aws-default
+spec:
+  provider: velero.io/aws
+  config:
+    region: us-east-1
+    ebsKmsKeyId: alias/ebs
+`)
+
+	name, config, err := loadVolumeSnapshotLocation(file, "")
+	require.NoError(t, err)
+	assert.Equal(t, "aws-default", name)
+	assert.Equal(t, map[string]string{"region": "us-east-1", "ebsKmsKeyId": "alias/ebs"}, config)
+}
+
+func TestRunDoctorUsageErrors(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 2, runDoctor(nil, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "at least one of --backup-location and --snapshot-location is required")
+
+	stderr.Reset()
+	assert.Equal(t, 2, runDoctor([]string{"--backup-location", "bsl.yaml", "-o", "yaml"}, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), `invalid --output "yaml"`)
+	assert.Empty(t, stdout.String())
+}
+
+func TestDoctorReportOutput(t *testing.T) {
+	report := &doctorReport{
+		BackupStorageLocation: &locationReport{
+			Name:       "default",
+			Identity:   "arn:aws:iam::111122223333:user/velero",
+			Encryption: "SSE-KMS with key alias/backups",
+			Checks: []permissionCheck{
+				{Operation: "HeadBucket", Actions: []string{"s3:ListBucket"}, Resource: "s3://bucket", Result: checkPassed},
+				{Operation: "PutObject", Actions: []string{"s3:PutObject"}, Resource: "s3://bucket/key", Result: checkDenied, Error: "AccessDenied"},
+			},
+			InitError: "permission check failed: missing permissions: s3:PutObject on s3://bucket/key",
+		},
+	}
+	assert.False(t, report.ok())
+
+	var text bytes.Buffer
+	report.writeText(&text)
+	assert.Equal(t, `BackupStorageLocation default: PROBLEMS FOUND
+  credentials: arn:aws:iam::111122223333:user/velero
+  encryption:  SSE-KMS with key alias/backups
+  passed      HeadBucket         s3:ListBucket on s3://bucket
+  denied      PutObject          s3:PutObject on s3://bucket/key
+              AccessDenied
+  error: permission check failed: missing permissions: s3:PutObject on s3://bucket/key
+
+`, text.String())
+
+	data, err := json.Marshal(report)
+	require.NoError(t, err)
+	var decoded map[string]map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "denied", decoded["backupStorageLocation"]["checks"].([]interface{})[1].(map[string]interface{})["result"])
+	assert.Equal(t, false, decoded["backupStorageLocation"]["ok"])
+	assert.NotContains(t, decoded, "volumeSnapshotLocation")
+}
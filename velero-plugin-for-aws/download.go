@@ -0,0 +1,279 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// downloadCommand is the first argument that downloads a file of a
+	// backup or restore, sending the SSE-C headers that signed URLs created
+	// with signedURLRequireCustomerKey require.
+	downloadCommand = "download"
+
+	// downloadRequestPollInterval is how often the status of a
+	// DownloadRequest is checked while waiting for its URL.
+	downloadRequestPollInterval = time.Second
+
+	// customerKeyHeader is the SSE-C header that is listed in the signed
+	// headers of URLs that require the customer key.
+	customerKeyHeader = "x-amz-server-side-encryption-customer-key"
+)
+
+var downloadRequestResource = velerov1.SchemeGroupVersion.WithResource("downloadrequests")
+
+// requestDownloadURL creates a DownloadRequest for the file of the given
+// kind of a backup or restore, waits for Velero to process it and returns
+// its URL. The DownloadRequest is deleted once it is processed.
+func requestDownloadURL(ctx context.Context, client dynamic.Interface, namespace, kind, name string) (string, error) {
+	requests := client.Resource(downloadRequestResource).Namespace(namespace)
+
+	request := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": velerov1.SchemeGroupVersion.String(),
+		"kind":       "DownloadRequest",
+		"metadata": map[string]interface{}{
+			"name":      fmt.Sprintf("%s-%s", name, time.Now().Format("20060102150405")),
+			"namespace": namespace,
+		},
+		"spec": map[string]interface{}{
+			"target": map[string]interface{}{
+				"kind": kind,
+				"name": name,
+			},
+		},
+	}}
+	created, err := requests.Create(ctx, request, metav1.CreateOptions{})
+	if err != nil {
+		return "", errors.Wrap(err, "error creating DownloadRequest")
+	}
+	defer requests.Delete(context.Background(), created.GetName(), metav1.DeleteOptions{})
+
+	ticker := time.NewTicker(downloadRequestPollInterval)
+	defer ticker.Stop()
+	for {
+		current, err := requests.Get(ctx, created.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return "", errors.Wrapf(err, "error getting DownloadRequest %s", created.GetName())
+		}
+		phase, _, _ := unstructured.NestedString(current.Object, "status", "phase")
+		downloadURL, _, _ := unstructured.NestedString(current.Object, "status", "downloadURL")
+		if phase == string(velerov1.DownloadRequestPhaseProcessed) && downloadURL != "" {
+			return downloadURL, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", errors.Errorf("timed out waiting for DownloadRequest %s to be processed", created.GetName())
+		case <-ticker.C:
+		}
+	}
+}
+
+// requiresCustomerKey returns whether the SSE-C headers are signed into a
+// URL, which makes S3 reject requests for it that do not send them.
+func requiresCustomerKey(signedURL string) (bool, error) {
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		return false, errors.Wrap(err, "error parsing signed URL")
+	}
+	for _, header := range strings.Split(u.Query().Get("X-Amz-SignedHeaders"), ";") {
+		if header == customerKeyHeader {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// downloadSignedURL downloads a signed URL. If the URL requires the SSE-C
+// headers, they are sent with each of keys in turn until S3 accepts one.
+func downloadSignedURL(ctx context.Context, client *http.Client, signedURL string, keys []customerKey) (io.ReadCloser, error) {
+	required, err := requiresCustomerKey(signedURL)
+	if err != nil {
+		return nil, err
+	}
+	if !required {
+		return getSignedURL(ctx, client, signedURL, customerKey{})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("the signed URL requires an SSE-C customer key, but none was given")
+	}
+
+	for _, ck := range keys {
+		body, err := getSignedURL(ctx, client, signedURL, ck)
+		if hasStatus(err, http.StatusForbidden) {
+			continue
+		}
+		return body, err
+	}
+	return nil, errors.New("error downloading signed URL: none of the customer keys was accepted")
+}
+
+func getSignedURL(ctx context.Context, client *http.Client, signedURL string, ck customerKey) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, signedURL, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if ck.key != "" {
+		req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+		req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Key", ck.key)
+		req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Key-Md5", ck.md5)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error downloading signed URL")
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, &httpStatusError{status: res.StatusCode}
+	}
+	return res.Body, nil
+}
+
+// httpStatusError is returned for responses to a signed URL that are not
+// successful.
+type httpStatusError struct {
+	status int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("error downloading signed URL: %s", http.StatusText(e.status))
+}
+
+func (e *httpStatusError) HTTPStatusCode() int {
+	return e.status
+}
+
+// readCustomerKeyFiles reads the raw customer keys in files.
+func readCustomerKeyFiles(files []string) ([]customerKey, error) {
+	var keys []customerKey
+	for _, file := range files {
+		key, err := readCustomerKey(file)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, newCustomerKey(key))
+	}
+	return keys, nil
+}
+
+func runDownload(args []string, stdout, stderr io.Writer) int {
+	flags := pflag.NewFlagSet(downloadCommand, pflag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		kind        = flags.String("kind", "", `kind of the file to download, e.g. "BackupLog" or "RestoreResults"`)
+		name        = flags.String("name", "", "name of the backup or restore the file belongs to")
+		signedURL   = flags.String("url", "", "signed URL to download instead of requesting one from Velero")
+		keyFiles    = flags.StringSlice("customer-key-file", nil, "path to a file with a 32-byte SSE-C customer key of the location; may be repeated to also try previous keys")
+		namespace   = flags.String("namespace", "velero", "namespace Velero runs in")
+		kubeconfig  = flags.String("kubeconfig", "", "path to the kubeconfig file to use to reach Velero")
+		kubeContext = flags.String("kubecontext", "", "name of the kubeconfig context to use")
+		output      = flags.StringP("output", "o", "", "path of the file to write to, instead of stdout")
+		timeout     = flags.Duration("timeout", time.Minute, "how long to wait for the download")
+		decompress  = flags.Bool("decompress", true, "decompress the file, except for BackupContents which is written as the tarball")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: velero-plugin-for-aws %s [flags]\n\nDownloads a file of a backup or restore, sending the SSE-C customer key that its signed URL requires.\n\n", downloadCommand)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if (*signedURL == "") == (*kind == "" || *name == "") {
+		fmt.Fprintln(stderr, "either --url or both --kind and --name are required")
+		return 2
+	}
+
+	keys, err := readCustomerKeyFiles(*keyFiles)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if *signedURL == "" {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = *kubeconfig
+		restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: *kubeContext}).ClientConfig()
+		if err != nil {
+			fmt.Fprintln(stderr, errors.Wrap(err, "error loading kubeconfig"))
+			return 1
+		}
+		client, err := dynamic.NewForConfig(restConfig)
+		if err != nil {
+			fmt.Fprintln(stderr, errors.Wrap(err, "error creating kubernetes client"))
+			return 1
+		}
+		if *signedURL, err = requestDownloadURL(ctx, client, *namespace, *kind, *name); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+
+	body, err := downloadSignedURL(ctx, http.DefaultClient, *signedURL, keys)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer body.Close()
+
+	var reader io.Reader = body
+	if *decompress && *kind != string(velerov1.DownloadTargetKindBackupContents) {
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			fmt.Fprintln(stderr, errors.Wrap(err, "error decompressing download"))
+			return 1
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	writer := stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(stderr, errors.WithStack(err))
+			return 1
+		}
+		defer file.Close()
+		writer = file
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		fmt.Fprintln(stderr, errors.Wrap(err, "error writing download"))
+		return 1
+	}
+	return 0
+}
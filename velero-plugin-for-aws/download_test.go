@@ -0,0 +1,182 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDownloadSignedURL(t *testing.T) {
+	const signedHeaders = "host;x-amz-server-side-encryption-customer-algorithm;x-amz-server-side-encryption-customer-key;x-amz-server-side-encryption-customer-key-md5"
+
+	tests := []struct {
+		name          string
+		signedHeaders string
+		keys          []customerKey
+		expectedKeys  []string
+		expectedError string
+	}{
+		{
+			name:          "no SSE-C headers",
+			signedHeaders: "host",
+			keys:          []customerKey{currentTestKey},
+			expectedKeys:  []string{""},
+		},
+		{
+			name:          "current key",
+			signedHeaders: signedHeaders,
+			keys:          []customerKey{currentTestKey, previousTestKey},
+			expectedKeys:  []string{currentTestKey.key},
+		},
+		{
+			name:          "falls back to a previous key",
+			signedHeaders: signedHeaders,
+			keys:          []customerKey{previousTestKey, currentTestKey},
+			expectedKeys:  []string{previousTestKey.key, currentTestKey.key},
+		},
+		{
+			name:          "no key accepted",
+			signedHeaders: signedHeaders,
+			keys:          []customerKey{previousTestKey},
+			expectedKeys:  []string{previousTestKey.key},
+			expectedError: "error downloading signed URL: none of the customer keys was accepted",
+		},
+		{
+			name:          "no keys",
+			signedHeaders: signedHeaders,
+			expectedError: "the signed URL requires an SSE-C customer key, but none was given",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var sentKeys []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				key := r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key")
+				sentKeys = append(sentKeys, key)
+				if key != "" && (key != currentTestKey.key || r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5") != currentTestKey.md5) {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.Write([]byte("data"))
+			}))
+			defer server.Close()
+
+			body, err := downloadSignedURL(context.Background(), server.Client(), server.URL+"/b/k?X-Amz-SignedHeaders="+url.QueryEscape(tc.signedHeaders), tc.keys)
+			assert.Equal(t, tc.expectedKeys, sentKeys)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			defer body.Close()
+			data, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.Equal(t, "data", string(data))
+		})
+	}
+}
+
+func TestRequestDownloadURL(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		downloadRequestResource: "DownloadRequestList",
+	})
+
+	// the first get returns the request as created, the second as
+	// processed by Velero
+	gets := 0
+	client.PrependReactor("get", "downloadrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		if gets == 1 {
+			return false, nil, nil
+		}
+		obj, err := client.Tracker().Get(downloadRequestResource, action.GetNamespace(), action.(k8stesting.GetAction).GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		request := obj.(*unstructured.Unstructured).DeepCopy()
+		require.NoError(t, unstructured.SetNestedField(request.Object, "Processed", "status", "phase"))
+		require.NoError(t, unstructured.SetNestedField(request.Object, "https://example.com/b/k", "status", "downloadURL"))
+		return true, request, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	downloadURL, err := requestDownloadURL(ctx, client, "velero", "BackupLog", "backup-1")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/b/k", downloadURL)
+	assert.Equal(t, 2, gets)
+
+	var created *unstructured.Unstructured
+	var deleted bool
+	for _, action := range client.Actions() {
+		switch action := action.(type) {
+		case k8stesting.CreateAction:
+			created = action.GetObject().(*unstructured.Unstructured)
+		case k8stesting.DeleteAction:
+			deleted = true
+		}
+	}
+	require.NotNil(t, created)
+	target, _, _ := unstructured.NestedStringMap(created.Object, "spec", "target")
+	assert.Equal(t, map[string]string{"kind": "BackupLog", "name": "backup-1"}, target)
+	assert.True(t, deleted, "the DownloadRequest was not deleted")
+}
+
+func TestRunDownload(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("log line\n"))
+	require.NoError(t, gz.Close())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 0, runDownload([]string{"--url", server.URL + "/b/k"}, &stdout, &stderr), stderr.String())
+	assert.Equal(t, "log line\n", stdout.String())
+}
+
+func TestRunDownloadUsageErrors(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"--kind", "BackupLog"},
+		{"--url", "https://example.com", "--kind", "BackupLog", "--name", "backup-1"},
+	} {
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, 2, runDownload(args, &stdout, &stderr), args)
+		assert.Equal(t, "either --url or both --kind and --name are required\n", stderr.String(), args)
+	}
+}
@@ -36,27 +36,33 @@ func IsValidS3URLScheme(s3URL string) bool {
 	return true
 }
 
+// CheckTags returns an error if tagging is not a valid S3 tag set in the
+// URL query form of the x-amz-tagging header, e.g. "Key1=Value1&Key2=Value2".
 func CheckTags(tagging string) error {
-	tags := strings.Split(tagging, "&")
-	if len(tags) == 1 {
-		return errors.New("Tags are not seperated with an &")
+	_, err := parseTags(tagging)
+	return err
+}
+
+// isAccountID reports whether id is a 12-digit AWS account ID.
+func isAccountID(id string) bool {
+	if len(id) != 12 {
+		return false
 	}
-	for c, j := range tags {
-		if c > 9 {
-			return errors.New("Aws S3 allows only ten tags per object")
-		}
-		tg := strings.Split(j, "=")
-		if len(tg) != 2 {
-			return errors.New("invalid tags provided")
-		} else {
-			if len([]rune(tg[0])) > 128 {
-				return errors.New("An S3 tag key can not be more than 128 Unicode characters in length")
-			} else {
-				if len([]rune(tg[1])) > 248 {
-					return errors.New("An S3 tag values can not be more 256 Unicode characters in length")
-				}
-			}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
 		}
 	}
+	return true
+}
+
+// checkOutsideLocation checks that prefix, the value of key, does not
+// contain the prefix of the backup storage location, so that the objects the
+// plugin keeps under it are not mixed with backups.
+func checkOutsideLocation(config map[string]string, key, prefix string) error {
+	bslPrefix := strings.Trim(config[prefixKey], "/")
+	if bslPrefix != "" && strings.HasPrefix(bslPrefix+"/", strings.Trim(prefix, "/")+"/") {
+		return errors.Errorf("%s %q contains the prefix %q of the backup storage location", key, strings.Trim(prefix, "/"), bslPrefix)
+	}
 	return nil
 }
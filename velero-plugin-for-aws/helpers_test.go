@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -35,4 +36,7 @@ func TestS3Tags(t *testing.T) {
 	assert.Error(t, CheckTags("Key1=Value1&Key2=Value2&Key3-Value3&Key4=Value4&Key5=Value5&Key6=Value6&Key7=Value7&Key8=Value8&Key9=Value9&key10=Value10&Key11=Value11"))
 	assert.Nil(t, CheckTags("Key1=Value1&Key2=Value2"))
 	assert.ErrorIs(t, CheckTags("Key1=Value1&Key2=Value2&Key3=Value3"), nil)
+	assert.NoError(t, CheckTags("Key1=Value1"))
+	assert.NoError(t, CheckTags("Key1="+strings.Repeat("v", 256)))
+	assert.NoError(t, CheckTags("cost%20center=a%26b"))
 }
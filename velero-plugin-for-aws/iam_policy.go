@@ -0,0 +1,574 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// policyCommand is the first argument that prints the IAM policy needed by
+// the given locations instead of running the plugin server.
+const policyCommand = "policy"
+
+// veleroBackupTagKey is the tag Velero puts on every snapshot it creates,
+// which restored volumes inherit. The generated policy only allows
+// snapshots and volumes with this tag to be created and deleted.
+const veleroBackupTagKey = "velero.io/backup"
+
+// policyResource is the kind of resource an operation acts on. Each kind
+// becomes one statement of the generated policy.
+type policyResource int
+
+const (
+	resourceBucket policyResource = iota
+	// resourceBucketPrefix is the bucket, when listed under the prefix.
+	resourceBucketPrefix
+	resourceObjects
+	resourceKMSKey
+	resourceEC2All
+	resourceVolumes
+	resourceNewVeleroVolumes
+	resourceNewVeleroSnapshots
+	resourceVeleroSnapshots
+	// resourceTagOnCreate is a volume or snapshot tagged while created.
+	resourceTagOnCreate
+	resourceEBSKMSKey
+	// resourceEBSKMSKeyGrant is the EBS KMS key, granted to EC2.
+	resourceEBSKMSKeyGrant
+	// resourceTrashObjects are the objects under the trash prefix, and
+	// resourceTrashPrefix is the bucket, when listed under it.
+	resourceTrashObjects
+	resourceTrashPrefix
+	// resourceReplicaObjects are the objects of the replica bucket, and
+	// resourceReplicaPrefix is the replica bucket, when listed under the
+	// prefix.
+	resourceReplicaObjects
+	resourceReplicaPrefix
+	// resourceMirrorQueueObjects are the objects under the mirror queue
+	// prefix, and resourceMirrorQueuePrefix is the bucket, when listed
+	// under it.
+	resourceMirrorQueueObjects
+	resourceMirrorQueuePrefix
+	// resourceDirectoryBucket is a directory bucket, whose requests are
+	// all authorized by the session the S3 client creates for it.
+	resourceDirectoryBucket
+)
+
+// awsOperation is an AWS API call the plugin makes and the IAM actions it
+// needs on a resource. An operation that needs actions on several kinds of
+// resources has one entry per kind.
+type awsOperation struct {
+	Operation string
+	Actions   []string
+	Resource  policyResource
+	// when reports whether the call is made for a location config. A nil
+	// when means it always is.
+	when func(config map[string]string) bool
+}
+
+// objectStoreOperations are the calls made by ObjectStore, including
+// those of the S3 upload manager. The generated policies and the actions
+// reported by the permission check come from this table, and a test
+// checks that it lists every call in the code.
+var objectStoreOperations = []awsOperation{
+	{Operation: "HeadBucket", Actions: []string{"s3:ListBucket"}, Resource: resourceBucket, when: looksUpBucketRegion},
+	{Operation: "ListObjectsV2", Actions: []string{"s3:ListBucket"}, Resource: resourceBucketPrefix},
+	{Operation: "PutObject", Actions: []string{"s3:PutObject"}, Resource: resourceObjects},
+	{Operation: "PutObject", Actions: []string{"s3:PutObjectTagging"}, Resource: resourceObjects, when: usesTagging},
+	{Operation: "PutObject", Actions: []string{"kms:GenerateDataKey"}, Resource: resourceKMSKey, when: configSet(kmsKeyIDKey)},
+	{Operation: "CreateMultipartUpload", Actions: []string{"s3:PutObject"}, Resource: resourceObjects},
+	{Operation: "CreateMultipartUpload", Actions: []string{"s3:PutObjectTagging"}, Resource: resourceObjects, when: usesTagging},
+	{Operation: "CreateMultipartUpload", Actions: []string{"kms:GenerateDataKey"}, Resource: resourceKMSKey, when: configSet(kmsKeyIDKey)},
+	{Operation: "UploadPart", Actions: []string{"s3:PutObject"}, Resource: resourceObjects},
+	{Operation: "UploadPart", Actions: []string{"kms:Decrypt"}, Resource: resourceKMSKey, when: configSet(kmsKeyIDKey)},
+	{Operation: "CompleteMultipartUpload", Actions: []string{"s3:PutObject"}, Resource: resourceObjects},
+	{Operation: "CompleteMultipartUpload", Actions: []string{"kms:Decrypt"}, Resource: resourceKMSKey, when: configSet(kmsKeyIDKey)},
+	{Operation: "AbortMultipartUpload", Actions: []string{"s3:AbortMultipartUpload"}, Resource: resourceObjects},
+	{Operation: "HeadObject", Actions: []string{"s3:GetObject"}, Resource: resourceObjects},
+	{Operation: "GetObject", Actions: []string{"s3:GetObject"}, Resource: resourceObjects},
+	{Operation: "GetObject", Actions: []string{"kms:Decrypt"}, Resource: resourceKMSKey, when: configSet(kmsKeyIDKey)},
+	{Operation: "DeleteObject", Actions: []string{"s3:DeleteObject"}, Resource: resourceObjects},
+	// the retag command replaces the tags of existing objects.
+	{Operation: "PutObjectTagging", Actions: []string{"s3:PutObjectTagging"}, Resource: resourceObjects, when: usesTagging},
+	// versionedDeletes deletes the versions of an object, and
+	// readDeletedObjects reads them.
+	{Operation: "GetBucketVersioning", Actions: []string{"s3:GetBucketVersioning"}, Resource: resourceBucket, when: configTrue(versionedDeletesKey)},
+	{Operation: "ListObjectVersions", Actions: []string{"s3:ListBucketVersions"}, Resource: resourceBucketPrefix, when: usesObjectVersions},
+	{Operation: "DeleteObjects", Actions: []string{"s3:DeleteObjectVersion"}, Resource: resourceObjects, when: configTrue(versionedDeletesKey)},
+	{Operation: "GetObject", Actions: []string{"s3:GetObjectVersion"}, Resource: resourceObjects, when: configTrue(readDeletedObjectsKey)},
+	// the reencrypt command copies objects encrypted with a previous SSE-C
+	// key in place, with their tags.
+	{Operation: "CopyObject", Actions: []string{"s3:GetObject", "s3:GetObjectTagging", "s3:PutObject", "s3:PutObjectTagging"}, Resource: resourceObjects, when: rotatesCustomerKey},
+	// trashPrefix moves deleted objects to the trash with CopyObject, and
+	// the trash command purges and restores them.
+	{Operation: "CopyObject", Actions: []string{"s3:GetObject", "s3:PutObject", "s3:PutObjectTagging"}, Resource: resourceObjects, when: configSet(trashPrefixKey)},
+	{Operation: "CopyObject", Actions: []string{"s3:GetObject", "s3:PutObject", "s3:PutObjectTagging"}, Resource: resourceTrashObjects, when: configSet(trashPrefixKey)},
+	{Operation: "CopyObject", Actions: []string{"kms:Decrypt", "kms:GenerateDataKey"}, Resource: resourceKMSKey, when: allOf(configSet(trashPrefixKey), configSet(kmsKeyIDKey))},
+	{Operation: "HeadObject", Actions: []string{"s3:GetObject"}, Resource: resourceTrashObjects, when: configSet(trashPrefixKey)},
+	{Operation: "ListObjectsV2", Actions: []string{"s3:ListBucket"}, Resource: resourceTrashPrefix, when: configSet(trashPrefixKey)},
+	{Operation: "GetObjectTagging", Actions: []string{"s3:GetObjectTagging"}, Resource: resourceTrashObjects, when: configSet(trashPrefixKey)},
+	{Operation: "DeleteObject", Actions: []string{"s3:DeleteObject"}, Resource: resourceTrashObjects, when: configSet(trashPrefixKey)},
+	{Operation: "ListObjectVersions", Actions: []string{"s3:ListBucketVersions"}, Resource: resourceTrashPrefix, when: allOf(configSet(trashPrefixKey), configTrue(versionedDeletesKey))},
+	{Operation: "DeleteObjects", Actions: []string{"s3:DeleteObjectVersion"}, Resource: resourceTrashObjects, when: allOf(configSet(trashPrefixKey), configTrue(versionedDeletesKey))},
+	// replicaBucket is read when the bucket is unavailable.
+	{Operation: "ListObjectsV2", Actions: []string{"s3:ListBucket"}, Resource: resourceReplicaPrefix, when: configSet(replicaBucketKey)},
+	{Operation: "HeadObject", Actions: []string{"s3:GetObject"}, Resource: resourceReplicaObjects, when: configSet(replicaBucketKey)},
+	{Operation: "GetObject", Actions: []string{"s3:GetObject"}, Resource: resourceReplicaObjects, when: configSet(replicaBucketKey)},
+	// mirrorQueuePrefix queues objects that could not be mirrored, and the
+	// mirror command reconciles them. The mirror has its own credentials.
+	{Operation: "PutObject", Actions: []string{"s3:PutObject"}, Resource: resourceMirrorQueueObjects, when: configSet(mirrorQueuePrefixKey)},
+	{Operation: "PutObject", Actions: []string{"s3:PutObjectTagging"}, Resource: resourceMirrorQueueObjects, when: allOf(configSet(mirrorQueuePrefixKey), usesTagging)},
+	{Operation: "ListObjectsV2", Actions: []string{"s3:ListBucket"}, Resource: resourceMirrorQueuePrefix, when: configSet(mirrorQueuePrefixKey)},
+	{Operation: "DeleteObject", Actions: []string{"s3:DeleteObject"}, Resource: resourceMirrorQueueObjects, when: configSet(mirrorQueuePrefixKey)},
+	{Operation: "ListObjectVersions", Actions: []string{"s3:ListBucketVersions"}, Resource: resourceMirrorQueuePrefix, when: allOf(configSet(mirrorQueuePrefixKey), configTrue(versionedDeletesKey))},
+	{Operation: "DeleteObjects", Actions: []string{"s3:DeleteObjectVersion"}, Resource: resourceMirrorQueueObjects, when: allOf(configSet(mirrorQueuePrefixKey), configTrue(versionedDeletesKey))},
+	// the permission check deletes the version of its sentinel object.
+	{Operation: "DeleteObject", Actions: []string{"s3:DeleteObjectVersion"}, Resource: resourceObjects, when: configTrue(validatePermissionsKey)},
+	{Operation: "DescribeKey", Actions: []string{"kms:DescribeKey"}, Resource: resourceKMSKey, when: allOf(configTrue(validatePermissionsKey), configSet(kmsKeyIDKey))},
+	// The S3 client calls CreateSession before its first request to a
+	// directory bucket, and again when the session expires.
+	{Operation: "CreateSession", Actions: []string{directoryBucketSessionAction}, Resource: resourceDirectoryBucket, when: usesDirectoryBucket},
+}
+
+// volumeSnapshotterOperations are the calls made by VolumeSnapshotter.
+var volumeSnapshotterOperations = []awsOperation{
+	{Operation: "DescribeVolumes", Actions: []string{"ec2:DescribeVolumes"}, Resource: resourceEC2All},
+	{Operation: "DescribeSnapshots", Actions: []string{"ec2:DescribeSnapshots"}, Resource: resourceEC2All},
+	{Operation: "CreateSnapshot", Actions: []string{"ec2:CreateSnapshot"}, Resource: resourceVolumes},
+	{Operation: "CreateSnapshot", Actions: []string{"ec2:CreateSnapshot"}, Resource: resourceNewVeleroSnapshots},
+	{Operation: "CreateSnapshot", Actions: []string{"ec2:CreateTags"}, Resource: resourceTagOnCreate},
+	{Operation: "CreateVolume", Actions: []string{"ec2:CreateVolume"}, Resource: resourceVeleroSnapshots},
+	{Operation: "CreateVolume", Actions: []string{"ec2:CreateVolume"}, Resource: resourceNewVeleroVolumes},
+	{Operation: "CreateVolume", Actions: []string{"ec2:CreateTags"}, Resource: resourceTagOnCreate},
+	{Operation: "CreateVolume", Actions: []string{"kms:DescribeKey", "kms:Decrypt", "kms:GenerateDataKeyWithoutPlaintext", "kms:ReEncrypt*"}, Resource: resourceEBSKMSKey, when: configSet(ebsKmsKeyIDKey)},
+	{Operation: "CreateVolume", Actions: []string{"kms:CreateGrant"}, Resource: resourceEBSKMSKeyGrant, when: configSet(ebsKmsKeyIDKey)},
+	{Operation: "DeleteSnapshot", Actions: []string{"ec2:DeleteSnapshot"}, Resource: resourceVeleroSnapshots},
+	{Operation: "DescribeKey", Actions: []string{"kms:DescribeKey"}, Resource: resourceEBSKMSKey, when: allOf(configTrue(validatePermissionsKey), configSet(ebsKmsKeyIDKey))},
+}
+
+func configSet(key string) func(map[string]string) bool {
+	return func(config map[string]string) bool { return config[key] != "" }
+}
+
+func configTrue(key string) func(map[string]string) bool {
+	return func(config map[string]string) bool {
+		val, _ := strconv.ParseBool(config[key])
+		return val
+	}
+}
+
+func allOf(conditions ...func(map[string]string) bool) func(map[string]string) bool {
+	return func(config map[string]string) bool {
+		for _, condition := range conditions {
+			if !condition(config) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// looksUpBucketRegion reports whether Init calls HeadBucket, to find the
+// region of the bucket or to check permissions.
+func looksUpBucketRegion(config map[string]string) bool {
+	return (config[regionKey] == "" && config[s3URLKey] == "") || configTrue(validatePermissionsKey)(config)
+}
+
+func usesObjectVersions(config map[string]string) bool {
+	return configTrue(versionedDeletesKey)(config) || configTrue(readDeletedObjectsKey)(config)
+}
+
+func usesDirectoryBucket(config map[string]string) bool {
+	return isDirectoryBucket(config[bucketKey])
+}
+
+func usesTagging(config map[string]string) bool {
+	return config[taggingKey] != "" || config[taggingByPrefixKey] != ""
+}
+
+func usesCustomerKey(config map[string]string) bool {
+	return config[customerKeyEncryptionFileKey] != "" || config[customerKeyEncryptionSecretKey] != ""
+}
+
+// rotatesCustomerKey reports whether previous SSE-C keys are configured,
+// which the reencrypt command moves objects off.
+func rotatesCustomerKey(config map[string]string) bool {
+	return usesCustomerKey(config) && (config[previousCustomerKeyFilesKey] != "" || config[previousCustomerKeySecretsKey] != "")
+}
+
+// operationActions returns the actions operation needs for config, on all
+// resources.
+func operationActions(operations []awsOperation, operation string, config map[string]string) []string {
+	var actions []string
+	for _, op := range operations {
+		if op.Operation == operation && (op.when == nil || op.when(config)) {
+			actions = appendUnique(actions, op.Actions...)
+		}
+	}
+	return actions
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, existing := range list {
+			if existing == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+type iamPolicy struct {
+	Version   string         `json:"Version"`
+	Statement []iamStatement `json:"Statement"`
+}
+
+type iamStatement struct {
+	Sid       string       `json:"Sid"`
+	Effect    string       `json:"Effect"`
+	Action    []string     `json:"Action"`
+	Resource  []string     `json:"Resource"`
+	Condition iamCondition `json:"Condition,omitempty"`
+}
+
+// iamCondition maps condition operators to condition keys and values.
+type iamCondition map[string]map[string][]string
+
+func (c iamCondition) with(operator, key string, values ...string) iamCondition {
+	if c == nil {
+		c = iamCondition{}
+	}
+	if c[operator] == nil {
+		c[operator] = map[string][]string{}
+	}
+	c[operator][key] = values
+	return c
+}
+
+// policyTarget is the statement a kind of resource becomes for a location.
+// Kinds that resolve to the same Sid share a statement.
+type policyTarget struct {
+	Sid       string
+	Resources []string
+	Condition iamCondition
+}
+
+func newIAMPolicy() *iamPolicy {
+	return &iamPolicy{Version: "2012-10-17"}
+}
+
+// add allows the actions of the operations made for config. Targets of
+// another location that have the same Sid but other resources get a
+// numbered Sid.
+func (p *iamPolicy) add(operations []awsOperation, config map[string]string, targets map[policyResource]policyTarget) {
+	for _, op := range operations {
+		if op.when != nil && !op.when(config) {
+			continue
+		}
+		// resources without a target are not used by the location, e.g.
+		// the objects of a directory bucket
+		target, ok := targets[op.Resource]
+		if !ok {
+			continue
+		}
+		statement := p.statement(target)
+		statement.Action = appendUnique(statement.Action, op.Actions...)
+	}
+}
+
+// statement returns the statement of target, adding it if needed.
+func (p *iamPolicy) statement(target policyTarget) *iamStatement {
+	sid, n := target.Sid, 1
+	for i := 0; i < len(p.Statement); i++ {
+		statement := &p.Statement[i]
+		if statement.Sid != sid {
+			continue
+		}
+		if reflect.DeepEqual(statement.Resource, target.Resources) && reflect.DeepEqual(statement.Condition, target.Condition) {
+			return statement
+		}
+		n++
+		sid = fmt.Sprintf("%s%d", target.Sid, n)
+		i = -1
+	}
+	p.Statement = append(p.Statement, iamStatement{
+		Sid:       sid,
+		Effect:    "Allow",
+		Resource:  target.Resources,
+		Condition: target.Condition,
+	})
+	return &p.Statement[len(p.Statement)-1]
+}
+
+// backupStorageLocationPolicy returns the policy the object store needs
+// for the config that Velero passes to ObjectStore.Init.
+func backupStorageLocationPolicy(policy *iamPolicy, config map[string]string) error {
+	bucket := config[bucketKey]
+	if bucket == "" {
+		return errors.Errorf("missing %s in aws configuration", bucketKey)
+	}
+	bucketARN, err := parseBucketARN(bucket)
+	if err != nil {
+		return err
+	}
+
+	var bucketResource, objectsPrefix string
+	objects := "*"
+	if prefix := strings.Trim(config[prefixKey], "/"); prefix != "" {
+		objects = prefix + "/*"
+	}
+	region := config[regionKey]
+	if bucketARN != nil {
+		bucketResource = bucket
+		objectsPrefix = bucket + "/object/"
+		if region == "" {
+			region = bucketARN.Region
+		}
+	} else {
+		bucketResource = fmt.Sprintf("arn:%s:s3:::%s", awsPartition(region), bucket)
+		objectsPrefix = bucketResource + "/"
+	}
+	objectsResource := objectsPrefix + objects
+
+	targets := map[policyResource]policyTarget{
+		resourceBucket:       {Sid: "S3Bucket", Resources: []string{bucketResource}},
+		resourceBucketPrefix: {Sid: "S3Bucket", Resources: []string{bucketResource}},
+		resourceObjects:      {Sid: "S3Objects", Resources: []string{objectsResource}},
+	}
+	directory := isDirectoryBucket(bucket)
+	if directory {
+		if region == "" {
+			return errors.Errorf("directory bucket %s requires %s", bucket, regionKey)
+		}
+		// the bucket's account is not part of the location config
+		sessionResource := fmt.Sprintf("arn:%s:s3express:%s:*:bucket/%s", awsPartition(region), region, bucket)
+		targets = map[policyResource]policyTarget{
+			resourceDirectoryBucket: {Sid: "S3ExpressSession", Resources: []string{sessionResource}},
+		}
+	}
+	if objects != "*" && !directory {
+		targets[resourceBucketPrefix] = policyTarget{
+			Sid:       "S3ListPrefix",
+			Resources: []string{bucketResource},
+			Condition: iamCondition{}.with("StringLike", "s3:prefix", objects),
+		}
+	}
+	if trash := strings.Trim(config[trashPrefixKey], "/"); trash != "" && !directory {
+		targets[resourceTrashObjects] = policyTarget{Sid: "S3Trash", Resources: []string{objectsPrefix + trash + "/*"}}
+		targets[resourceTrashPrefix] = policyTarget{
+			Sid:       "S3ListTrash",
+			Resources: []string{bucketResource},
+			Condition: iamCondition{}.with("StringLike", "s3:prefix", trash+"/*"),
+		}
+	}
+	if queue := strings.Trim(config[mirrorQueuePrefixKey], "/"); queue != "" && !directory {
+		targets[resourceMirrorQueueObjects] = policyTarget{Sid: "S3MirrorQueue", Resources: []string{objectsPrefix + queue + "/*"}}
+		targets[resourceMirrorQueuePrefix] = policyTarget{
+			Sid:       "S3ListMirrorQueue",
+			Resources: []string{bucketResource},
+			Condition: iamCondition{}.with("StringLike", "s3:prefix", queue+"/*"),
+		}
+	}
+	if replica := config[replicaBucketKey]; replica != "" {
+		replicaRegion := config[replicaRegionKey]
+		if replicaRegion == "" {
+			replicaRegion = region
+		}
+		replicaResource := fmt.Sprintf("arn:%s:s3:::%s", awsPartition(replicaRegion), replica)
+		targets[resourceReplicaObjects] = policyTarget{Sid: "S3ReplicaObjects", Resources: []string{replicaResource + "/" + objects}}
+		targets[resourceReplicaPrefix] = policyTarget{Sid: "S3ReplicaBucket", Resources: []string{replicaResource}}
+		if objects != "*" {
+			targets[resourceReplicaPrefix] = policyTarget{
+				Sid:       "S3ReplicaListPrefix",
+				Resources: []string{replicaResource},
+				Condition: iamCondition{}.with("StringLike", "s3:prefix", objects),
+			}
+		}
+	}
+	if keyID := config[kmsKeyIDKey]; keyID != "" {
+		targets[resourceKMSKey] = kmsKeyTarget("S3KMSKey", keyID, region)
+	}
+
+	policy.add(objectStoreOperations, config, targets)
+	return nil
+}
+
+// volumeSnapshotLocationPolicy returns the policy the volume snapshotter
+// needs for the config that Velero passes to VolumeSnapshotter.Init.
+func volumeSnapshotLocationPolicy(policy *iamPolicy, config map[string]string) error {
+	region := config[regionKey]
+	if region == "" {
+		return errors.Errorf("missing %s in aws configuration", regionKey)
+	}
+	partition := awsPartition(region)
+	volumes := fmt.Sprintf("arn:%s:ec2:%s:*:volume/*", partition, region)
+	snapshots := fmt.Sprintf("arn:%s:ec2:%s::snapshot/*", partition, region)
+
+	targets := map[policyResource]policyTarget{
+		resourceEC2All:  {Sid: "EC2Describe", Resources: []string{"*"}},
+		resourceVolumes: {Sid: "EC2SnapshotVolumes", Resources: []string{volumes}},
+		resourceNewVeleroVolumes: {
+			Sid:       "EC2CreateVeleroVolumes",
+			Resources: []string{volumes},
+			Condition: iamCondition{}.with("Null", "aws:RequestTag/"+veleroBackupTagKey, "false"),
+		},
+		resourceNewVeleroSnapshots: {
+			Sid:       "EC2CreateVeleroSnapshots",
+			Resources: []string{snapshots},
+			Condition: iamCondition{}.with("Null", "aws:RequestTag/"+veleroBackupTagKey, "false"),
+		},
+		resourceVeleroSnapshots: {
+			Sid:       "EC2VeleroSnapshots",
+			Resources: []string{snapshots},
+			Condition: iamCondition{}.with("Null", "aws:ResourceTag/"+veleroBackupTagKey, "false"),
+		},
+		resourceTagOnCreate: {
+			Sid:       "EC2TagOnCreate",
+			Resources: []string{volumes, snapshots},
+			Condition: iamCondition{}.with("StringEquals", "ec2:CreateAction", "CreateSnapshot", "CreateVolume"),
+		},
+	}
+	if keyID := config[ebsKmsKeyIDKey]; keyID != "" {
+		targets[resourceEBSKMSKey] = kmsKeyTarget("EBSKMSKey", keyID, region)
+		grant := kmsKeyTarget("EBSKMSKeyGrant", keyID, region)
+		grant.Condition = grant.Condition.with("Bool", "kms:GrantIsForAWSResource", "true")
+		targets[resourceEBSKMSKeyGrant] = grant
+	}
+
+	policy.add(volumeSnapshotterOperations, config, targets)
+	return nil
+}
+
+// kmsKeyTarget returns the statement for a key given as a key ID, alias or
+// ARN. Aliases cannot be used as the resource of key operations, so keys
+// given by alias are matched with the kms:ResourceAliases condition.
+func kmsKeyTarget(sid, keyID, region string) policyTarget {
+	partition, account := awsPartition(region), "*"
+	if region == "" {
+		region = "*"
+	}
+	alias := ""
+	if parsed, err := arn.Parse(keyID); err == nil {
+		if !strings.HasPrefix(parsed.Resource, "alias/") {
+			return policyTarget{Sid: sid, Resources: []string{keyID}}
+		}
+		partition, region, account, alias = parsed.Partition, parsed.Region, parsed.AccountID, parsed.Resource
+	} else if strings.HasPrefix(keyID, "alias/") {
+		alias = keyID
+	}
+
+	if alias == "" {
+		return policyTarget{Sid: sid, Resources: []string{fmt.Sprintf("arn:%s:kms:%s:%s:key/%s", partition, region, account, keyID)}}
+	}
+	return policyTarget{
+		Sid:       sid,
+		Resources: []string{fmt.Sprintf("arn:%s:kms:%s:%s:key/*", partition, region, account)},
+		Condition: iamCondition{}.with("ForAnyValue:StringEquals", "kms:ResourceAliases", alias),
+	}
+}
+
+// awsPartition returns the partition of region, defaulting to "aws".
+func awsPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	case strings.HasPrefix(region, "us-iso-"):
+		return "aws-iso"
+	case strings.HasPrefix(region, "us-isob-"):
+		return "aws-iso-b"
+	}
+	return "aws"
+}
+
+// runPolicy prints the IAM policy needed by the locations given in args
+// and returns the process exit code.
+func runPolicy(args []string, stdout, stderr io.Writer) int {
+	flags := pflag.NewFlagSet(policyCommand, pflag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		bslFiles = flags.StringArray("backup-location", nil, `path to a BackupStorageLocation YAML file, or "-" for stdin; can be repeated`)
+		vslFiles = flags.StringArray("snapshot-location", nil, `path to a VolumeSnapshotLocation YAML file, or "-" for stdin; can be repeated`)
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: velero-plugin-for-aws %s [flags]\n\nPrints the least-privilege IAM policy the plugin needs for the given locations.\n\n", policyCommand)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(*bslFiles) == 0 && len(*vslFiles) == 0 {
+		fmt.Fprintln(stderr, "at least one of --backup-location and --snapshot-location is required")
+		return 2
+	}
+	stdin := 0
+	for _, file := range append(append([]string{}, *bslFiles...), *vslFiles...) {
+		if file == "-" {
+			stdin++
+		}
+	}
+	if stdin > 1 {
+		fmt.Fprintln(stderr, "only one location can be read from stdin")
+		return 2
+	}
+
+	policy := newIAMPolicy()
+	for _, file := range *bslFiles {
+		_, config, err := loadBackupStorageLocation(file, "")
+		if err == nil {
+			err = backupStorageLocationPolicy(policy, config)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+	for _, file := range *vslFiles {
+		_, config, err := loadVolumeSnapshotLocation(file, "")
+		if err == nil {
+			err = volumeSnapshotLocationPolicy(policy, config)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(policy); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
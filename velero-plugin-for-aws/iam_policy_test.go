@@ -0,0 +1,384 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOperationTablesListEveryCall fails when the code makes an S3, EC2 or
+// KMS call that is missing from the operation tables, which would leave
+// it out of the generated policies.
+func TestOperationTablesListEveryCall(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	require.NoError(t, err)
+
+	s3Calls, ec2Calls := map[string]bool{}, map[string]bool{}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		require.NoError(t, err)
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			method := sel.Sel.Name
+			var receiver string
+			switch x := sel.X.(type) {
+			case *ast.SelectorExpr:
+				receiver = x.Sel.Name
+			case *ast.Ident:
+				receiver = x.Name
+			}
+
+			switch {
+			case receiver == "s3" && strings.HasPrefix(method, "New") && strings.HasSuffix(method, "Paginator"):
+				s3Calls[strings.TrimSuffix(strings.TrimPrefix(method, "New"), "Paginator")] = true
+			// o.s3 and m.s3 are the clients of the bucket and the mirror,
+			// client the one withReplica passes to reads
+			case (receiver == "s3" && isFieldSelector(sel.X) || receiver == "client") && isS3ClientMethod(method):
+				s3Calls[method] = true
+			case receiver == "preSignS3":
+				s3Calls[strings.TrimPrefix(method, "Presign")] = true
+			case (receiver == "s3Uploader" || receiver == "uploader") && method == "Upload":
+				for _, op := range []string{"PutObject", "CreateMultipartUpload", "UploadPart", "CompleteMultipartUpload", "AbortMultipartUpload"} {
+					s3Calls[op] = true
+				}
+			case receiver == "manager" && method == "GetBucketRegion":
+				s3Calls["HeadBucket"] = true
+			case receiver == "ec2" && isFieldSelector(sel.X):
+				ec2Calls[method] = true
+			case method == "DescribeKey":
+				s3Calls[method] = true
+				ec2Calls[method] = true
+			}
+			return true
+		})
+	}
+
+	require.NotEmpty(t, s3Calls)
+	require.NotEmpty(t, ec2Calls)
+	for call := range s3Calls {
+		assert.True(t, hasOperation(objectStoreOperations, call), "objectStoreOperations does not list %s", call)
+	}
+	for call := range ec2Calls {
+		assert.True(t, hasOperation(volumeSnapshotterOperations, call), "volumeSnapshotterOperations does not list %s", call)
+	}
+}
+
+func isS3ClientMethod(method string) bool {
+	_, ok := reflect.TypeOf(&s3.Client{}).MethodByName(method)
+	return ok
+}
+
+func isFieldSelector(x ast.Expr) bool {
+	_, ok := x.(*ast.SelectorExpr)
+	return ok
+}
+
+func hasOperation(operations []awsOperation, name string) bool {
+	for _, op := range operations {
+		if op.Operation == name {
+			return true
+		}
+	}
+	return false
+}
+
+func policyJSON(t *testing.T, policy *iamPolicy) string {
+	t.Helper()
+	data, err := json.Marshal(policy)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestBackupStorageLocationPolicy(t *testing.T) {
+	policy := newIAMPolicy()
+	require.NoError(t, backupStorageLocationPolicy(policy, map[string]string{
+		bucketKey:   "my-bucket",
+		prefixKey:   "velero",
+		regionKey:   "us-east-1",
+		kmsKeyIDKey: "alias/backups",
+		taggingKey:  "team=storage",
+	}))
+
+	assert.JSONEq(t, `{
+		"Version": "2012-10-17",
+		"Statement": [
+			{
+				"Sid": "S3ListPrefix",
+				"Effect": "Allow",
+				"Action": ["s3:ListBucket"],
+				"Resource": ["arn:aws:s3:::my-bucket"],
+				"Condition": {"StringLike": {"s3:prefix": ["velero/*"]}}
+			},
+			{
+				"Sid": "S3Objects",
+				"Effect": "Allow",
+				"Action": ["s3:PutObject", "s3:PutObjectTagging", "s3:AbortMultipartUpload", "s3:GetObject", "s3:DeleteObject"],
+				"Resource": ["arn:aws:s3:::my-bucket/velero/*"]
+			},
+			{
+				"Sid": "S3KMSKey",
+				"Effect": "Allow",
+				"Action": ["kms:GenerateDataKey", "kms:Decrypt"],
+				"Resource": ["arn:aws:kms:us-east-1:*:key/*"],
+				"Condition": {"ForAnyValue:StringEquals": {"kms:ResourceAliases": ["alias/backups"]}}
+			}
+		]
+	}`, policyJSON(t, policy))
+}
+
+func TestBackupStorageLocationPolicyResources(t *testing.T) {
+	tests := []struct {
+		name              string
+		config            map[string]string
+		expectedBucket    string
+		expectedObjects   string
+		expectedStatement []string
+	}{
+		{
+			name:              "no region or prefix",
+			config:            map[string]string{bucketKey: "b"},
+			expectedBucket:    "arn:aws:s3:::b",
+			expectedObjects:   "arn:aws:s3:::b/*",
+			expectedStatement: []string{"S3Bucket", "S3Objects"},
+		},
+		{
+			name:              "china region",
+			config:            map[string]string{bucketKey: "b", regionKey: "cn-north-1"},
+			expectedBucket:    "arn:aws-cn:s3:::b",
+			expectedObjects:   "arn:aws-cn:s3:::b/*",
+			expectedStatement: []string{"S3Bucket", "S3Objects"},
+		},
+		{
+			name:              "access point",
+			config:            map[string]string{bucketKey: testAccessPointARN, prefixKey: "p/", regionKey: "us-west-2"},
+			expectedBucket:    testAccessPointARN,
+			expectedObjects:   testAccessPointARN + "/object/p/*",
+			expectedStatement: []string{"S3ListPrefix", "S3Objects"},
+		},
+		{
+			name:              "validatePermissions with SSE-C",
+			config:            map[string]string{bucketKey: "b", regionKey: "us-east-1", prefixKey: "p", validatePermissionsKey: "true", customerKeyEncryptionFileKey: "/key"},
+			expectedBucket:    "arn:aws:s3:::b",
+			expectedObjects:   "arn:aws:s3:::b/p/*",
+			expectedStatement: []string{"S3Bucket", "S3ListPrefix", "S3Objects"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := newIAMPolicy()
+			require.NoError(t, backupStorageLocationPolicy(policy, test.config))
+
+			var sids []string
+			for _, statement := range policy.Statement {
+				sids = append(sids, statement.Sid)
+				if statement.Sid == "S3Objects" {
+					assert.Equal(t, []string{test.expectedObjects}, statement.Resource)
+				} else {
+					assert.Equal(t, []string{test.expectedBucket}, statement.Resource)
+				}
+			}
+			assert.Equal(t, test.expectedStatement, sids)
+		})
+	}
+}
+
+func TestBackupStorageLocationPolicyCustomerKey(t *testing.T) {
+	policy := newIAMPolicy()
+	require.NoError(t, backupStorageLocationPolicy(policy, map[string]string{bucketKey: "b", regionKey: "us-east-1", customerKeyEncryptionSecretKey: "secret/key"}))
+	assert.Equal(t, []string{"s3:PutObject", "s3:AbortMultipartUpload", "s3:GetObject", "s3:DeleteObject"}, policy.statement(policyTarget{Sid: "S3Objects", Resources: []string{"arn:aws:s3:::b/*"}}).Action)
+
+	// the reencrypt command copies objects off the previous keys
+	policy = newIAMPolicy()
+	require.NoError(t, backupStorageLocationPolicy(policy, map[string]string{bucketKey: "b", regionKey: "us-east-1", customerKeyEncryptionSecretKey: "secret/key", previousCustomerKeySecretsKey: "secret/old"}))
+	assert.Equal(t, []string{"s3:PutObject", "s3:AbortMultipartUpload", "s3:GetObject", "s3:DeleteObject", "s3:GetObjectTagging", "s3:PutObjectTagging"}, policy.statement(policyTarget{Sid: "S3Objects", Resources: []string{"arn:aws:s3:::b/*"}}).Action)
+}
+
+func TestBackupStorageLocationPolicyTrash(t *testing.T) {
+	policy := newIAMPolicy()
+	require.NoError(t, backupStorageLocationPolicy(policy, map[string]string{bucketKey: "b", regionKey: "us-east-1", prefixKey: "velero", trashPrefixKey: "trash/"}))
+	assert.Equal(t, []string{"s3:GetObject", "s3:PutObject", "s3:PutObjectTagging", "s3:GetObjectTagging", "s3:DeleteObject"},
+		policy.statement(policyTarget{Sid: "S3Trash", Resources: []string{"arn:aws:s3:::b/trash/*"}}).Action)
+	assert.Equal(t, []string{"s3:ListBucket"}, policy.statement(policyTarget{
+		Sid:       "S3ListTrash",
+		Resources: []string{"arn:aws:s3:::b"},
+		Condition: iamCondition{}.with("StringLike", "s3:prefix", "trash/*"),
+	}).Action)
+	assert.Contains(t, policy.statement(policyTarget{Sid: "S3Objects", Resources: []string{"arn:aws:s3:::b/velero/*"}}).Action, "s3:PutObjectTagging")
+}
+
+func TestVolumeSnapshotLocationPolicy(t *testing.T) {
+	policy := newIAMPolicy()
+	require.NoError(t, volumeSnapshotLocationPolicy(policy, map[string]string{
+		regionKey:      "us-west-2",
+		ebsKmsKeyIDKey: "arn:aws:kms:us-west-2:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab",
+	}))
+
+	assert.JSONEq(t, `{
+		"Version": "2012-10-17",
+		"Statement": [
+			{
+				"Sid": "EC2Describe",
+				"Effect": "Allow",
+				"Action": ["ec2:DescribeVolumes", "ec2:DescribeSnapshots"],
+				"Resource": ["*"]
+			},
+			{
+				"Sid": "EC2SnapshotVolumes",
+				"Effect": "Allow",
+				"Action": ["ec2:CreateSnapshot"],
+				"Resource": ["arn:aws:ec2:us-west-2:*:volume/*"]
+			},
+			{
+				"Sid": "EC2CreateVeleroSnapshots",
+				"Effect": "Allow",
+				"Action": ["ec2:CreateSnapshot"],
+				"Resource": ["arn:aws:ec2:us-west-2::snapshot/*"],
+				"Condition": {"Null": {"aws:RequestTag/velero.io/backup": ["false"]}}
+			},
+			{
+				"Sid": "EC2TagOnCreate",
+				"Effect": "Allow",
+				"Action": ["ec2:CreateTags"],
+				"Resource": ["arn:aws:ec2:us-west-2:*:volume/*", "arn:aws:ec2:us-west-2::snapshot/*"],
+				"Condition": {"StringEquals": {"ec2:CreateAction": ["CreateSnapshot", "CreateVolume"]}}
+			},
+			{
+				"Sid": "EC2VeleroSnapshots",
+				"Effect": "Allow",
+				"Action": ["ec2:CreateVolume", "ec2:DeleteSnapshot"],
+				"Resource": ["arn:aws:ec2:us-west-2::snapshot/*"],
+				"Condition": {"Null": {"aws:ResourceTag/velero.io/backup": ["false"]}}
+			},
+			{
+				"Sid": "EC2CreateVeleroVolumes",
+				"Effect": "Allow",
+				"Action": ["ec2:CreateVolume"],
+				"Resource": ["arn:aws:ec2:us-west-2:*:volume/*"],
+				"Condition": {"Null": {"aws:RequestTag/velero.io/backup": ["false"]}}
+			},
+			{
+				"Sid": "EBSKMSKey",
+				"Effect": "Allow",
+				"Action": ["kms:DescribeKey", "kms:Decrypt", "kms:GenerateDataKeyWithoutPlaintext", "kms:ReEncrypt*"],
+				"Resource": ["arn:aws:kms:us-west-2:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"]
+			},
+			{
+				"Sid": "EBSKMSKeyGrant",
+				"Effect": "Allow",
+				"Action": ["kms:CreateGrant"],
+				"Resource": ["arn:aws:kms:us-west-2:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"],
+				"Condition": {"Bool": {"kms:GrantIsForAWSResource": ["true"]}}
+			}
+		]
+	}`, policyJSON(t, policy))
+
+	assert.EqualError(t, volumeSnapshotLocationPolicy(newIAMPolicy(), map[string]string{}), "missing region in aws configuration")
+}
+
+func TestKMSKeyTarget(t *testing.T) {
+	tests := []struct {
+		keyID             string
+		region            string
+		expectedResource  string
+		expectedCondition iamCondition
+	}{
+		{
+			keyID:            "1234abcd-12ab-34cd-56ef-1234567890ab",
+			region:           "eu-west-1",
+			expectedResource: "arn:aws:kms:eu-west-1:*:key/1234abcd-12ab-34cd-56ef-1234567890ab",
+		},
+		{
+			keyID:            "1234abcd-12ab-34cd-56ef-1234567890ab",
+			expectedResource: "arn:aws:kms:*:*:key/1234abcd-12ab-34cd-56ef-1234567890ab",
+		},
+		{
+			keyID:             "arn:aws-us-gov:kms:us-gov-west-1:111122223333:alias/backups",
+			region:            "us-gov-west-1",
+			expectedResource:  "arn:aws-us-gov:kms:us-gov-west-1:111122223333:key/*",
+			expectedCondition: iamCondition{"ForAnyValue:StringEquals": {"kms:ResourceAliases": {"alias/backups"}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.keyID, func(t *testing.T) {
+			target := kmsKeyTarget("Key", test.keyID, test.region)
+			assert.Equal(t, []string{test.expectedResource}, target.Resources)
+			assert.Equal(t, test.expectedCondition, target.Condition)
+		})
+	}
+}
+
+func TestIAMPolicyMultipleLocations(t *testing.T) {
+	policy := newIAMPolicy()
+	require.NoError(t, backupStorageLocationPolicy(policy, map[string]string{bucketKey: "a", regionKey: "us-east-1"}))
+	require.NoError(t, backupStorageLocationPolicy(policy, map[string]string{bucketKey: "b", regionKey: "us-east-1"}))
+	require.NoError(t, backupStorageLocationPolicy(policy, map[string]string{bucketKey: "a", regionKey: "us-east-1"}))
+
+	var sids []string
+	for _, statement := range policy.Statement {
+		sids = append(sids, statement.Sid)
+	}
+	assert.Equal(t, []string{"S3Bucket", "S3Objects", "S3Bucket2", "S3Objects2"}, sids)
+	assert.Equal(t, []string{"arn:aws:s3:::b/*"}, policy.Statement[3].Resource)
+}
+
+func TestPermissionCheckActionsFromTable(t *testing.T) {
+	config := map[string]string{kmsKeyIDKey: "k", taggingKey: "a=b"}
+	assert.Equal(t, []string{"s3:PutObject", "s3:PutObjectTagging", "kms:GenerateDataKey"}, operationActions(objectStoreOperations, "PutObject", config))
+	assert.Equal(t, []string{"s3:GetObject", "kms:Decrypt"}, operationActions(objectStoreOperations, "GetObject", config))
+	assert.Equal(t, []string{"ec2:CreateSnapshot", "ec2:CreateTags"}, operationActions(volumeSnapshotterOperations, "CreateSnapshot", nil))
+}
+
+func TestRunPolicy(t *testing.T) {
+	bsl := writeTestFile(t, "spec:\n  provider: velero.io/aws\n  objectStorage:\n    bucket: b\n  config:\n    region: us-east-1\n")
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 0, runPolicy([]string{"--backup-location", bsl}, &stdout, &stderr), stderr.String())
+	policy := &iamPolicy{}
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), policy))
+	assert.Equal(t, "2012-10-17", policy.Version)
+	assert.Len(t, policy.Statement, 2)
+
+	stderr.Reset()
+	assert.Equal(t, 2, runPolicy(nil, &stdout, &stderr))
+	assert.Equal(t, 2, runPolicy([]string{"--backup-location", "-", "--snapshot-location", "-"}, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "only one location can be read from stdin")
+}
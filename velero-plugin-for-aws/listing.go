@@ -0,0 +1,150 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+)
+
+// objectInfo is an object in a listing, with the metadata ListObjectsV2
+// returns for it.
+type objectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	StorageClass string    `json:"storageClass,omitempty"`
+	LastModified time.Time `json:"lastModified,omitzero"`
+}
+
+// objectLister lists the objects under a prefix one page at a time, like
+// the SDK's paginators, so that a large prefix is never held in memory at
+// once. Objects are returned in the order S3 lists them, which is not sorted
+// in directory buckets, including objects hidden from Velero.
+type objectLister struct {
+	paginator *s3.ListObjectsV2Paginator
+	prefix    string
+	// filter is set when a directory bucket is listed from the parent of
+	// prefix.
+	filter bool
+}
+
+// newObjectLister returns a lister of the objects under prefix of bucket,
+// read with client.
+func (o *ObjectStore) newObjectLister(client s3Interface, bucket, prefix string) *objectLister {
+	listPrefix := directoryBucketListPrefix(bucket, prefix)
+	return &objectLister{
+		paginator: s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+			Bucket:              aws.String(bucket),
+			Prefix:              aws.String(listPrefix),
+			RequestPayer:        o.requestPayer,
+			ExpectedBucketOwner: o.expectedBucketOwner,
+		}),
+		prefix: prefix,
+		filter: listPrefix != prefix,
+	}
+}
+
+func (l *objectLister) HasMorePages() bool {
+	return l.paginator.HasMorePages()
+}
+
+// NextPage returns the objects of the next page.
+func (l *objectLister) NextPage(ctx context.Context) ([]objectInfo, error) {
+	page, err := l.paginator.NextPage(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing objects under %s", l.prefix)
+	}
+	objects := make([]objectInfo, 0, len(page.Contents))
+	for _, obj := range page.Contents {
+		if l.filter && !strings.HasPrefix(aws.ToString(obj.Key), l.prefix) {
+			continue
+		}
+		objects = append(objects, objectInfo{
+			Key:          aws.ToString(obj.Key),
+			Size:         aws.ToInt64(obj.Size),
+			ETag:         aws.ToString(obj.ETag),
+			StorageClass: string(obj.StorageClass),
+			LastModified: aws.ToTime(obj.LastModified),
+		})
+	}
+	return objects, nil
+}
+
+// eachObject calls fn with each object under prefix.
+func (o *ObjectStore) eachObject(ctx context.Context, bucket, prefix string, fn func(objectInfo) error) error {
+	lister := o.newObjectLister(o.s3, bucket, prefix)
+	for lister.HasMorePages() {
+		objects, err := lister.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prefixStats summarizes the objects under a prefix.
+type prefixStats struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	// StorageClasses maps storage classes to the bytes stored in them.
+	StorageClasses map[string]int64 `json:"storageClasses,omitempty"`
+	Oldest         time.Time        `json:"oldest,omitzero"`
+	Newest         time.Time        `json:"newest,omitzero"`
+}
+
+func (s *prefixStats) add(obj objectInfo) {
+	s.Objects++
+	s.Bytes += obj.Size
+	if obj.StorageClass != "" {
+		if s.StorageClasses == nil {
+			s.StorageClasses = map[string]int64{}
+		}
+		s.StorageClasses[obj.StorageClass] += obj.Size
+	}
+	if !obj.LastModified.IsZero() {
+		if s.Oldest.IsZero() || obj.LastModified.Before(s.Oldest) {
+			s.Oldest = obj.LastModified
+		}
+		if obj.LastModified.After(s.Newest) {
+			s.Newest = obj.LastModified
+		}
+	}
+}
+
+// statPrefix summarizes the objects under prefix.
+func (o *ObjectStore) statPrefix(ctx context.Context, bucket, prefix string) (*prefixStats, error) {
+	stats := &prefixStats{}
+	err := o.eachObject(ctx, bucket, prefix, func(obj objectInfo) error {
+		stats.add(obj)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,192 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var testModified = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+func testObject(key string, size int64, storageClass types.ObjectStorageClass, age time.Duration) types.Object {
+	return types.Object{
+		Key:          aws.String(key),
+		Size:         aws.Int64(size),
+		ETag:         aws.String(`"etag"`),
+		StorageClass: storageClass,
+		LastModified: aws.Time(testModified.Add(-age)),
+	}
+}
+
+// listPages registers the pages of a listing of prefix with s.
+func listPages(s *mockS3, prefix string, pages ...[]types.Object) {
+	for i, page := range pages {
+		token, next := "", ""
+		if i > 0 {
+			token = string(rune('a' + i))
+		}
+		if i < len(pages)-1 {
+			next = string(rune('a' + i + 1))
+		}
+		output := &s3.ListObjectsV2Output{Contents: page}
+		if next != "" {
+			output.IsTruncated = aws.Bool(true)
+			output.NextContinuationToken = aws.String(next)
+		}
+		s.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+			return aws.ToString(input.Prefix) == prefix && aws.ToString(input.ContinuationToken) == token
+		})).Return(output, nil).Once()
+	}
+}
+
+func TestObjectLister(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := &ObjectStore{log: newLogger(), s3: s}
+
+	listPages(s, "backups/",
+		[]types.Object{testObject("backups/b1/b1.tar.gz", 100, types.ObjectStorageClassStandard, time.Hour)},
+		[]types.Object{testObject("backups/b2/b2.tar.gz", 200, types.ObjectStorageClassGlacierIr, 0)},
+	)
+
+	lister := o.newObjectLister(s, "bucket", "backups/")
+	var pages [][]objectInfo
+	for lister.HasMorePages() {
+		objects, err := lister.NextPage(context.Background())
+		require.NoError(t, err)
+		pages = append(pages, objects)
+	}
+	assert.Equal(t, [][]objectInfo{
+		{{Key: "backups/b1/b1.tar.gz", Size: 100, ETag: `"etag"`, StorageClass: "STANDARD", LastModified: testModified.Add(-time.Hour)}},
+		{{Key: "backups/b2/b2.tar.gz", Size: 200, ETag: `"etag"`, StorageClass: "GLACIER_IR", LastModified: testModified}},
+	}, pages)
+}
+
+func TestObjectListerError(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := &ObjectStore{log: newLogger(), s3: s}
+
+	s.On("ListObjectsV2", mock.Anything, mock.Anything).Return(&s3.ListObjectsV2Output{}, newTestResponseError(http.StatusForbidden))
+	_, err := o.newObjectLister(s, "bucket", "backups/").NextPage(context.Background())
+	assert.ErrorContains(t, err, "error listing objects under backups/")
+}
+
+func TestListObjectsReverseOrderAcrossPages(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := &ObjectStore{log: newLogger(), s3: s}
+
+	// the pseudo-folder object must come after the objects under it, even
+	// when they are listed on another page
+	listPages(s, "backups/",
+		[]types.Object{testObject("backups/b1/", 0, "", 0), testObject("backups/b1/a", 1, "", 0)},
+		[]types.Object{testObject("backups/b1/b", 1, "", 0)},
+	)
+	keys, err := o.ListObjects("bucket", "backups/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups/b1/b", "backups/b1/a", "backups/b1/"}, keys)
+}
+
+func TestStatPrefix(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := &ObjectStore{log: newLogger(), s3: s}
+
+	listPages(s, "backups/b1/",
+		[]types.Object{
+			testObject("backups/b1/b1.tar.gz", 300, types.ObjectStorageClassStandard, time.Hour),
+			testObject("backups/b1/b1-logs.gz", 100, types.ObjectStorageClassStandardIa, 2*time.Hour),
+		},
+		[]types.Object{testObject("backups/b1/b1-volumesnapshots.json.gz", 50, types.ObjectStorageClassStandard, 0)},
+	)
+
+	stats, err := o.statPrefix(context.Background(), "bucket", "backups/b1/")
+	require.NoError(t, err)
+	assert.Equal(t, &prefixStats{
+		Objects:        3,
+		Bytes:          450,
+		StorageClasses: map[string]int64{"STANDARD": 350, "STANDARD_IA": 100},
+		Oldest:         testModified.Add(-2 * time.Hour),
+		Newest:         testModified,
+	}, stats)
+}
+
+func TestLocationUsage(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := &ObjectStore{log: newLogger(), s3: s, trash: &trashSettings{prefix: "velero/trash/"}}
+
+	listPages(s, "velero/",
+		[]types.Object{
+			testObject("velero/backups/b1/b1.tar.gz", 2048, types.ObjectStorageClassStandard, 0),
+			testObject("velero/backups/b1/b1-logs.gz", 1024, types.ObjectStorageClassStandard, 0),
+			testObject("velero/backups/b2/b2.tar.gz", 1024, types.ObjectStorageClassStandard, 0),
+		},
+		[]types.Object{
+			testObject("velero/kopia/default/p1", 3<<20, types.ObjectStorageClassStandardIa, 0),
+			testObject("velero/trash/velero/backups/b0/b0.tar.gz", 512, types.ObjectStorageClassStandard, 0),
+			testObject("velero/README", 10, types.ObjectStorageClassStandard, 0),
+		},
+	)
+	listPages(s, "velero/trash/", []types.Object{testObject("velero/trash/velero/backups/b0/b0.tar.gz", 512, types.ObjectStorageClassStandard, 0)})
+
+	report, err := o.locationUsage(context.Background(), "bucket", "/velero/")
+	require.NoError(t, err)
+	assert.Equal(t, "velero", report.Prefix)
+	assert.Equal(t, int64(5), report.Total.Objects)
+	assert.Equal(t, []string{"backups", "kopia"}, sortedKeys(report.Directories))
+	assert.Equal(t, int64(4096), report.Directories["backups"].Bytes)
+	assert.Equal(t, int64(3072), report.Backups["b1"].Bytes)
+	assert.Equal(t, int64(1), report.Backups["b2"].Objects)
+	assert.Equal(t, int64(512), report.Trash.Bytes)
+
+	var text bytes.Buffer
+	report.writeText(&text)
+	assert.Equal(t, `bucket/velero: 5 objects, 3.0 MiB
+  STANDARD              4.0 KiB
+  STANDARD_IA           3.0 MiB
+
+Directories:
+  backups               3 objects, 4.0 KiB
+  kopia                 1 object, 3.0 MiB
+
+Backups:
+  b1                                        2 objects, 3.0 KiB
+  b2                                        1 object, 1.0 KiB
+
+Trash: 1 object, 512 B
+`, text.String())
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "0 B", formatBytes(0))
+	assert.Equal(t, "1023 B", formatBytes(1023))
+	assert.Equal(t, "1.5 KiB", formatBytes(1536))
+	assert.Equal(t, "2.0 GiB", formatBytes(2<<30))
+}
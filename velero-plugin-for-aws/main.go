@@ -17,12 +17,54 @@ limitations under the License.
 package main
 
 import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/framework"
 )
 
+// commands are run instead of the plugin server when the binary is started
+// with their name as the first argument. Each returns the exit code.
+var commands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	doctorCommand:    runDoctor,
+	policyCommand:    runPolicy,
+	trashCommand:     runTrash,
+	mirrorCommand:    runMirror,
+	usageCommand:     runUsage,
+	reencryptCommand: runReencrypt,
+	downloadCommand:  runDownload,
+	retagCommand:     runRetag,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	if addr := os.Getenv(metricsAddressEnvVar); addr != "" {
+		go serveMetrics(addr, logrus.New())
+	}
+
+	if endpoint := os.Getenv(tracingEndpointEnvVar); endpoint != "" {
+		shutdown, err := initTracing(endpoint)
+		if err != nil {
+			logrus.New().WithError(err).Warn("Tracing is disabled")
+		} else {
+			// interrupts are ignored by the plugin server, which waits for
+			// Velero to stop it
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGTERM)
+			go shutdownTracingOnSignal(shutdown, signals, os.Exit, logrus.New())
+			defer flushTracing(shutdown, logrus.New())
+		}
+	}
+
 	veleroplugin.NewServer().
 		BindFlags(pflag.CommandLine).
 		RegisterObjectStore("velero.io/aws", newAwsObjectStore).
@@ -0,0 +1,139 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+)
+
+const (
+	metadataKey          = "metadata"
+	cacheControlKey      = "cacheControl"
+	detectContentTypeKey = "detectContentType"
+
+	// maxMetadataSize is the limit S3 puts on the user metadata of an
+	// object, the total length of its keys and values.
+	maxMetadataSize = 2048
+)
+
+// metadataName matches the names of user metadata, which are sent as
+// x-amz-meta-* HTTP headers.
+var metadataName = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// contentTypes maps key suffixes to the Content-Type of the objects
+// uploaded by Velero. The first matching suffix is used. Files compressed
+// with gzip, including ".json.gz", are not given a Content-Encoding: Go's
+// HTTP client would decompress them when the velero CLI downloads them,
+// and the CLI then fails to decompress them again.
+var contentTypes = []struct {
+	suffix      string
+	contentType string
+}{
+	{suffix: ".gz", contentType: "application/gzip"},
+	{suffix: ".json", contentType: "application/json"},
+}
+
+// objectHeaders are the headers that PutObject sets on every object, in
+// addition to its tags and encryption.
+type objectHeaders struct {
+	metadata          map[string]string
+	cacheControl      string
+	detectContentType bool
+}
+
+// parseObjectHeaders returns the object headers set in config. Metadata
+// is given in the same form as tagging, e.g. "owner=backup&retention=30d".
+func parseObjectHeaders(config map[string]string) (objectHeaders, error) {
+	headers := objectHeaders{cacheControl: config[cacheControlKey]}
+	if val := config[detectContentTypeKey]; val != "" {
+		var err error
+		if headers.detectContentType, err = strconv.ParseBool(val); err != nil {
+			return objectHeaders{}, errors.Wrapf(err, "could not parse %s (expected bool)", detectContentTypeKey)
+		}
+	}
+
+	val := config[metadataKey]
+	if val == "" {
+		return headers, nil
+	}
+	values, err := url.ParseQuery(val)
+	if err != nil {
+		return objectHeaders{}, errors.Wrapf(err, "could not parse %s", metadataKey)
+	}
+	headers.metadata = map[string]string{}
+	size := 0
+	for name, vals := range values {
+		if !metadataName.MatchString(name) {
+			return objectHeaders{}, errors.Errorf("invalid %s name %q", metadataKey, name)
+		}
+		if len(vals) > 1 {
+			return objectHeaders{}, errors.Errorf("%s name %q is set more than once", metadataKey, name)
+		}
+		if !isPrintableASCII(vals[0]) {
+			return objectHeaders{}, errors.Errorf("%s value of %q must be printable ASCII", metadataKey, name)
+		}
+		// S3 stores metadata names in lowercase
+		name = strings.ToLower(name)
+		if _, ok := headers.metadata[name]; ok {
+			return objectHeaders{}, errors.Errorf("%s name %q is set more than once", metadataKey, name)
+		}
+		headers.metadata[name] = vals[0]
+		size += len(name) + len(vals[0])
+	}
+	if size > maxMetadataSize {
+		return objectHeaders{}, errors.Errorf("%s is %d bytes, S3 allows at most %d bytes of user metadata", metadataKey, size, maxMetadataSize)
+	}
+	return headers, nil
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// apply sets the headers on the upload of input.Key.
+func (h objectHeaders) apply(input *s3.PutObjectInput) {
+	if len(h.metadata) > 0 {
+		input.Metadata = make(map[string]string, len(h.metadata))
+		for name, value := range h.metadata {
+			input.Metadata[name] = value
+		}
+	}
+	if h.cacheControl != "" {
+		input.CacheControl = aws.String(h.cacheControl)
+	}
+	if !h.detectContentType {
+		return
+	}
+	for _, t := range contentTypes {
+		if strings.HasSuffix(aws.ToString(input.Key), t.suffix) {
+			input.ContentType = aws.String(t.contentType)
+			return
+		}
+	}
+}
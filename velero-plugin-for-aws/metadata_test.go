@@ -0,0 +1,123 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseObjectHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]string
+		expected    objectHeaders
+		expectedErr string
+	}{
+		{
+			name:   "not configured",
+			config: map[string]string{},
+		},
+		{
+			name:     "all headers",
+			config:   map[string]string{metadataKey: "Owner=backup-team&retention=30d&note=" + "weekly%20backups", cacheControlKey: "no-cache", detectContentTypeKey: "true"},
+			expected: objectHeaders{metadata: map[string]string{"owner": "backup-team", "retention": "30d", "note": "weekly backups"}, cacheControl: "no-cache", detectContentType: true},
+		},
+		{
+			name:        "invalid name",
+			config:      map[string]string{metadataKey: "cost center=42"},
+			expectedErr: `invalid metadata name "cost center"`,
+		},
+		{
+			name:        "name set twice",
+			config:      map[string]string{metadataKey: "owner=a&Owner=b"},
+			expectedErr: `metadata name "owner" is set more than once`,
+		},
+		{
+			name:        "non-ASCII value",
+			config:      map[string]string{metadataKey: "owner=équipe"},
+			expectedErr: `metadata value of "owner" must be printable ASCII`,
+		},
+		{
+			name:        "too large",
+			config:      map[string]string{metadataKey: "note=" + strings.Repeat("x", maxMetadataSize)},
+			expectedErr: "metadata is 2052 bytes, S3 allows at most 2048 bytes of user metadata",
+		},
+		{
+			name:        "invalid bool",
+			config:      map[string]string{detectContentTypeKey: "yes"},
+			expectedErr: `could not parse detectContentType (expected bool): strconv.ParseBool: parsing "yes": invalid syntax`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers, err := parseObjectHeaders(test.config)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, headers)
+		})
+	}
+}
+
+func TestPutObjectHeaders(t *testing.T) {
+	headers := map[string]http.Header{}
+	client := newTestS3Client(t, func(req *http.Request) (*http.Response, error) {
+		headers[strings.TrimPrefix(req.URL.Path, "/")] = req.Header
+		return newTestResponse(req, http.StatusOK, ""), nil
+	})
+	o := &ObjectStore{
+		log:        newLogger(),
+		s3:         client,
+		s3Uploader: manager.NewUploader(client),
+		headers: objectHeaders{
+			metadata:          map[string]string{"owner": "backup-team"},
+			cacheControl:      "no-cache",
+			detectContentType: true,
+		},
+	}
+
+	tests := []struct {
+		key         string
+		contentType string
+	}{
+		{key: "backups/b1/b1.tar.gz", contentType: "application/gzip"},
+		{key: "backups/b1/b1-resource-list.json.gz", contentType: "application/gzip"},
+		{key: "backups/b1/b1-logs.gz", contentType: "application/gzip"},
+		{key: "backups/b1/velero-backup.json", contentType: "application/json"},
+		// the SDK's default
+		{key: "restic/default/config", contentType: "application/octet-stream"},
+	}
+	for _, test := range tests {
+		require.NoError(t, o.PutObject("bucket", test.key, strings.NewReader("data")))
+		header := headers[test.key]
+		require.NotNil(t, header, test.key)
+		assert.Equal(t, test.contentType, header.Get("Content-Type"), test.key)
+		// a Content-Encoding would make HTTP clients decompress the file
+		assert.Empty(t, header.Get("Content-Encoding"), test.key)
+		assert.Equal(t, "no-cache", header.Get("Cache-Control"), test.key)
+		assert.Equal(t, "backup-team", header.Get("X-Amz-Meta-Owner"), test.key)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// metricsAddressEnvVar enables the metrics endpoint when set to a
+	// listen address such as "127.0.0.1:8085".
+	metricsAddressEnvVar = "VELERO_AWS_METRICS_ADDRESS"
+	metricsNamespace     = "velero_plugin_aws"
+
+	serviceLabel   = "service"
+	operationLabel = "operation"
+	bucketLabel    = "bucket"
+	regionLabel    = "region"
+	codeLabel      = "code"
+	directionLabel = "direction"
+	kindLabel      = "kind"
+	resultLabel    = "result"
+
+	directionUpload   = "upload"
+	directionDownload = "download"
+
+	reloadResultSuccess = "success"
+	reloadResultFailure = "failure"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	operationLabels = []string{serviceLabel, operationLabel, bucketLabel, regionLabel}
+
+	operationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Time taken by AWS API operations, including retries.",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+		},
+		operationLabels,
+	)
+	operationTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "operations_total",
+			Help:      "Total number of AWS API operations.",
+		},
+		operationLabels,
+	)
+	operationErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "operation_errors_total",
+			Help:      "Total number of failed AWS API operations by error code.",
+		},
+		append(operationLabels, codeLabel),
+	)
+	operationRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "operation_retries_total",
+			Help:      "Total number of retried attempts of AWS API operations.",
+		},
+		operationLabels,
+	)
+	transferredBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "transferred_bytes_total",
+			Help:      "Total number of object bytes uploaded to or downloaded from S3.",
+		},
+		append(operationLabels, directionLabel),
+	)
+	reloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "file_reloads_total",
+			Help:      "Total number of reloads of changed credentials, CA and client certificate files.",
+		},
+		[]string{kindLabel, resultLabel},
+	)
+	listCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "list_cache_requests_total",
+			Help:      "Total number of listings and existence checks looked up in the listing cache, by result.",
+		},
+		[]string{operationLabel, resultLabel},
+	)
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		operationDuration,
+		operationTotal,
+		operationErrors,
+		operationRetries,
+		transferredBytes,
+		reloadsTotal,
+		listCacheRequests,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// serveMetrics exposes the plugin metrics on addr until the listener fails.
+// Velero may run several instances of the plugin binary at once; only the
+// first one to bind addr serves metrics, the others log a warning.
+func serveMetrics(addr string, log logrus.FieldLogger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Infof("Serving metrics on %s", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.WithError(err).Warn("Metrics server stopped")
+	}
+}
+
+// metricsAPIOptions returns the middleware that records operation metrics
+// for an SDK client. bucket is empty for clients that do not target S3.
+func metricsAPIOptions(bucket, region string) []func(*middleware.Stack) error {
+	return []func(*middleware.Stack) error{
+		func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(&operationMetrics{bucket: bucket, region: region}, middleware.After)
+		},
+		func(stack *middleware.Stack) error {
+			return stack.Deserialize.Add(&transferMetrics{bucket: bucket, region: region}, middleware.Before)
+		},
+	}
+}
+
+// operationMetrics records the latency, outcome and retry count of each
+// operation. It runs once per operation, outside of the retry loop.
+type operationMetrics struct {
+	bucket string
+	region string
+}
+
+func (*operationMetrics) ID() string {
+	return "VeleroOperationMetrics"
+}
+
+func (m *operationMetrics) HandleInitialize(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (
+	out middleware.InitializeOutput, metadata middleware.Metadata, err error,
+) {
+	start := time.Now()
+	out, metadata, err = next.HandleInitialize(ctx, in)
+
+	labels := prometheus.Labels{
+		serviceLabel:   awsmiddleware.GetServiceID(ctx),
+		operationLabel: awsmiddleware.GetOperationName(ctx),
+		bucketLabel:    m.bucket,
+		regionLabel:    m.region,
+	}
+	operationDuration.With(labels).Observe(time.Since(start).Seconds())
+	operationTotal.With(labels).Inc()
+	if results, ok := retry.GetAttemptResults(metadata); ok && len(results.Results) > 1 {
+		operationRetries.With(labels).Add(float64(len(results.Results) - 1))
+	}
+	if err != nil {
+		operationErrors.MustCurryWith(labels).WithLabelValues(errorCode(err)).Inc()
+	}
+	return out, metadata, err
+}
+
+// transferMetrics counts the payload bytes sent and received by object
+// transfer operations. It runs once per attempt, so retried uploads are
+// counted each time they are sent.
+type transferMetrics struct {
+	bucket string
+	region string
+}
+
+func (*transferMetrics) ID() string {
+	return "VeleroTransferMetrics"
+}
+
+func (m *transferMetrics) HandleDeserialize(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (
+	out middleware.DeserializeOutput, metadata middleware.Metadata, err error,
+) {
+	operation := awsmiddleware.GetOperationName(ctx)
+	labels := prometheus.Labels{
+		serviceLabel:   awsmiddleware.GetServiceID(ctx),
+		operationLabel: operation,
+		bucketLabel:    m.bucket,
+		regionLabel:    m.region,
+	}
+
+	switch operation {
+	case "PutObject", "UploadPart":
+		if req, ok := in.Request.(*smithyhttp.Request); ok && req.ContentLength > 0 {
+			transferredBytes.MustCurryWith(labels).WithLabelValues(directionUpload).Add(float64(req.ContentLength))
+		}
+	}
+
+	out, metadata, err = next.HandleDeserialize(ctx, in)
+
+	if operation == "GetObject" && err == nil {
+		if resp, ok := out.RawResponse.(*smithyhttp.Response); ok && resp.ContentLength > 0 {
+			transferredBytes.MustCurryWith(labels).WithLabelValues(directionDownload).Add(float64(resp.ContentLength))
+		}
+	}
+	return out, metadata, err
+}
+
+// errorCode returns the AWS error code of err, or a coarse classification
+// when the error did not come from the service.
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	var sendErr *smithyhttp.RequestSendError
+	if errors.As(err, &sendErr) {
+		return "RequestSendError"
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return "Canceled"
+	}
+	return "Unknown"
+}
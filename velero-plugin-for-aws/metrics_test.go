@@ -0,0 +1,99 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestS3Client returns an S3 client that sends every request to do
+// instead of the network.
+func newTestS3Client(t *testing.T, do func(*http.Request) (*http.Response, error), apiOptions ...func(*middleware.Stack) error) *s3.Client {
+	t.Helper()
+	cfg := aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		HTTPClient:  smithyhttp.ClientDoFunc(do),
+		APIOptions:  apiOptions,
+	}
+	client, err := newS3Client(cfg, "", false)
+	require.NoError(t, err)
+	return client
+}
+
+func newTestResponse(req *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		Header:        http.Header{},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	bucket := "metrics-test-bucket"
+	attempts := 0
+	client := newTestS3Client(t, func(req *http.Request) (*http.Response, error) {
+		switch {
+		case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/retried"):
+			attempts++
+			if attempts == 1 {
+				return newTestResponse(req, http.StatusServiceUnavailable, ""), nil
+			}
+			return newTestResponse(req, http.StatusOK, "hello"), nil
+		case req.Method == http.MethodGet:
+			return newTestResponse(req, http.StatusForbidden, "<Error><Code>AccessDenied</Code><Message>denied</Message></Error>"), nil
+		case req.Method == http.MethodPut:
+			return newTestResponse(req, http.StatusOK, ""), nil
+		}
+		return newTestResponse(req, http.StatusNotImplemented, ""), nil
+	}, metricsAPIOptions(bucket, "us-east-1")...)
+
+	out, err := client.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String("retried")})
+	require.NoError(t, err)
+	out.Body.Close()
+
+	_, err = client.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String("denied")})
+	require.Error(t, err)
+
+	_, err = client.PutObject(context.Background(), &s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String("put"), Body: strings.NewReader("abcdefgh")})
+	require.NoError(t, err)
+
+	getLabels := []string{"S3", "GetObject", bucket, "us-east-1"}
+	putLabels := []string{"S3", "PutObject", bucket, "us-east-1"}
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(operationTotal.WithLabelValues(getLabels...)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(operationTotal.WithLabelValues(putLabels...)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(operationRetries.WithLabelValues(getLabels...)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(operationErrors.WithLabelValues(append(getLabels, "AccessDenied")...)))
+	assert.Equal(t, float64(5), testutil.ToFloat64(transferredBytes.WithLabelValues(append(getLabels, directionDownload)...)))
+	assert.Equal(t, float64(8), testutil.ToFloat64(transferredBytes.WithLabelValues(append(putLabels, directionUpload)...)))
+}
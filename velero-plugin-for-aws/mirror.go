@@ -0,0 +1,398 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	mirrorBucketKey                    = "mirrorBucket"
+	mirrorRegionKey                    = "mirrorRegion"
+	mirrorS3URLKey                     = "mirrorS3Url"
+	mirrorS3ForcePathStyleKey          = "mirrorS3ForcePathStyle"
+	mirrorCredentialsFileKey           = "mirrorCredentialsFile"
+	mirrorProfileKey                   = "mirrorProfile"
+	mirrorCACertKey                    = "mirrorCaCert"
+	mirrorKMSKeyIDKey                  = "mirrorKmsKeyId"
+	mirrorServerSideEncryptionKey      = "mirrorServerSideEncryption"
+	mirrorCustomerKeyEncryptionFileKey = "mirrorCustomerKeyEncryptionFile"
+	mirrorFailurePolicyKey             = "mirrorFailurePolicy"
+	mirrorQueuePrefixKey               = "mirrorQueuePrefix"
+
+	// mirrorFailurePolicyFail fails the write or delete when the mirror
+	// fails, and mirrorFailurePolicyQueue logs the failure and queues the
+	// object for "mirror reconcile".
+	mirrorFailurePolicyFail  = "fail"
+	mirrorFailurePolicyQueue = "queue"
+
+	// mirrorCommand is the first argument that reconciles the mirror of a
+	// location instead of running the plugin server.
+	mirrorCommand = "mirror"
+
+	// defaultMirrorRegion is the region of an S3-compatible mirror, which
+	// is only used for signing.
+	defaultMirrorRegion = "us-east-1"
+)
+
+// objectMirror is a second bucket, usually at another provider, that every
+// object written to or deleted from the bucket is also written to or deleted
+// from, with its own credentials and encryption.
+type objectMirror struct {
+	bucket   string
+	s3       s3Interface
+	uploader *manager.Uploader
+
+	kmsKeyID             string
+	serverSideEncryption string
+	customerKey          customerKey
+
+	failurePolicy string
+	// queuePrefix ends with a slash. The bucket has an empty object under
+	// it for each object whose mirroring failed.
+	queuePrefix string
+}
+
+// newObjectMirror returns the mirror of a location, or nil if it has none.
+// The mirror uses the transport settings of the location.
+func newObjectMirror(log logrus.FieldLogger, config map[string]string, transport transportSettings, tlsMinVersion uint16) (*objectMirror, error) {
+	bucket := config[mirrorBucketKey]
+	if bucket == "" {
+		key := firstSetKey(config, mirrorRegionKey, mirrorS3URLKey, mirrorS3ForcePathStyleKey, mirrorCredentialsFileKey, mirrorProfileKey,
+			mirrorCACertKey, mirrorKMSKeyIDKey, mirrorServerSideEncryptionKey, mirrorCustomerKeyEncryptionFileKey, mirrorFailurePolicyKey, mirrorQueuePrefixKey)
+		if key != "" {
+			return nil, errors.Errorf("%s requires %s", key, mirrorBucketKey)
+		}
+		return nil, nil
+	}
+
+	m := &objectMirror{
+		bucket:               bucket,
+		kmsKeyID:             config[mirrorKMSKeyIDKey],
+		serverSideEncryption: config[mirrorServerSideEncryptionKey],
+		failurePolicy:        config[mirrorFailurePolicyKey],
+	}
+	switch m.failurePolicy {
+	case "":
+		m.failurePolicy = mirrorFailurePolicyFail
+	case mirrorFailurePolicyFail, mirrorFailurePolicyQueue:
+	default:
+		return nil, errors.Errorf("invalid %s %q, expected %q or %q", mirrorFailurePolicyKey, m.failurePolicy, mirrorFailurePolicyFail, mirrorFailurePolicyQueue)
+	}
+	queuePrefix := strings.Trim(config[mirrorQueuePrefixKey], "/")
+	if m.failurePolicy == mirrorFailurePolicyQueue && queuePrefix == "" {
+		return nil, errors.Errorf("%s %q requires %s", mirrorFailurePolicyKey, mirrorFailurePolicyQueue, mirrorQueuePrefixKey)
+	}
+	if m.failurePolicy != mirrorFailurePolicyQueue && queuePrefix != "" {
+		return nil, errors.Errorf("%s requires %s %q", mirrorQueuePrefixKey, mirrorFailurePolicyKey, mirrorFailurePolicyQueue)
+	}
+	if queuePrefix != "" {
+		m.queuePrefix = queuePrefix + "/"
+		if err := checkOutsideLocation(config, mirrorQueuePrefixKey, m.queuePrefix); err != nil {
+			return nil, err
+		}
+	}
+
+	encryption := 0
+	for _, key := range []string{mirrorKMSKeyIDKey, mirrorServerSideEncryptionKey, mirrorCustomerKeyEncryptionFileKey} {
+		if config[key] != "" {
+			encryption++
+		}
+	}
+	if encryption > 1 {
+		return nil, errors.Errorf("you can only use one of: %s, %s or %s", mirrorKMSKeyIDKey, mirrorServerSideEncryptionKey, mirrorCustomerKeyEncryptionFileKey)
+	}
+	if file := config[mirrorCustomerKeyEncryptionFileKey]; file != "" {
+		key, err := readCustomerKey(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading %s", mirrorCustomerKeyEncryptionFileKey)
+		}
+		m.customerKey = newCustomerKey(key)
+	}
+
+	region, s3URL := config[mirrorRegionKey], config[mirrorS3URLKey]
+	if region == "" {
+		if s3URL == "" {
+			return nil, errors.Errorf("%s requires %s or %s", mirrorBucketKey, mirrorRegionKey, mirrorS3URLKey)
+		}
+		region = defaultMirrorRegion
+	}
+	var forcePathStyle bool
+	if val := config[mirrorS3ForcePathStyleKey]; val != "" {
+		var err error
+		if forcePathStyle, err = strconv.ParseBool(val); err != nil {
+			return nil, errors.Wrapf(err, "could not parse %s (expected bool)", mirrorS3ForcePathStyleKey)
+		}
+	}
+	roots, err := newRootCAs(log, config[mirrorCACertKey], "")
+	if err != nil {
+		return nil, err
+	}
+
+	// the mirror never uses the credentials of the location or of the
+	// environment, such as IRSA, which an explicit profile keeps the SDK
+	// from picking up
+	credentialsFile, profile := config[mirrorCredentialsFileKey], config[mirrorProfileKey]
+	if credentialsFile == "" && profile == "" {
+		return nil, errors.Errorf("%s requires %s or %s", mirrorBucketKey, mirrorCredentialsFileKey, mirrorProfileKey)
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	cfg, err := newConfigBuilder(log).WithRegion(region).
+		WithProfile(profile).
+		WithSharedFiles(credentialsFile).
+		WithTLSSettings(false, roots, nil, tlsMinVersion).
+		WithTransportSettings(transport).Build()
+	if err != nil {
+		return nil, errors.Wrap(err, "error configuring the mirror")
+	}
+	cfg.APIOptions = append(cfg.APIOptions, metricsAPIOptions(bucket, cfg.Region)...)
+	cfg.APIOptions = append(cfg.APIOptions, tracingAPIOptions(cfg.Region)...)
+
+	client, err := newS3Client(cfg, s3URL, forcePathStyle)
+	if err != nil {
+		return nil, err
+	}
+	m.s3 = client
+	m.uploader = manager.NewUploader(client)
+	return m, nil
+}
+
+// queued reports whether key is in the mirror queue.
+func (m *objectMirror) queued(key string) bool {
+	return m != nil && m.queuePrefix != "" && strings.HasPrefix(key, m.queuePrefix)
+}
+
+// put uploads body to key of the mirror, encrypted with the mirror's
+// settings.
+func (m *objectMirror) put(ctx context.Context, key string, body io.Reader, tagging, checksumAlg string, headers objectHeaders) error {
+	input := &s3.PutObjectInput{
+		Bucket:  aws.String(m.bucket),
+		Key:     aws.String(key),
+		Body:    body,
+		Tagging: optionalString(tagging),
+	}
+	switch {
+	case m.kmsKeyID != "":
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(m.kmsKeyID)
+	case m.customerKey.key != "":
+		setCustomerKey(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5, m.customerKey)
+	case m.serverSideEncryption != "":
+		input.ServerSideEncryption = types.ServerSideEncryption(m.serverSideEncryption)
+	}
+	if checksumAlg != "" {
+		input.ChecksumAlgorithm = types.ChecksumAlgorithm(checksumAlg)
+	}
+	headers.apply(input)
+
+	_, err := m.uploader.Upload(ctx, input)
+	return errors.Wrapf(err, "error putting object %s in mirror bucket %s", key, m.bucket)
+}
+
+func (m *objectMirror) delete(ctx context.Context, key string) error {
+	_, err := m.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(m.bucket),
+		Key:    aws.String(key),
+	})
+	return errors.Wrapf(err, "error deleting object %s from mirror bucket %s", key, m.bucket)
+}
+
+// mirrorWriter passes what the bucket's upload reads on to the mirror's
+// upload until the mirror stops reading, so that a failed mirror does not
+// fail the upload to the bucket.
+type mirrorWriter struct {
+	w   *io.PipeWriter
+	err error
+}
+
+func (w *mirrorWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// putObjectMirrored uploads body to the bucket and the mirror at the same
+// time, passing what the bucket's upload reads to the mirror's upload
+// through a pipe, so that the object is read once and not buffered in full.
+// The mirror's upload only completes once the bucket's has, so that an
+// object that could not be written to the bucket is not mirrored either.
+func (o *ObjectStore) putObjectMirrored(ctx context.Context, log logrus.FieldLogger, bucket, key string, body io.Reader) error {
+	tagging, err := o.tagging.header(key)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	mirrored := make(chan error, 1)
+	go func() {
+		err := o.mirror.put(ctx, key, pr, tagging, o.checksumAlg, o.headers)
+		// unblocks the bucket's upload if the mirror stopped early
+		pr.CloseWithError(err)
+		mirrored <- err
+	}()
+
+	_, err = o.putObject(ctx, bucket, key, io.TeeReader(body, &mirrorWriter{w: pw}))
+	// a nil error ends the mirror's body, anything else aborts its upload
+	pw.CloseWithError(err)
+	mirrorErr := <-mirrored
+	if err != nil {
+		return err
+	}
+	if mirrorErr != nil {
+		return o.mirrorFailed(ctx, log, bucket, key, mirrorErr)
+	}
+	return nil
+}
+
+// mirrorFailed applies the failure policy to an object that could not be
+// mirrored.
+func (o *ObjectStore) mirrorFailed(ctx context.Context, log logrus.FieldLogger, bucket, key string, err error) error {
+	if o.mirror.failurePolicy != mirrorFailurePolicyQueue {
+		return errors.Wrapf(err, "error mirroring object %s", key)
+	}
+	log.WithError(err).Warn("Failed to mirror object, queueing it for reconciliation")
+	if _, err := o.putObject(ctx, bucket, o.mirror.queuePrefix+key, bytes.NewReader(nil)); err != nil {
+		return errors.Wrapf(err, "error queueing object %s for mirroring", key)
+	}
+	return nil
+}
+
+// purgeFromMirror deletes an object that was purged from the trash from the
+// mirror, which keeps the objects in the trash, unless the object was written
+// to the bucket again since it was moved to the trash.
+func (o *ObjectStore) purgeFromMirror(ctx context.Context, log logrus.FieldLogger, bucket, key string) error {
+	exists, err := o.ObjectExists(bucket, key)
+	if err != nil || exists {
+		return err
+	}
+	if err := o.mirror.delete(ctx, key); err != nil {
+		return o.mirrorFailed(ctx, log, bucket, key, err)
+	}
+	return nil
+}
+
+// reconcileMirror brings each object in the mirror queue in line with the
+// bucket: objects that exist are written to the mirror, and the others are
+// deleted from it unless they are in the trash. It returns the number of
+// objects that were reconciled.
+func (o *ObjectStore) reconcileMirror(bucket string) (int, error) {
+	if o.mirror == nil || o.mirror.queuePrefix == "" {
+		return 0, errors.Errorf("%s is not set", mirrorQueuePrefixKey)
+	}
+	ctx := context.Background()
+
+	reconciled := 0
+	err := o.eachObject(ctx, bucket, o.mirror.queuePrefix, func(obj objectInfo) error {
+		queueKey := obj.Key
+		key := strings.TrimPrefix(queueKey, o.mirror.queuePrefix)
+		log := o.log.WithFields(logrus.Fields{"bucket": bucket, "key": key})
+
+		exists, err := o.ObjectExists(bucket, key)
+		if err != nil {
+			return err
+		}
+		trashed := false
+		if !exists && o.trash != nil {
+			if trashed, err = o.ObjectExists(bucket, o.trash.prefix+key); err != nil {
+				return err
+			}
+		}
+		switch {
+		case exists:
+			var tagging string
+			if tagging, err = o.tagging.header(key); err != nil {
+				return err
+			}
+			var body io.ReadCloser
+			if body, err = o.GetObject(bucket, key); err != nil {
+				return err
+			}
+			err = o.mirror.put(ctx, key, body, tagging, o.checksumAlg, o.headers)
+			body.Close()
+		case !trashed:
+			err = o.mirror.delete(ctx, key)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error reconciling object %s", key)
+		}
+
+		if err := o.deleteObject(ctx, log, bucket, queueKey); err != nil {
+			return err
+		}
+		log.WithField("exists", exists).Info("Reconciled object with the mirror")
+		reconciled++
+		return nil
+	})
+	return reconciled, err
+}
+
+// runMirror reconciles the mirror of a location and returns the process
+// exit code.
+func runMirror(args []string, stdout, stderr io.Writer) int {
+	flags := pflag.NewFlagSet(mirrorCommand, pflag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		bslFile         = flags.String("backup-location", "", `path to a BackupStorageLocation YAML file, or "-" for stdin`)
+		credentialsFile = flags.String("credentials-file", "", "path to an AWS credentials file, as referenced by the location's credential")
+		logLevel        = flags.String("log-level", "warning", "level of the plugin logs written to stderr")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: velero-plugin-for-aws %s reconcile [flags]\n\n"+
+			"Writes the objects queued after a failure to the mirror of a location, or deletes them from it.\n\n", mirrorCommand)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || flags.Arg(0) != "reconcile" {
+		flags.Usage()
+		return 2
+	}
+	if *bslFile == "" {
+		fmt.Fprintln(stderr, "--backup-location is required")
+		return 2
+	}
+
+	o, config, err := initBackupStorageLocation(*bslFile, *credentialsFile, *logLevel, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	count, err := o.reconcileMirror(config[bucketKey])
+	fmt.Fprintf(stdout, "Reconciled %d objects with the mirror\n", count)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,329 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBucket is an in-memory bucket served to an S3 client.
+type testBucket struct {
+	mu      sync.Mutex
+	objects map[string]string
+	// putStatus, if set, is returned for writes instead of storing them.
+	putStatus int
+	puts      int
+}
+
+func newTestBucket(objects map[string]string) *testBucket {
+	if objects == nil {
+		objects = map[string]string{}
+	}
+	return &testBucket{objects: objects}
+}
+
+func (b *testBucket) do(req *http.Request) (*http.Response, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key, _ := url.PathUnescape(strings.TrimPrefix(req.URL.Path, "/"))
+
+	switch {
+	case req.URL.Query().Get("list-type") == "2":
+		var keys []string
+		for k := range b.objects {
+			if strings.HasPrefix(k, req.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var contents strings.Builder
+		for _, k := range keys {
+			fmt.Fprintf(&contents, "<Contents><Key>%s</Key></Contents>", k)
+		}
+		return newTestResponse(req, http.StatusOK, "<ListBucketResult>"+contents.String()+"</ListBucketResult>"), nil
+	case req.Method == http.MethodPut:
+		var data []byte
+		if req.Body != nil {
+			var err error
+			if data, err = io.ReadAll(req.Body); err != nil {
+				return nil, err
+			}
+		}
+		if b.putStatus != 0 {
+			return newTestResponse(req, b.putStatus, ""), nil
+		}
+		b.puts++
+		b.objects[key] = string(data)
+		return newTestResponse(req, http.StatusOK, ""), nil
+	case req.Method == http.MethodDelete:
+		delete(b.objects, key)
+		return newTestResponse(req, http.StatusNoContent, ""), nil
+	}
+
+	data, ok := b.objects[key]
+	if !ok && req.Method == http.MethodHead {
+		// S3 answers HEAD without a body
+		return newTestResponse(req, http.StatusNotFound, ""), nil
+	}
+	if !ok {
+		return newTestResponse(req, http.StatusNotFound, "<Error><Code>NoSuchKey</Code></Error>"), nil
+	}
+	return newTestResponse(req, http.StatusOK, data), nil
+}
+
+func newMirroredObjectStore(t *testing.T, primary, mirror *testBucket, failurePolicy string) *ObjectStore {
+	primaryClient := newTestS3Client(t, primary.do)
+	mirrorClient := newTestS3Client(t, mirror.do)
+	o := &ObjectStore{
+		log:        newLogger(),
+		s3:         primaryClient,
+		s3Uploader: manager.NewUploader(primaryClient),
+		mirror: &objectMirror{
+			bucket:        "mirror",
+			s3:            mirrorClient,
+			uploader:      manager.NewUploader(mirrorClient),
+			failurePolicy: failurePolicy,
+		},
+	}
+	if failurePolicy == mirrorFailurePolicyQueue {
+		o.mirror.queuePrefix = "mirror-queue/"
+	}
+	return o
+}
+
+// writeMirrorCredentials writes a credentials file with a default and an
+// offsite profile for the mirror.
+func writeMirrorCredentials(t *testing.T) string {
+	file := filepath.Join(t.TempDir(), "cloud")
+	require.NoError(t, os.WriteFile(file, []byte("[default]\naws_access_key_id = MIRROR\naws_secret_access_key = SECRET\n\n"+
+		"[offsite]\naws_access_key_id = OFFSITE\naws_secret_access_key = SECRET\n"), 0600))
+	return file
+}
+
+func TestNewObjectMirror(t *testing.T) {
+	credentialsFile := writeMirrorCredentials(t)
+	tests := []struct {
+		name        string
+		config      map[string]string
+		expectedErr string
+	}{
+		{
+			name:   "not configured",
+			config: map[string]string{},
+		},
+		{
+			name:   "S3-compatible mirror",
+			config: map[string]string{mirrorBucketKey: "backups", mirrorS3URLKey: "https://minio.local:9000", mirrorS3ForcePathStyleKey: "true", mirrorCredentialsFileKey: credentialsFile},
+		},
+		{
+			name:        "no credentials",
+			config:      map[string]string{mirrorBucketKey: "backups", mirrorRegionKey: "eu-west-1"},
+			expectedErr: "mirrorBucket requires mirrorCredentialsFile or mirrorProfile",
+		},
+		{
+			name:        "settings without bucket",
+			config:      map[string]string{mirrorS3URLKey: "https://minio.local:9000"},
+			expectedErr: "mirrorS3Url requires mirrorBucket",
+		},
+		{
+			name:        "no region or URL",
+			config:      map[string]string{mirrorBucketKey: "backups"},
+			expectedErr: "mirrorBucket requires mirrorRegion or mirrorS3Url",
+		},
+		{
+			name:        "invalid failure policy",
+			config:      map[string]string{mirrorBucketKey: "backups", mirrorRegionKey: "eu-west-1", mirrorFailurePolicyKey: "ignore"},
+			expectedErr: `invalid mirrorFailurePolicy "ignore", expected "fail" or "queue"`,
+		},
+		{
+			name:        "queue without prefix",
+			config:      map[string]string{mirrorBucketKey: "backups", mirrorRegionKey: "eu-west-1", mirrorFailurePolicyKey: "queue"},
+			expectedErr: `mirrorFailurePolicy "queue" requires mirrorQueuePrefix`,
+		},
+		{
+			name:        "prefix without queue",
+			config:      map[string]string{mirrorBucketKey: "backups", mirrorRegionKey: "eu-west-1", mirrorQueuePrefixKey: "queue"},
+			expectedErr: `mirrorQueuePrefix requires mirrorFailurePolicy "queue"`,
+		},
+		{
+			name:        "queue containing the location",
+			config:      map[string]string{mirrorBucketKey: "backups", mirrorRegionKey: "eu-west-1", mirrorFailurePolicyKey: "queue", mirrorQueuePrefixKey: "velero", prefixKey: "velero/prod"},
+			expectedErr: `mirrorQueuePrefix "velero" contains the prefix "velero/prod" of the backup storage location`,
+		},
+		{
+			name:        "two encryption methods",
+			config:      map[string]string{mirrorBucketKey: "backups", mirrorRegionKey: "eu-west-1", mirrorKMSKeyIDKey: "alias/velero", mirrorServerSideEncryptionKey: "AES256"},
+			expectedErr: "you can only use one of: mirrorKmsKeyId, mirrorServerSideEncryption or mirrorCustomerKeyEncryptionFile",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mirror, err := newObjectMirror(newLogger(), test.config, transportSettings{}, 0)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			if test.config[mirrorBucketKey] == "" {
+				assert.Nil(t, mirror)
+				return
+			}
+			require.NotNil(t, mirror)
+			assert.Equal(t, mirrorFailurePolicyFail, mirror.failurePolicy)
+		})
+	}
+}
+
+func TestObjectStoreInitMirrorKeepsEnvironment(t *testing.T) {
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_PROFILE", "AWS_SHARED_CREDENTIALS_FILE", "AWS_CONFIG_FILE"} {
+		t.Setenv(env, "")
+	}
+	// the IRSA settings of the Velero pod, which other locations rely on
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "/var/run/secrets/eks.amazonaws.com/serviceaccount/token")
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::111122223333:role/velero")
+	t.Setenv("AWS_ROLE_SESSION_NAME", "velero")
+	credentialsFile := writeMirrorCredentials(t)
+
+	for _, test := range []struct {
+		profile  string
+		expected string
+	}{
+		{expected: "MIRROR"},
+		{profile: "offsite", expected: "OFFSITE"},
+	} {
+		o := newObjectStore(newLogger())
+		require.NoError(t, o.Init(map[string]string{
+			bucketKey:                "bucket",
+			regionKey:                "us-east-1",
+			mirrorBucketKey:          "mirror",
+			mirrorRegionKey:          "eu-west-1",
+			mirrorCredentialsFileKey: credentialsFile,
+			mirrorProfileKey:         test.profile,
+		}))
+
+		assert.Equal(t, "/var/run/secrets/eks.amazonaws.com/serviceaccount/token", os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+		assert.Equal(t, "arn:aws:iam::111122223333:role/velero", os.Getenv("AWS_ROLE_ARN"))
+		assert.Equal(t, "velero", os.Getenv("AWS_ROLE_SESSION_NAME"))
+
+		// the mirror uses its own credentials rather than IRSA
+		creds, err := o.mirror.s3.(*s3.Client).Options().Credentials.Retrieve(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, creds.AccessKeyID)
+	}
+}
+
+func TestPutObjectMirrored(t *testing.T) {
+	primary, mirror := newTestBucket(nil), newTestBucket(nil)
+	o := newMirroredObjectStore(t, primary, mirror, mirrorFailurePolicyFail)
+
+	// the body is read once, and neither upload can seek it
+	content := strings.Repeat("backup data ", 1000)
+	require.NoError(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", io.NopCloser(strings.NewReader(content))))
+	assert.Equal(t, content, primary.objects["backups/b1/b1.tar.gz"])
+	assert.Equal(t, content, mirror.objects["backups/b1/b1.tar.gz"])
+
+	require.NoError(t, o.DeleteObject("bucket", "backups/b1/b1.tar.gz"))
+	assert.Empty(t, primary.objects)
+	assert.Empty(t, mirror.objects)
+}
+
+func TestPutObjectMirrorFailure(t *testing.T) {
+	primary, mirror := newTestBucket(nil), newTestBucket(nil)
+	mirror.putStatus = http.StatusForbidden
+	o := newMirroredObjectStore(t, primary, mirror, mirrorFailurePolicyFail)
+
+	err := o.PutObject("bucket", "key", strings.NewReader("data"))
+	assert.ErrorContains(t, err, "error mirroring object key: error putting object key in mirror bucket mirror")
+	assert.Equal(t, "data", primary.objects["key"])
+
+	// the mirror is not written when the bucket is not
+	primary.putStatus, mirror.putStatus = http.StatusForbidden, 0
+	err = o.PutObject("bucket", "other", strings.NewReader("data"))
+	assert.ErrorContains(t, err, "error putting object other")
+	assert.Zero(t, mirror.puts)
+}
+
+func TestMirrorQueueAndReconcile(t *testing.T) {
+	primary, mirror := newTestBucket(nil), newTestBucket(map[string]string{"backups/old/old.tar.gz": "old"})
+	mirror.putStatus = http.StatusForbidden
+	o := newMirroredObjectStore(t, primary, mirror, mirrorFailurePolicyQueue)
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", strings.NewReader("data")))
+	assert.Equal(t, map[string]string{"backups/b1/b1.tar.gz": "data", "mirror-queue/backups/b1/b1.tar.gz": ""}, primary.objects)
+
+	// the queue is not part of the location
+	keys, err := o.ListObjects("bucket", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups/b1/b1.tar.gz"}, keys)
+
+	// an object deleted while the mirror was down is deleted from it
+	primary.objects["mirror-queue/backups/old/old.tar.gz"] = ""
+
+	mirror.putStatus = 0
+	reconciled, err := o.reconcileMirror("bucket")
+	require.NoError(t, err)
+	assert.Equal(t, 2, reconciled)
+	assert.Equal(t, map[string]string{"backups/b1/b1.tar.gz": "data"}, primary.objects)
+	assert.Equal(t, map[string]string{"backups/b1/b1.tar.gz": "data"}, mirror.objects)
+}
+
+func TestReconcileMirrorKeepsTrashedObjects(t *testing.T) {
+	primary := newTestBucket(map[string]string{
+		"trash/backups/b1/b1.tar.gz":        "data",
+		"mirror-queue/backups/b1/b1.tar.gz": "",
+	})
+	mirror := newTestBucket(map[string]string{"backups/b1/b1.tar.gz": "data"})
+	o := newMirroredObjectStore(t, primary, mirror, mirrorFailurePolicyQueue)
+	o.trash = &trashSettings{prefix: "trash/", retention: time.Hour}
+
+	reconciled, err := o.reconcileMirror("bucket")
+	require.NoError(t, err)
+	assert.Equal(t, 1, reconciled)
+	assert.Equal(t, map[string]string{"trash/backups/b1/b1.tar.gz": "data"}, primary.objects)
+	assert.Equal(t, map[string]string{"backups/b1/b1.tar.gz": "data"}, mirror.objects)
+}
+
+func TestReconcileMirrorFailure(t *testing.T) {
+	primary := newTestBucket(map[string]string{
+		"backups/b1/b1.tar.gz":              "data",
+		"mirror-queue/backups/b1/b1.tar.gz": "",
+	})
+	mirror := newTestBucket(nil)
+	mirror.putStatus = http.StatusForbidden
+	o := newMirroredObjectStore(t, primary, mirror, mirrorFailurePolicyQueue)
+
+	_, err := o.reconcileMirror("bucket")
+	assert.ErrorContains(t, err, "error reconciling object backups/b1/b1.tar.gz")
+	assert.Contains(t, primary.objects, "mirror-queue/backups/b1/b1.tar.gz")
+}
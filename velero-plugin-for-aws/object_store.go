@@ -18,8 +18,6 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"os"
@@ -27,13 +25,17 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -50,8 +52,11 @@ const (
 	kmsKeyIDKey                    = "kmsKeyId"
 	customerKeyEncryptionFileKey   = "customerKeyEncryptionFile"
 	customerKeyEncryptionSecretKey = "customerKeyEncryptionSecret"
+	previousCustomerKeyFilesKey    = "customerKeyEncryptionPreviousFiles"
+	previousCustomerKeySecretsKey  = "customerKeyEncryptionPreviousSecrets"
 	s3ForcePathStyleKey            = "s3ForcePathStyle"
 	bucketKey                      = "bucket"
+	prefixKey                      = "prefix"
 	signatureVersionKey            = "signatureVersion"
 	credentialsFileKey             = "credentialsFile"
 	credentialProfileKey           = "profile"
@@ -61,13 +66,26 @@ const (
 	enableSharedConfigKey          = "enableSharedConfig"
 	taggingKey                     = "tagging"
 	checksumAlgKey                 = "checksumAlgorithm"
+	useAccelerateKey               = "useAccelerate"
+	useDualStackKey                = "useDualStack"
+	useFIPSKey                     = "useFIPS"
+	requesterPaysKey               = "requesterPays"
+	expectedBucketOwnerKey         = "expectedBucketOwner"
+	signedURLRequireCustomerKeyKey = "signedURLRequireCustomerKey"
 )
 
 type s3Interface interface {
+	HeadBucket(ctx context.Context, input *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
 	HeadObject(ctx context.Context, input *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
 	GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
 	DeleteObject(ctx context.Context, input *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	CopyObject(ctx context.Context, input *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	ListObjectVersions(ctx context.Context, input *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error)
+	DeleteObjects(ctx context.Context, input *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	GetBucketVersioning(ctx context.Context, input *s3.GetBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.GetBucketVersioningOutput, error)
+	GetObjectTagging(ctx context.Context, input *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	PutObjectTagging(ctx context.Context, input *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
 }
 
 type s3PresignInterface interface {
@@ -82,10 +100,37 @@ type ObjectStore struct {
 	kmsKeyID             string
 	sseCustomerKey       string
 	sseCustomerKeyMd5    string
+	previousCustomerKeys []customerKey
 	signatureVersion     string
 	serverSideEncryption string
-	tagging              string
+	tagging              *objectTagging
 	checksumAlg          string
+	headers              objectHeaders
+	requestPayer         types.RequestPayer
+	expectedBucketOwner  *string
+	// signedURLRequireCustomerKey allows signed URLs to be created for
+	// SSE-C objects. Such URLs can only be used by clients that send the
+	// SSE-C headers, such as the download command.
+	signedURLRequireCustomerKey bool
+	// permissionReport is the result of the permission check, if it was
+	// enabled with validatePermissions.
+	permissionReport *permissionReport
+	// versionedDeletes makes DeleteObject delete all versions of an
+	// object, and readDeletedObjects makes GetObject read the latest
+	// version of a deleted object.
+	versionedDeletes   bool
+	readDeletedObjects bool
+	versioningMu       sync.Mutex
+	// mfaDelete caches whether buckets have MFA delete enabled.
+	mfaDelete map[string]bool
+	// trash makes DeleteObject move objects to a trash prefix, if set.
+	trash *trashSettings
+	// replica is read when the bucket is unavailable, if set.
+	replica *replicaBucket
+	// mirror receives a copy of every write and delete, if set.
+	mirror *objectMirror
+	// cache caches listings and existence checks, if set.
+	cache *listingCache
 }
 
 func newObjectStore(logger logrus.FieldLogger) *ObjectStore {
@@ -100,15 +145,67 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		kmsKeyIDKey,
 		customerKeyEncryptionFileKey,
 		customerKeyEncryptionSecretKey,
+		previousCustomerKeyFilesKey,
+		previousCustomerKeySecretsKey,
 		s3ForcePathStyleKey,
 		signatureVersionKey,
 		credentialsFileKey,
+		credentialsSecretKey,
 		credentialProfileKey,
+		stsURLKey,
+		webIdentityTokenFileKey,
+		webIdentityAudienceKey,
+		webIdentityRoleARNKey,
 		serverSideEncryptionKey,
 		insecureSkipTLSVerifyKey,
 		enableSharedConfigKey,
 		taggingKey,
+		taggingByPrefixKey,
 		checksumAlgKey,
+		metadataKey,
+		cacheControlKey,
+		detectContentTypeKey,
+		useAccelerateKey,
+		useDualStackKey,
+		useFIPSKey,
+		requesterPaysKey,
+		versionedDeletesKey,
+		readDeletedObjectsKey,
+		trashPrefixKey,
+		trashRetentionKey,
+		replicaBucketKey,
+		replicaRegionKey,
+		replicaS3URLKey,
+		mirrorBucketKey,
+		mirrorRegionKey,
+		mirrorS3URLKey,
+		mirrorS3ForcePathStyleKey,
+		mirrorCredentialsFileKey,
+		mirrorProfileKey,
+		mirrorCACertKey,
+		mirrorKMSKeyIDKey,
+		mirrorServerSideEncryptionKey,
+		mirrorCustomerKeyEncryptionFileKey,
+		mirrorFailurePolicyKey,
+		mirrorQueuePrefixKey,
+		listCacheTTLKey,
+		expectedBucketOwnerKey,
+		signedURLRequireCustomerKeyKey,
+		validatePermissionsKey,
+		httpProxyKey,
+		httpsProxyKey,
+		noProxyKey,
+		maxIdleConnsKey,
+		dialTimeoutKey,
+		responseHeaderTimeoutKey,
+		tlsClientCertKey,
+		tlsClientKeyKey,
+		tlsClientCertFileKey,
+		tlsClientKeyFileKey,
+		tlsClientCertSecretKey,
+		tlsClientKeySecretKey,
+		tlsMinVersionKey,
+		caCertFileKey,
 	); err != nil {
 		return err
 	}
@@ -120,20 +217,31 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		kmsKeyID                    = config[kmsKeyIDKey]
 		customerKeyEncryptionFile   = config[customerKeyEncryptionFileKey]
 		customerKeyEncryptionSecret = config[customerKeyEncryptionSecretKey]
+		previousCustomerKeyFiles    = config[previousCustomerKeyFilesKey]
+		previousCustomerKeySecrets  = config[previousCustomerKeySecretsKey]
 		s3ForcePathStyleVal         = config[s3ForcePathStyleKey]
 		credentialProfile           = config[credentialProfileKey]
 		credentialsFile             = config[credentialsFileKey]
 		serverSideEncryption        = config[serverSideEncryptionKey]
 		insecureSkipTLSVerifyVal    = config[insecureSkipTLSVerifyKey]
-		tagging                     = config[taggingKey]
+		signatureVersion            = config[signatureVersionKey]
+		useAccelerateVal            = config[useAccelerateKey]
+		useDualStackVal             = config[useDualStackKey]
+		useFIPSVal                  = config[useFIPSKey]
+		requesterPaysVal            = config[requesterPaysKey]
+		expectedBucketOwner         = config[expectedBucketOwnerKey]
+		validatePermissionsVal      = config[validatePermissionsKey]
 		// note that bucket is automatically added to the config map
 		// by the server from the ObjectStorageProviderConfig so
 		// doesn't need to be explicitly set by the user within
 		// config.
 		bucket                = config[bucketKey]
+		prefix                = config[prefixKey]
 		caCert                = config[caCertKey]
 		s3ForcePathStyle      bool
 		insecureSkipTLSVerify bool
+		endpointVariant       s3EndpointVariant
+		validatePermissions   bool
 		err                   error
 	)
 
@@ -149,10 +257,160 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		}
 	}
 
+	if useAccelerateVal != "" {
+		if endpointVariant.accelerate, err = strconv.ParseBool(useAccelerateVal); err != nil {
+			return errors.Wrapf(err, "could not parse %s (expected bool)", useAccelerateKey)
+		}
+	}
+
+	if useDualStackVal != "" {
+		if endpointVariant.dualStack, err = strconv.ParseBool(useDualStackVal); err != nil {
+			return errors.Wrapf(err, "could not parse %s (expected bool)", useDualStackKey)
+		}
+	}
+
+	if useFIPSVal != "" {
+		if endpointVariant.fips, err = strconv.ParseBool(useFIPSVal); err != nil {
+			return errors.Wrapf(err, "could not parse %s (expected bool)", useFIPSKey)
+		}
+	}
+
+	if validatePermissionsVal != "" {
+		if validatePermissions, err = strconv.ParseBool(validatePermissionsVal); err != nil {
+			return errors.Wrapf(err, "could not parse %s (expected bool)", validatePermissionsKey)
+		}
+	}
+
+	if val := config[signedURLRequireCustomerKeyKey]; val != "" {
+		if o.signedURLRequireCustomerKey, err = strconv.ParseBool(val); err != nil {
+			return errors.Wrapf(err, "could not parse %s (expected bool)", signedURLRequireCustomerKeyKey)
+		}
+	}
+
+	if val := config[versionedDeletesKey]; val != "" {
+		if o.versionedDeletes, err = strconv.ParseBool(val); err != nil {
+			return errors.Wrapf(err, "could not parse %s (expected bool)", versionedDeletesKey)
+		}
+	}
+
+	if val := config[readDeletedObjectsKey]; val != "" {
+		if o.readDeletedObjects, err = strconv.ParseBool(val); err != nil {
+			return errors.Wrapf(err, "could not parse %s (expected bool)", readDeletedObjectsKey)
+		}
+	}
+
+	if o.trash, err = parseTrashSettings(config); err != nil {
+		return err
+	}
+
+	if o.cache, err = newListingCache(config); err != nil {
+		return err
+	}
+
+	if requesterPaysVal != "" {
+		requesterPays, err := strconv.ParseBool(requesterPaysVal)
+		if err != nil {
+			return errors.Wrapf(err, "could not parse %s (expected bool)", requesterPaysKey)
+		}
+		if requesterPays {
+			o.requestPayer = types.RequestPayerRequester
+		}
+	}
+
+	if expectedBucketOwner != "" {
+		if !isAccountID(expectedBucketOwner) {
+			return errors.Errorf("invalid %s %q, expected a 12-digit AWS account ID", expectedBucketOwnerKey, expectedBucketOwner)
+		}
+		o.expectedBucketOwner = aws.String(expectedBucketOwner)
+	}
+
+	transport, err := parseTransportSettings(config)
+	if err != nil {
+		return err
+	}
+
+	tlsMinVersion, err := parseTLSMinVersion(config[tlsMinVersionKey])
+	if err != nil {
+		return err
+	}
+	clientCert, err := newClientCertificate(config, o.log)
+	if err != nil {
+		return err
+	}
+	roots, err := newRootCAs(o.log, caCert, config[caCertFileKey])
+	if err != nil {
+		return err
+	}
+	secretCreds, err := locationSecretCredentials(config)
+	if err != nil {
+		return err
+	}
+	webIdentity, err := parseWebIdentitySettings(config)
+	if err != nil {
+		return err
+	}
+	replica, err := parseReplicaSettings(config)
+	if err != nil {
+		return err
+	}
+
+	if o.signatureVersion, err = parseSignatureVersion(signatureVersion); err != nil {
+		return err
+	}
+
+	// The bucket may be an access point ARN, whose endpoint is derived from
+	// the ARN rather than from the region, s3Url and path style settings.
+	bucketARN, err := parseBucketARN(bucket)
+	if err != nil {
+		return err
+	}
+	if isDirectoryBucket(bucket) {
+		if err := validateDirectoryBucket(config); err != nil {
+			return err
+		}
+	}
+	var s3Opts []func(*s3.Options)
+	if bucketARN != nil {
+		if s3ForcePathStyle {
+			return errors.Errorf("%s cannot be used when the bucket is an access point ARN", s3ForcePathStyleKey)
+		}
+		if publicURL != "" {
+			return errors.Errorf("%s cannot be used when the bucket is an access point ARN", publicURLKey)
+		}
+		if signsURLsWithSigV2(o.signatureVersion) {
+			return errors.Errorf("access point ARNs do not support %s %q", signatureVersionKey, signatureVersion)
+		}
+		if bucketARN.multiRegion {
+			if signatureVersion != "" && o.signatureVersion != signatureVersion4a {
+				return errors.Errorf("multi-region access points require %s %q, got %q", signatureVersionKey, signatureVersion4a, signatureVersion)
+			}
+			o.signatureVersion = signatureVersion4a
+		}
+		if region == "" {
+			region = bucketARN.Region
+		}
+		if region == "" {
+			// multi-region access points are not tied to a region, but the
+			// client still needs one
+			region = "us-east-1"
+		}
+		s3Opts = append(s3Opts, func(o *s3.Options) {
+			o.UseARNRegion = true
+		})
+	}
+	s3Opts = append(s3Opts, signatureVersionOptions(o.signatureVersion, bucket)...)
+
+	if err := endpointVariant.validate(bucket, s3URL, s3ForcePathStyle, bucketARN); err != nil {
+		return err
+	}
+
 	cfg, err := newConfigBuilder(o.log).WithRegion(region).
 		WithProfile(credentialProfile).
 		WithCredentialsFile(credentialsFile).
-		WithTLSSettings(insecureSkipTLSVerify, caCert).Build()
+		WithCredentialsSecret(secretCreds).
+		WithWebIdentity(webIdentity).
+		WithTLSSettings(insecureSkipTLSVerify, roots, clientCert, tlsMinVersion).
+		WithTransportSettings(transport).Build()
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -176,8 +434,17 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		}
 		cfg.Region = region
 	}
+	if replica != nil {
+		if o.replica, err = newReplicaBucket(cfg, replica, s3ForcePathStyle, o.signatureVersion); err != nil {
+			return err
+		}
+	}
+	cfg.APIOptions = append(cfg.APIOptions, metricsAPIOptions(bucket, cfg.Region)...)
+	cfg.APIOptions = append(cfg.APIOptions, tracingAPIOptions(cfg.Region)...)
 
-	client, err := newS3Client(cfg, s3URL, s3ForcePathStyle)
+	// The endpoint variant is not applied to the publicUrl client, which
+	// always uses the endpoint it is given.
+	client, err := newS3Client(cfg, s3URL, s3ForcePathStyle, append(endpointVariant.options(), s3Opts...)...)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -185,7 +452,6 @@ func (o *ObjectStore) Init(config map[string]string) error {
 	o.s3Uploader = manager.NewUploader(client)
 	o.kmsKeyID = kmsKeyID
 	o.serverSideEncryption = serverSideEncryption
-	o.tagging = tagging
 
 	// Validate that only one SSE method is used
 	sseMethodsCount := 0
@@ -208,9 +474,8 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		if err != nil {
 			return err
 		}
-		o.sseCustomerKey = base64.StdEncoding.EncodeToString([]byte(customerKey))
-		hash := md5.Sum([]byte(customerKey))
-		o.sseCustomerKeyMd5 = base64.StdEncoding.EncodeToString(hash[:])
+		ck := newCustomerKey(customerKey)
+		o.sseCustomerKey, o.sseCustomerKeyMd5 = ck.key, ck.md5
 	}
 
 	// Handle customer key from secret
@@ -219,26 +484,36 @@ func (o *ObjectStore) Init(config map[string]string) error {
 		if err != nil {
 			return err
 		}
-		o.sseCustomerKey = base64.StdEncoding.EncodeToString([]byte(customerKey))
-		hash := md5.Sum([]byte(customerKey))
-		o.sseCustomerKeyMd5 = base64.StdEncoding.EncodeToString(hash[:])
+		ck := newCustomerKey(customerKey)
+		o.sseCustomerKey, o.sseCustomerKeyMd5 = ck.key, ck.md5
+	}
+
+	// Previous customer keys are only used to read objects written before
+	// the current key was rotated in.
+	if previousCustomerKeyFiles != "" || previousCustomerKeySecrets != "" {
+		if o.sseCustomerKey == "" {
+			return errors.Errorf("%s and %s require %s or %s", previousCustomerKeyFilesKey, previousCustomerKeySecretsKey, customerKeyEncryptionFileKey, customerKeyEncryptionSecretKey)
+		}
+		if o.previousCustomerKeys, err = readPreviousCustomerKeys(previousCustomerKeyFiles, previousCustomerKeySecrets); err != nil {
+			return err
+		}
 	}
 
 	if publicURL != "" {
-		publicClient, err := newS3Client(cfg, publicURL, s3ForcePathStyle)
+		publicClient, err := newS3Client(cfg, publicURL, s3ForcePathStyle, s3Opts...)
 		if err != nil {
 			return err
 		}
 
-		o.preSignS3 = s3.NewPresignClient(publicClient)
+		o.preSignS3 = s3.NewPresignClient(publicClient, presignOptions(o.signatureVersion, bucket)...)
 	} else {
-		o.preSignS3 = s3.NewPresignClient(client)
+		o.preSignS3 = s3.NewPresignClient(client, presignOptions(o.signatureVersion, bucket)...)
 	}
-	if tagging != "" {
-		err = CheckTags(tagging)
-		if err != nil {
-			return err
-		}
+	if o.tagging, err = newObjectTagging(config); err != nil {
+		return err
+	}
+	if o.headers, err = parseObjectHeaders(config); err != nil {
+		return err
 	}
 	if alg, ok := config[checksumAlgKey]; ok {
 		if !validChecksumAlg(alg) {
@@ -248,6 +523,21 @@ func (o *ObjectStore) Init(config map[string]string) error {
 	} else {
 		o.checksumAlg = string(types.ChecksumAlgorithmCrc32)
 	}
+
+	if validatePermissions {
+		o.permissionReport = o.checkPermissions(context.Background(), bucket, prefix, kms.NewFromConfig(cfg))
+		o.permissionReport.log(o.log.WithField("bucket", bucket))
+		if err := o.permissionReport.err(); err != nil {
+			return err
+		}
+	}
+
+	// The mirror is set up last: loading its credentials file changes the
+	// environment the location's credentials are read from, and the
+	// permission check only covers the bucket.
+	if o.mirror, err = newObjectMirror(o.log, config, transport, tlsMinVersion); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -288,57 +578,102 @@ func readCustomerKey(customerKeyEncryptionFile string) (string, error) {
 // The secretRef should be in the format "secretName/key"
 // The namespace is determined from the VELERO_NAMESPACE environment variable
 func readCustomerKeyFromSecret(secretRef string) (string, error) {
-	parts := strings.Split(secretRef, "/")
-	if len(parts) != 2 {
-		return "", errors.Errorf("invalid secret reference format: %s, expected secretName/key", secretRef)
+	customerKeyData, err := readSecretKey(secretRef)
+	if err != nil {
+		return "", err
 	}
 
+	// Validate the key length
+	if len(customerKeyData) != 32 {
+		return "", errors.Errorf("customer key from secret %s/%s must be exactly 32 bytes, got %d bytes", os.Getenv("VELERO_NAMESPACE"), secretRef, len(customerKeyData))
+	}
+
+	return string(customerKeyData), nil
+}
+
+// inClusterClient returns a Kubernetes client for the cluster the plugin
+// runs in, and the Velero namespace from the VELERO_NAMESPACE environment
+// variable.
+func inClusterClient() (kubernetes.Interface, string, error) {
 	namespace := os.Getenv("VELERO_NAMESPACE")
 	if namespace == "" {
-		return "", errors.New("VELERO_NAMESPACE environment variable is not set")
+		return nil, "", errors.New("VELERO_NAMESPACE environment variable is not set")
 	}
 
-	secretName := parts[0]
-	keyName := parts[1]
-
 	// Create in-cluster config
 	config, err := rest.InClusterConfig()
 	if err != nil {
-		return "", errors.Wrap(err, "failed to create in-cluster config")
+		return nil, "", errors.Wrap(err, "failed to create in-cluster config")
 	}
 
 	// Create clientset
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to create kubernetes client")
+		return nil, "", errors.Wrap(err, "failed to create kubernetes client")
+	}
+	return clientset, namespace, nil
+}
+
+// readSecretKey reads a key of a Kubernetes secret in the Velero namespace.
+// The secretRef should be in the format "secretName/key"
+// The namespace is determined from the VELERO_NAMESPACE environment variable
+func readSecretKey(secretRef string) ([]byte, error) {
+	parts := strings.Split(secretRef, "/")
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid secret reference format: %s, expected secretName/key", secretRef)
+	}
+
+	secretName := parts[0]
+	keyName := parts[1]
+
+	clientset, namespace, err := inClusterClient()
+	if err != nil {
+		return nil, err
 	}
 
 	// Get the secret
 	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), secretName, metav1.GetOptions{})
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to get secret %s/%s", namespace, secretName)
+		return nil, errors.Wrapf(err, "failed to get secret %s/%s", namespace, secretName)
 	}
 
 	// Get the key from the secret
-	customerKeyData, exists := secret.Data[keyName]
+	data, exists := secret.Data[keyName]
 	if !exists {
-		return "", errors.Errorf("key %s not found in secret %s/%s", keyName, namespace, secretName)
+		return nil, errors.Errorf("key %s not found in secret %s/%s", keyName, namespace, secretName)
 	}
 
-	// Validate the key length
-	if len(customerKeyData) != 32 {
-		return "", errors.Errorf("customer key from secret %s/%s/%s must be exactly 32 bytes, got %d bytes", namespace, secretName, keyName, len(customerKeyData))
-	}
+	return data, nil
+}
 
-	return string(customerKeyData), nil
+func (o *ObjectStore) PutObject(bucket, key string, body io.Reader) (err error) {
+	ctx, span := startSpan(context.Background(), "ObjectStore.PutObject", bucketAttr(bucket), keyAttr(key))
+	defer func() { endSpan(span, err) }()
+	// a failed write may still have created the object
+	defer o.cache.invalidate(bucket, key)
+
+	if o.mirror != nil {
+		log := o.log.WithFields(logrus.Fields{"bucket": bucket, "key": key})
+		return o.putObjectMirrored(ctx, log, bucket, key, body)
+	}
+	_, err = o.putObject(ctx, bucket, key, body)
+	return err
 }
 
-func (o *ObjectStore) PutObject(bucket, key string, body io.Reader) error {
+// putObject writes the object to the bucket and returns the ID of the
+// version it created, which is empty if the bucket is not versioned.
+func (o *ObjectStore) putObject(ctx context.Context, bucket, key string, body io.Reader) (string, error) {
+	tagging, err := o.tagging.header(key)
+	if err != nil {
+		return "", err
+	}
 	input := &s3.PutObjectInput{
-		Bucket:  aws.String(bucket),
-		Key:     aws.String(key),
-		Body:    body,
-		Tagging: aws.String(o.tagging),
+		Bucket:              aws.String(bucket),
+		Key:                 aws.String(key),
+		Body:                body,
+		Tagging:             optionalString(tagging),
+		RequestPayer:        o.requestPayer,
+		ExpectedBucketOwner: o.expectedBucketOwner,
 	}
 
 	switch {
@@ -360,14 +695,21 @@ func (o *ObjectStore) PutObject(bucket, key string, body io.Reader) error {
 	if o.checksumAlg != "" {
 		input.ChecksumAlgorithm = types.ChecksumAlgorithm(o.checksumAlg)
 	}
+	o.headers.apply(input)
 
-	_, err := o.s3Uploader.Upload(context.Background(), input)
+	output, err := o.s3Uploader.Upload(ctx, input)
+	if err != nil {
+		return "", errors.Wrapf(err, "error putting object %s", key)
+	}
 
-	return errors.Wrapf(err, "error putting object %s", key)
+	return aws.ToString(output.VersionID), nil
 }
 
 // ObjectExists checks if there is an object with the given key in the object storage bucket.
-func (o *ObjectStore) ObjectExists(bucket, key string) (bool, error) {
+func (o *ObjectStore) ObjectExists(bucket, key string) (_ bool, err error) {
+	ctx, span := startSpan(context.Background(), "ObjectStore.ObjectExists", bucketAttr(bucket), keyAttr(key))
+	defer func() { endSpan(span, err) }()
+
 	log := o.log.WithFields(
 		logrus.Fields{
 			"bucket": bucket,
@@ -375,19 +717,24 @@ func (o *ObjectStore) ObjectExists(bucket, key string) (bool, error) {
 		},
 	)
 
-	input := &s3.HeadObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	}
-
-	if o.sseCustomerKey != "" {
-		input.SSECustomerAlgorithm = aws.String("AES256")
-		input.SSECustomerKey = &o.sseCustomerKey
-		input.SSECustomerKeyMD5 = &o.sseCustomerKeyMd5
-	}
+	return o.cache.exists(bucket, key, func() (bool, error) {
+		return o.objectExists(ctx, log, bucket, key)
+	})
+}
 
+func (o *ObjectStore) objectExists(ctx context.Context, log logrus.FieldLogger, bucket, key string) (bool, error) {
 	log.Debug("Checking if object exists")
-	if _, err := o.s3.HeadObject(context.Background(), input); err != nil {
+	err := o.withReplica(ctx, log, bucket, func(client s3Interface, bucket string) error {
+		object := o.headObjectInput(bucket, key)
+		return o.withCustomerKeys(ctx, log, client, object, func(ck customerKey) error {
+			input := *object
+			setCustomerKey(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5, ck)
+
+			_, err := client.HeadObject(ctx, &input)
+			return err
+		})
+	})
+	if err != nil {
 		log.Debug("Checking for AWS specific error information")
 		var ne *types.NotFound
 		if errors.As(err, &ne) {
@@ -406,62 +753,132 @@ func (o *ObjectStore) ObjectExists(bucket, key string) (bool, error) {
 	return true, nil
 }
 
-func (o *ObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	}
-
-	if o.sseCustomerKey != "" {
-		input.SSECustomerAlgorithm = aws.String("AES256")
-		input.SSECustomerKey = &o.sseCustomerKey
-		input.SSECustomerKeyMD5 = &o.sseCustomerKeyMd5
-	}
-
-	output, err := o.s3.GetObject(context.Background(), input)
+func (o *ObjectStore) GetObject(bucket, key string) (_ io.ReadCloser, err error) {
+	ctx, span := startSpan(context.Background(), "ObjectStore.GetObject", bucketAttr(bucket), keyAttr(key))
+	defer func() { endSpan(span, err) }()
+
+	log := o.log.WithFields(logrus.Fields{"bucket": bucket, "key": key})
+
+	var output *s3.GetObjectOutput
+	err = o.withReplica(ctx, log, bucket, func(client s3Interface, bucket string) error {
+		return o.withCustomerKeys(ctx, log, client, o.headObjectInput(bucket, key), func(ck customerKey) error {
+			input := &s3.GetObjectInput{
+				Bucket:              aws.String(bucket),
+				Key:                 aws.String(key),
+				RequestPayer:        o.requestPayer,
+				ExpectedBucketOwner: o.expectedBucketOwner,
+			}
+			setCustomerKey(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5, ck)
+
+			var err error
+			output, err = client.GetObject(ctx, input)
+			return err
+		})
+	})
 	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if o.readDeletedObjects && errors.As(err, &noSuchKey) {
+			return o.getLatestVersion(ctx, log, bucket, key, err)
+		}
 		return nil, errors.Wrapf(err, "error getting object %s", key)
 	}
 
 	return output.Body, nil
 }
 
-func (o *ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
-	input := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(bucket),
-		Prefix:    aws.String(prefix),
-		Delimiter: aws.String(delimiter),
-	}
+func (o *ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) (_ []string, err error) {
+	ctx, span := startSpan(context.Background(), "ObjectStore.ListCommonPrefixes", bucketAttr(bucket), prefixAttr(prefix))
+	defer func() { endSpan(span, err) }()
+
+	log := o.log.WithFields(logrus.Fields{"bucket": bucket, "prefix": prefix})
+	cacheKey := listingCacheKey{operation: "ListCommonPrefixes", bucket: bucket, key: prefix, delimiter: delimiter}
+	return o.cache.keys(cacheKey, func() ([]string, error) {
+		return o.listCommonPrefixes(ctx, log, bucket, prefix, delimiter)
+	})
+}
+
+func (o *ObjectStore) listCommonPrefixes(ctx context.Context, log logrus.FieldLogger, bucket, prefix, delimiter string) ([]string, error) {
 	var ret []string
-	p := s3.NewListObjectsV2Paginator(o.s3, input)
-	for p.HasMorePages() {
-		page, err := p.NextPage(context.Background())
-		if err != nil {
-			return nil, errors.WithStack(err)
+	err := o.withReplica(ctx, log, bucket, func(client s3Interface, bucket string) error {
+		if isDirectoryBucket(bucket) && delimiter != directoryBucketDelimiter {
+			return errors.Errorf("directory bucket %s only supports the delimiter %q", bucket, directoryBucketDelimiter)
+		}
+		listPrefix := directoryBucketListPrefix(bucket, prefix)
+		input := &s3.ListObjectsV2Input{
+			Bucket:              aws.String(bucket),
+			Prefix:              aws.String(listPrefix),
+			Delimiter:           aws.String(delimiter),
+			RequestPayer:        o.requestPayer,
+			ExpectedBucketOwner: o.expectedBucketOwner,
 		}
-		for _, prefix := range page.CommonPrefixes {
-			ret = append(ret, *prefix.Prefix)
+		ret = nil
+		p := s3.NewListObjectsV2Paginator(client, input)
+		for p.HasMorePages() {
+			page, err := p.NextPage(ctx)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			for _, commonPrefix := range page.CommonPrefixes {
+				// the trash and the mirror queue are not part of the
+				// backup storage location
+				if o.hidden(*commonPrefix.Prefix) {
+					continue
+				}
+				// a directory bucket listed from the parent of prefix
+				if listPrefix != prefix && !strings.HasPrefix(*commonPrefix.Prefix, prefix) {
+					continue
+				}
+				ret = append(ret, *commonPrefix.Prefix)
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	// directory buckets do not list keys in order
+	sort.Strings(ret)
 	return ret, nil
 }
 
-func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
-	input := &s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(prefix),
-	}
+// hidden reports whether key or common prefix is one of the objects the
+// plugin keeps in the bucket next to the backup storage location.
+func (o *ObjectStore) hidden(key string) bool {
+	return o.trash.contains(key) || o.mirror.queued(key)
+}
+
+func (o *ObjectStore) ListObjects(bucket, prefix string) (_ []string, err error) {
+	ctx, span := startSpan(context.Background(), "ObjectStore.ListObjects", bucketAttr(bucket), prefixAttr(prefix))
+	defer func() { endSpan(span, err) }()
 
+	log := o.log.WithFields(logrus.Fields{"bucket": bucket, "prefix": prefix})
+	cacheKey := listingCacheKey{operation: "ListObjects", bucket: bucket, key: prefix}
+	return o.cache.keys(cacheKey, func() ([]string, error) {
+		return o.listObjects(ctx, log, bucket, prefix)
+	})
+}
+
+func (o *ObjectStore) listObjects(ctx context.Context, log logrus.FieldLogger, bucket, prefix string) ([]string, error) {
 	var ret []string
-	p := s3.NewListObjectsV2Paginator(o.s3, input)
-	for p.HasMorePages() {
-		page, err := p.NextPage(context.Background())
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		for _, obj := range page.Contents {
-			ret = append(ret, *obj.Key)
+	err := o.withReplica(ctx, log, bucket, func(client s3Interface, bucket string) error {
+		ret = nil
+		lister := o.newObjectLister(client, bucket, prefix)
+		for lister.HasMorePages() {
+			objects, err := lister.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			for _, obj := range objects {
+				if o.hidden(obj.Key) {
+					continue
+				}
+				ret = append(ret, obj.Key)
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	// ensure that returned objects are in a consistent order so that the deletion logic deletes the objects before
 	// the pseudo-folder prefix object for s3 providers (such as Quobyte) that return the pseudo-folder as an object.
@@ -471,27 +888,112 @@ func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
 	return ret, nil
 }
 
-func (o *ObjectStore) DeleteObject(bucket, key string) error {
+func (o *ObjectStore) DeleteObject(bucket, key string) (err error) {
+	ctx, span := startSpan(context.Background(), "ObjectStore.DeleteObject", bucketAttr(bucket), keyAttr(key))
+	defer func() { endSpan(span, err) }()
+	defer o.cache.invalidate(bucket, key)
+
+	log := o.log.WithFields(logrus.Fields{"bucket": bucket, "key": key})
+	if o.trash != nil {
+		err = o.moveToTrash(ctx, log, bucket, key)
+	} else {
+		err = o.deleteObject(ctx, log, bucket, key)
+	}
+	// objects in the trash stay in the mirror until they are purged, so
+	// that restoring them leaves the mirror complete
+	if err != nil || o.mirror == nil || o.trash != nil {
+		return err
+	}
+	if err := o.mirror.delete(ctx, key); err != nil {
+		return o.mirrorFailed(ctx, log, bucket, key, err)
+	}
+	return nil
+}
+
+// deleteObject permanently deletes an object, bypassing the trash.
+func (o *ObjectStore) deleteObject(ctx context.Context, log logrus.FieldLogger, bucket, key string) error {
+	if o.versionedDeletes {
+		if deleted, err := o.deleteAllVersions(ctx, log, bucket, key); deleted || err != nil {
+			return err
+		}
+	}
+
 	input := &s3.DeleteObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
+		Bucket:              aws.String(bucket),
+		Key:                 aws.String(key),
+		RequestPayer:        o.requestPayer,
+		ExpectedBucketOwner: o.expectedBucketOwner,
 	}
 
-	_, err := o.s3.DeleteObject(context.Background(), input)
+	_, err := o.s3.DeleteObject(ctx, input)
 
 	return errors.Wrapf(err, "error deleting object %s", key)
 }
 
-func (o *ObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (string, error) {
-	req, err := o.preSignS3.PresignGetObject(context.Background(), &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	}, func(opts *s3.PresignOptions) {
+func (o *ObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (_ string, err error) {
+	ctx, span := startSpan(context.Background(), "ObjectStore.CreateSignedURL", bucketAttr(bucket), keyAttr(key))
+	defer func() { endSpan(span, err) }()
+
+	input := &s3.GetObjectInput{
+		Bucket:              aws.String(bucket),
+		Key:                 aws.String(key),
+		RequestPayer:        o.requestPayer,
+		ExpectedBucketOwner: o.expectedBucketOwner,
+	}
+
+	// Objects encrypted with SSE-C can only be read by sending the customer
+	// key in request headers, which the velero CLI does not do when it
+	// downloads from the URL. Locations without a customer key cannot have
+	// written SSE-C objects, so they skip the HEAD request.
+	if o.sseCustomerKey != "" {
+		log := o.log.WithFields(logrus.Fields{"bucket": bucket, "key": key})
+		ck, err := o.findCustomerKey(ctx, log, bucket, key)
+		if err != nil {
+			return "", errors.Wrapf(err, "error finding SSE-C key of object %s", key)
+		}
+		if ck.key != "" {
+			if !o.signedURLRequireCustomerKey {
+				return "", errors.Errorf("object %s is encrypted with SSE-C and cannot be downloaded from a signed URL; set %s and use the %s command to download it", key, signedURLRequireCustomerKeyKey, downloadCommand)
+			}
+			setCustomerKey(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5, ck)
+		}
+	}
+
+	req, err := o.preSignS3.PresignGetObject(ctx, input, func(opts *s3.PresignOptions) {
 		opts.Expires = ttl
-	})
+	}, presignQueryHeaders("X-Amz-Request-Payer", "X-Amz-Expected-Bucket-Owner"))
 
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
 	return req.URL, nil
 }
+
+// presignQueryHeaders moves the given headers of a presigned request into
+// the query string, so that they are covered by the signature without
+// requiring the user of the URL to send them.
+func presignQueryHeaders(headers ...string) func(*s3.PresignOptions) {
+	hoist := middleware.BuildMiddlewareFunc("VeleroPresignQueryHeaders", func(ctx context.Context, in middleware.BuildInput, next middleware.BuildHandler) (
+		middleware.BuildOutput, middleware.Metadata, error,
+	) {
+		if req, ok := in.Request.(*smithyhttp.Request); ok {
+			query := req.URL.Query()
+			for _, header := range headers {
+				if value := req.Header.Get(header); value != "" {
+					query.Set(strings.ToLower(header), value)
+					req.Header.Del(header)
+				}
+			}
+			req.URL.RawQuery = query.Encode()
+		}
+		return next.HandleBuild(ctx, in)
+	})
+
+	return func(opts *s3.PresignOptions) {
+		opts.ClientOptions = append(opts.ClientOptions, func(o *s3.Options) {
+			o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+				return stack.Build.Add(hoist, middleware.After)
+			})
+		})
+	}
+}
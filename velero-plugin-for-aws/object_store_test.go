@@ -19,9 +19,14 @@ package main
 import (
 	"context"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"net/http"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
@@ -33,6 +38,11 @@ type mockS3 struct {
 	mock.Mock
 }
 
+func (m *mockS3) HeadBucket(ctx context.Context, input *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.HeadBucketOutput), args.Error(1)
+}
+
 func (m *mockS3) HeadObject(ctx context.Context, input *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
 	args := m.Called(ctx, input)
 	return args.Get(0).(*s3.HeadObjectOutput), args.Error(1)
@@ -53,6 +63,36 @@ func (m *mockS3) DeleteObject(ctx context.Context, input *s3.DeleteObjectInput,
 	return args.Get(0).(*s3.DeleteObjectOutput), args.Error(1)
 }
 
+func (m *mockS3) CopyObject(ctx context.Context, input *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.CopyObjectOutput), args.Error(1)
+}
+
+func (m *mockS3) ListObjectVersions(ctx context.Context, input *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.ListObjectVersionsOutput), args.Error(1)
+}
+
+func (m *mockS3) DeleteObjects(ctx context.Context, input *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.DeleteObjectsOutput), args.Error(1)
+}
+
+func (m *mockS3) GetBucketVersioning(ctx context.Context, input *s3.GetBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.GetBucketVersioningOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.GetBucketVersioningOutput), args.Error(1)
+}
+
+func (m *mockS3) GetObjectTagging(ctx context.Context, input *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.GetObjectTaggingOutput), args.Error(1)
+}
+
+func (m *mockS3) PutObjectTagging(ctx context.Context, input *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.PutObjectTaggingOutput), args.Error(1)
+}
+
 func TestObjectExists(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -248,3 +288,154 @@ func TestValidChecksumAlg(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateSignedURL(t *testing.T) {
+	tests := []struct {
+		name               string
+		customerKey        bool
+		requireCustomerKey bool
+		headErr            error
+		expectedError      string
+	}{
+		{
+			name: "no SSE-C",
+		},
+		{
+			name:          "SSE-C object",
+			customerKey:   true,
+			expectedError: "object k is encrypted with SSE-C and cannot be downloaded from a signed URL; set signedURLRequireCustomerKey and use the download command to download it",
+		},
+		{
+			name:               "SSE-C object with signedURLRequireCustomerKey",
+			customerKey:        true,
+			requireCustomerKey: true,
+		},
+		{
+			name:          "error finding the key",
+			customerKey:   true,
+			headErr:       errors.New("bad"),
+			expectedError: "error finding SSE-C key of object k: bad",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := new(mockS3)
+			defer s.AssertExpectations(t)
+
+			o := &ObjectStore{
+				log:       newLogger(),
+				s3:        s,
+				preSignS3: s3.NewPresignClient(newTestS3Client(t, nil)),
+
+				signedURLRequireCustomerKey: tc.requireCustomerKey,
+			}
+			if tc.customerKey {
+				o.sseCustomerKey, o.sseCustomerKeyMd5 = currentTestKey.key, currentTestKey.md5
+				s.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, tc.headErr)
+			}
+
+			signedURL, err := o.CreateSignedURL("b", "k", time.Minute)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Contains(t, signedURL, "X-Amz-Expires=60")
+			assert.NotContains(t, signedURL, url.QueryEscape(currentTestKey.key))
+
+			required, err := requiresCustomerKey(signedURL)
+			require.NoError(t, err)
+			assert.Equal(t, tc.requireCustomerKey, required)
+		})
+	}
+}
+
+func TestRequesterPaysAndExpectedBucketOwner(t *testing.T) {
+	var requests []*http.Request
+	client := newTestS3Client(t, func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req)
+		if req.URL.Query().Get("list-type") == "2" {
+			return newTestResponse(req, http.StatusOK, "<ListBucketResult></ListBucketResult>"), nil
+		}
+		return newTestResponse(req, http.StatusOK, ""), nil
+	})
+	o := &ObjectStore{
+		log:                 newLogger(),
+		s3:                  client,
+		s3Uploader:          manager.NewUploader(client),
+		preSignS3:           s3.NewPresignClient(client),
+		requestPayer:        types.RequestPayerRequester,
+		expectedBucketOwner: aws.String("111122223333"),
+	}
+
+	require.NoError(t, o.PutObject("bucket", "key", strings.NewReader("data")))
+	_, err := o.ObjectExists("bucket", "key")
+	require.NoError(t, err)
+	body, err := o.GetObject("bucket", "key")
+	require.NoError(t, err)
+	body.Close()
+	_, err = o.ListObjects("bucket", "prefix/")
+	require.NoError(t, err)
+	_, err = o.ListCommonPrefixes("bucket", "prefix/", "/")
+	require.NoError(t, err)
+	require.NoError(t, o.DeleteObject("bucket", "key"))
+
+	require.Len(t, requests, 6)
+	for _, req := range requests {
+		assert.Equal(t, "requester", req.Header.Get("X-Amz-Request-Payer"), "%s %s", req.Method, req.URL)
+		assert.Equal(t, "111122223333", req.Header.Get("X-Amz-Expected-Bucket-Owner"), "%s %s", req.Method, req.URL)
+	}
+
+	signedURL, err := o.CreateSignedURL("bucket", "key", time.Minute)
+	require.NoError(t, err)
+	u, err := url.Parse(signedURL)
+	require.NoError(t, err)
+	assert.Equal(t, "requester", u.Query().Get("x-amz-request-payer"))
+	assert.Equal(t, "111122223333", u.Query().Get("x-amz-expected-bucket-owner"))
+}
+
+func TestRequesterPaysAndExpectedBucketOwnerConfig(t *testing.T) {
+	tests := []struct {
+		name                string
+		config              map[string]string
+		expectedPayer       types.RequestPayer
+		expectedBucketOwner *string
+		expectedErr         string
+	}{
+		{
+			name:   "not set",
+			config: map[string]string{"bucket": "bucket", "region": "us-east-1"},
+		},
+		{
+			name:                "set",
+			config:              map[string]string{"bucket": "bucket", "region": "us-east-1", "requesterPays": "true", "expectedBucketOwner": "111122223333"},
+			expectedPayer:       types.RequestPayerRequester,
+			expectedBucketOwner: aws.String("111122223333"),
+		},
+		{
+			name:        "invalid requesterPays",
+			config:      map[string]string{"bucket": "bucket", "region": "us-east-1", "requesterPays": "maybe"},
+			expectedErr: "could not parse requesterPays (expected bool)",
+		},
+		{
+			name:        "invalid expectedBucketOwner",
+			config:      map[string]string{"bucket": "bucket", "region": "us-east-1", "expectedBucketOwner": "my-account"},
+			expectedErr: `invalid expectedBucketOwner "my-account", expected a 12-digit AWS account ID`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o := newObjectStore(newLogger())
+			err := o.Init(tc.config)
+			if tc.expectedErr != "" {
+				assert.ErrorContains(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedPayer, o.requestPayer)
+			assert.Equal(t, tc.expectedBucketOwner, o.expectedBucketOwner)
+		})
+	}
+}
@@ -0,0 +1,333 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// validatePermissionsKey enables the permission check in Init of both
+	// the object store and the volume snapshotter.
+	validatePermissionsKey = "validatePermissions"
+
+	// permissionCheckKeyPrefix is the name prefix of the sentinel object
+	// written under the backup storage location prefix.
+	permissionCheckKeyPrefix = ".velero-plugin-for-aws-permission-check-"
+
+	// Placeholder IDs used by the EC2 dry-run checks. EC2 checks whether
+	// the caller is authorized before it looks the resources up.
+	dryRunVolumeID   = "vol-00000000000000000"
+	dryRunSnapshotID = "snap-00000000000000000"
+)
+
+type checkResult string
+
+const (
+	// checkPassed means the call succeeded, or the dry run would have.
+	checkPassed checkResult = "passed"
+	// checkDenied means the credentials lack a permission for the call.
+	checkDenied checkResult = "denied"
+	// checkFailed means the call failed for a reason other than
+	// permissions, e.g. the bucket does not exist.
+	checkFailed checkResult = "failed"
+	// checkUnverified means a dry run failed before EC2 evaluated
+	// permissions, so they could not be determined.
+	checkUnverified checkResult = "unverified"
+	// checkSkipped means the check depends on an earlier one that did not
+	// pass.
+	checkSkipped checkResult = "skipped"
+)
+
+// permissionCheck is the outcome of one API call made by the permission
+// check.
+type permissionCheck struct {
+	Operation string      `json:"operation"`
+	Actions   []string    `json:"actions"`
+	Resource  string      `json:"resource"`
+	Result    checkResult `json:"result"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// permissionReport lists the outcome of every check, in the order they ran.
+type permissionReport struct {
+	Checks []permissionCheck `json:"checks"`
+}
+
+func (r *permissionReport) add(operation string, actions []string, resource string, err error) checkResult {
+	check := permissionCheck{
+		Operation: operation,
+		Actions:   actions,
+		Resource:  resource,
+		Result:    checkPassed,
+	}
+	if err != nil {
+		check.Error = err.Error()
+		check.Result = checkFailed
+		if isAccessDenied(err) {
+			check.Result = checkDenied
+		}
+	}
+	r.Checks = append(r.Checks, check)
+	return check.Result
+}
+
+// addDryRun records the outcome of an EC2 call made with DryRun set, which
+// always fails: with DryRunOperation if the call would have succeeded.
+func (r *permissionReport) addDryRun(operation string, actions []string, resource string, err error) {
+	check := permissionCheck{
+		Operation: operation,
+		Actions:   actions,
+		Resource:  resource,
+		Result:    checkPassed,
+	}
+	switch {
+	case errorCode(err) == "DryRunOperation":
+	case isAccessDenied(err):
+		check.Result = checkDenied
+		check.Error = err.Error()
+	default:
+		check.Result = checkUnverified
+		if err != nil {
+			check.Error = err.Error()
+		}
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+func (r *permissionReport) skip(operation string, actions []string, resource string) {
+	r.Checks = append(r.Checks, permissionCheck{
+		Operation: operation,
+		Actions:   actions,
+		Resource:  resource,
+		Result:    checkSkipped,
+	})
+}
+
+// missingPermissions returns the actions of the denied checks, with the
+// resource they were denied on.
+func (r *permissionReport) missingPermissions() []string {
+	var missing []string
+	for _, check := range r.Checks {
+		if check.Result == checkDenied {
+			missing = append(missing, fmt.Sprintf("%s on %s", strings.Join(check.Actions, ", "), check.Resource))
+		}
+	}
+	return missing
+}
+
+// err returns an error naming the missing permissions and failed checks,
+// or nil if no check was denied or failed.
+func (r *permissionReport) err() error {
+	var problems []string
+	if missing := r.missingPermissions(); len(missing) > 0 {
+		problems = append(problems, "missing permissions: "+strings.Join(missing, "; "))
+	}
+	for _, check := range r.Checks {
+		if check.Result == checkFailed {
+			problems = append(problems, fmt.Sprintf("%s on %s failed: %s", check.Operation, check.Resource, check.Error))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.Errorf("permission check failed: %s", strings.Join(problems, "; "))
+}
+
+func (r *permissionReport) log(log logrus.FieldLogger) {
+	for _, check := range r.Checks {
+		entry := log.WithFields(logrus.Fields{
+			"operation": check.Operation,
+			"actions":   strings.Join(check.Actions, ","),
+			"resource":  check.Resource,
+			"result":    check.Result,
+		})
+		if check.Error != "" {
+			entry = entry.WithField("error", check.Error)
+		}
+		if check.Result == checkPassed || check.Result == checkSkipped {
+			entry.Debug("Permission check")
+		} else {
+			entry.Warn("Permission check")
+		}
+	}
+}
+
+// isAccessDenied reports whether err is an authorization failure from S3,
+// EC2 or KMS.
+func isAccessDenied(err error) bool {
+	switch errorCode(err) {
+	case "AccessDenied", "AccessDeniedException", "UnauthorizedOperation", "Forbidden":
+		return true
+	}
+	var respErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusForbidden
+}
+
+type kmsDescribeKeyAPI interface {
+	DescribeKey(ctx context.Context, input *kms.DescribeKeyInput, optFns ...func(*kms.Options)) (*kms.DescribeKeyOutput, error)
+}
+
+func checkKMSKey(ctx context.Context, report *permissionReport, client kmsDescribeKeyAPI, keyID string, actions []string) {
+	_, err := client.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(keyID)})
+	report.add("DescribeKey", actions, keyID, err)
+}
+
+// checkPermissions exercises the S3 calls the object store makes on bucket
+// by writing, reading back and deleting a sentinel object under prefix.
+// kmsClient is only used when kmsKeyId is set.
+func (o *ObjectStore) checkPermissions(ctx context.Context, bucket, prefix string, kmsClient kmsDescribeKeyAPI) *permissionReport {
+	report := &permissionReport{}
+	bucketResource := "s3://" + bucket
+	config := map[string]string{kmsKeyIDKey: o.kmsKeyID, validatePermissionsKey: "true"}
+	actions := func(operation string) []string {
+		if isDirectoryBucket(bucket) {
+			return []string{directoryBucketSessionAction}
+		}
+		return operationActions(objectStoreOperations, operation, config)
+	}
+
+	_, err := o.s3.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket:              aws.String(bucket),
+		ExpectedBucketOwner: o.expectedBucketOwner,
+	})
+	report.add("HeadBucket", actions("HeadBucket"), bucketResource, err)
+
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		report.add("PutObject", actions("PutObject"), bucketResource, errors.WithStack(err))
+		return report
+	}
+	key := path.Join(prefix, permissionCheckKeyPrefix+hex.EncodeToString(suffix[:]))
+	objectResource := bucketResource + "/" + key
+	// the sentinel is tagged like the other objects under prefix. It
+	// belongs to no backup, so its tags are within the limits checked by
+	// Init.
+	config[taggingKey], _ = o.tagging.header(key)
+	content := []byte("velero-plugin-for-aws permission check")
+
+	putActions, getActions, deleteActions := actions("PutObject"), actions("GetObject"), actions("DeleteObject")
+
+	// the sentinel is written to the bucket only, not to the mirror
+	versionID, err := o.putObject(ctx, bucket, key, bytes.NewReader(content))
+	o.cache.invalidate(bucket, key)
+	if report.add("PutObject", putActions, objectResource, err) != checkPassed {
+		report.skip("GetObject", getActions, objectResource)
+		report.skip("DeleteObject", deleteActions, objectResource)
+	} else {
+		body, err := o.GetObject(bucket, key)
+		if err == nil {
+			var read []byte
+			read, err = io.ReadAll(body)
+			body.Close()
+			if err == nil && !bytes.Equal(read, content) {
+				err = errors.New("object content read back does not match what was written")
+			}
+		}
+		report.add("GetObject", getActions, objectResource, err)
+		report.add("DeleteObject", deleteActions, objectResource, o.deleteSentinel(ctx, bucket, key, versionID))
+	}
+
+	if o.kmsKeyID != "" && kmsClient != nil {
+		checkKMSKey(ctx, report, kmsClient, o.kmsKeyID, actions("DescribeKey"))
+	}
+	return report
+}
+
+// deleteSentinel deletes the version of the sentinel object that the
+// permission check wrote, so that a versioned bucket is left with neither
+// the version nor a delete marker. The sentinel is deleted permanently
+// rather than moved to the trash.
+func (o *ObjectStore) deleteSentinel(ctx context.Context, bucket, key, versionID string) error {
+	_, err := o.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:              aws.String(bucket),
+		Key:                 aws.String(key),
+		VersionId:           optionalString(versionID),
+		RequestPayer:        o.requestPayer,
+		ExpectedBucketOwner: o.expectedBucketOwner,
+	})
+	o.cache.invalidate(bucket, key)
+	return errors.Wrapf(err, "error deleting object %s", key)
+}
+
+// checkPermissions dry-runs the EC2 calls the volume snapshotter makes.
+// kmsClient is only used when ebsKmsKeyId is set.
+func (b *VolumeSnapshotter) checkPermissions(ctx context.Context, region string, kmsClient kmsDescribeKeyAPI) *permissionReport {
+	report := &permissionReport{}
+	regionResource := "ec2:" + region
+	dryRun := aws.Bool(true)
+	config := map[string]string{ebsKmsKeyIDKey: b.ebsKmsKeyId, validatePermissionsKey: "true"}
+	actions := func(operation string) []string {
+		return operationActions(volumeSnapshotterOperations, operation, config)
+	}
+	// tagged like Velero's snapshots, which the generated policy requires
+	tags := []ec2types.Tag{ec2Tag(veleroBackupTagKey, "velero-plugin-for-aws-permission-check")}
+
+	_, err := b.ec2.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{DryRun: dryRun})
+	report.addDryRun("DescribeVolumes", actions("DescribeVolumes"), regionResource, err)
+
+	_, err = b.ec2.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{DryRun: dryRun, OwnerIds: []string{"self"}})
+	report.addDryRun("DescribeSnapshots", actions("DescribeSnapshots"), regionResource, err)
+
+	_, err = b.ec2.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
+		DryRun:   dryRun,
+		VolumeId: aws.String(dryRunVolumeID),
+		TagSpecifications: []ec2types.TagSpecification{
+			{ResourceType: ec2types.ResourceTypeSnapshot, Tags: tags},
+		},
+	})
+	report.addDryRun("CreateSnapshot", actions("CreateSnapshot"), regionResource, err)
+
+	createVolume := &ec2.CreateVolumeInput{
+		DryRun:           dryRun,
+		SnapshotId:       aws.String(dryRunSnapshotID),
+		AvailabilityZone: aws.String(region + "a"),
+		TagSpecifications: []ec2types.TagSpecification{
+			{ResourceType: ec2types.ResourceTypeVolume, Tags: tags},
+		},
+	}
+	if b.ebsKmsKeyId != "" {
+		createVolume.Encrypted = aws.Bool(true)
+		createVolume.KmsKeyId = aws.String(b.ebsKmsKeyId)
+	}
+	_, err = b.ec2.CreateVolume(ctx, createVolume)
+	report.addDryRun("CreateVolume", actions("CreateVolume"), regionResource, err)
+
+	_, err = b.ec2.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{DryRun: dryRun, SnapshotId: aws.String(dryRunSnapshotID)})
+	report.addDryRun("DeleteSnapshot", actions("DeleteSnapshot"), regionResource, err)
+
+	if b.ebsKmsKeyId != "" && kmsClient != nil {
+		checkKMSKey(ctx, report, kmsClient, b.ebsKmsKeyId, actions("DescribeKey"))
+	}
+	return report
+}
@@ -0,0 +1,174 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeKMS struct {
+	err error
+}
+
+func (f *fakeKMS) DescribeKey(ctx context.Context, input *kms.DescribeKeyInput, optFns ...func(*kms.Options)) (*kms.DescribeKeyOutput, error) {
+	return &kms.DescribeKeyOutput{}, f.err
+}
+
+// newPermissionCheckObjectStore returns an object store backed by an
+// in-memory bucket that denies the given S3 methods.
+func newPermissionCheckObjectStore(t *testing.T, deniedMethods ...string) *ObjectStore {
+	objects := map[string]string{}
+	client := newTestS3Client(t, func(req *http.Request) (*http.Response, error) {
+		for _, method := range deniedMethods {
+			if req.Method == method {
+				return newTestResponse(req, http.StatusForbidden, "<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>"), nil
+			}
+		}
+		switch req.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(req.Body)
+			objects[req.URL.Path] = string(body)
+			return newTestResponse(req, http.StatusOK, ""), nil
+		case http.MethodGet:
+			return newTestResponse(req, http.StatusOK, objects[req.URL.Path]), nil
+		case http.MethodDelete:
+			delete(objects, req.URL.Path)
+			return newTestResponse(req, http.StatusNoContent, ""), nil
+		}
+		return newTestResponse(req, http.StatusOK, ""), nil
+	})
+	return &ObjectStore{
+		log:        newLogger(),
+		s3:         client,
+		s3Uploader: manager.NewUploader(client),
+	}
+}
+
+func checkResults(report *permissionReport) map[string]checkResult {
+	results := map[string]checkResult{}
+	for _, check := range report.Checks {
+		results[check.Operation] = check.Result
+	}
+	return results
+}
+
+func TestObjectStoreCheckPermissions(t *testing.T) {
+	o := newPermissionCheckObjectStore(t)
+	report := o.checkPermissions(context.Background(), "bucket", "prefix", nil)
+	require.NoError(t, report.err())
+	assert.Equal(t, map[string]checkResult{
+		"HeadBucket":   checkPassed,
+		"PutObject":    checkPassed,
+		"GetObject":    checkPassed,
+		"DeleteObject": checkPassed,
+	}, checkResults(report))
+	assert.True(t, strings.HasPrefix(report.Checks[1].Resource, "s3://bucket/prefix/"+permissionCheckKeyPrefix), report.Checks[1].Resource)
+}
+
+func TestObjectStoreCheckPermissionsDeletesSentinelVersion(t *testing.T) {
+	var deleted []string
+	client := newTestS3Client(t, func(req *http.Request) (*http.Response, error) {
+		switch req.Method {
+		case http.MethodPut:
+			resp := newTestResponse(req, http.StatusOK, "")
+			resp.Header.Set("x-amz-version-id", "v1")
+			return resp, nil
+		case http.MethodGet:
+			return newTestResponse(req, http.StatusOK, "velero-plugin-for-aws permission check"), nil
+		case http.MethodDelete:
+			deleted = append(deleted, req.URL.Query().Get("versionId"))
+			return newTestResponse(req, http.StatusNoContent, ""), nil
+		}
+		return newTestResponse(req, http.StatusOK, ""), nil
+	})
+	o := &ObjectStore{log: newLogger(), s3: client, s3Uploader: manager.NewUploader(client), versionedDeletes: true}
+
+	report := o.checkPermissions(context.Background(), "bucket", "prefix", nil)
+	require.NoError(t, report.err())
+	assert.Equal(t, []string{"v1"}, deleted)
+	assert.Equal(t, []string{"s3:DeleteObject", "s3:DeleteObjectVersion"}, report.Checks[3].Actions)
+}
+
+func TestObjectStoreCheckPermissionsDenied(t *testing.T) {
+	o := newPermissionCheckObjectStore(t, http.MethodPut)
+	o.kmsKeyID = "alias/backups"
+	report := o.checkPermissions(context.Background(), "bucket", "", &fakeKMS{
+		err: &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized"},
+	})
+
+	assert.Equal(t, map[string]checkResult{
+		"HeadBucket":   checkPassed,
+		"PutObject":    checkDenied,
+		"GetObject":    checkSkipped,
+		"DeleteObject": checkSkipped,
+		"DescribeKey":  checkDenied,
+	}, checkResults(report))
+
+	missing := report.missingPermissions()
+	require.Len(t, missing, 2)
+	assert.Regexp(t, `^s3:PutObject, kms:GenerateDataKey on s3://bucket/\.velero-plugin-for-aws-permission-check-[0-9a-f]+$`, missing[0])
+	assert.Equal(t, "kms:DescribeKey on alias/backups", missing[1])
+	assert.ErrorContains(t, report.err(), "permission check failed: missing permissions: s3:PutObject, kms:GenerateDataKey on s3://bucket/")
+}
+
+func TestVolumeSnapshotterCheckPermissions(t *testing.T) {
+	errorResponse := func(code string) string {
+		return "<Response><Errors><Error><Code>" + code + "</Code><Message>message</Message></Error></Errors><RequestID>id</RequestID></Response>"
+	}
+
+	client := ec2.New(ec2.Options{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		HTTPClient: smithyhttp.ClientDoFunc(func(req *http.Request) (*http.Response, error) {
+			body, _ := io.ReadAll(req.Body)
+			form, _ := url.ParseQuery(string(body))
+			switch form.Get("Action") {
+			case "CreateVolume":
+				return newTestResponse(req, http.StatusForbidden, errorResponse("UnauthorizedOperation")), nil
+			case "DeleteSnapshot":
+				return newTestResponse(req, http.StatusBadRequest, errorResponse("InvalidParameterValue")), nil
+			}
+			return newTestResponse(req, http.StatusPreconditionFailed, errorResponse("DryRunOperation")), nil
+		}),
+	})
+	b := &VolumeSnapshotter{log: newLogger(), ec2: client}
+
+	report := b.checkPermissions(context.Background(), "us-east-1", nil)
+	assert.Equal(t, map[string]checkResult{
+		"DescribeVolumes":   checkPassed,
+		"DescribeSnapshots": checkPassed,
+		"CreateSnapshot":    checkPassed,
+		"CreateVolume":      checkDenied,
+		"DeleteSnapshot":    checkUnverified,
+	}, checkResults(report))
+	assert.Equal(t, []string{"ec2:CreateVolume, ec2:CreateTags on ec2:us-east-1"}, report.missingPermissions())
+	assert.EqualError(t, report.err(), "permission check failed: missing permissions: ec2:CreateVolume, ec2:CreateTags on ec2:us-east-1")
+}
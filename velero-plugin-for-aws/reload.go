@@ -0,0 +1,254 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	caCertFileKey = "caCertFile"
+
+	// credentialsReloadInterval is how often the credentials file is
+	// checked for changes.
+	credentialsReloadInterval = time.Minute
+
+	reloadKindCredentials   = "credentials"
+	reloadKindCACert        = "caCert"
+	reloadKindTLSClientCert = "tlsClientCert"
+)
+
+// recordReload logs and counts a reload of kind from file.
+func recordReload(log logrus.FieldLogger, kind, file string, err error) {
+	log = log.WithFields(logrus.Fields{"kind": kind, "file": file})
+	if err != nil {
+		reloadsTotal.WithLabelValues(kind, reloadResultFailure).Inc()
+		log.WithError(err).Warn("Failed to reload changed file, using the previous contents")
+		return
+	}
+	reloadsTotal.WithLabelValues(kind, reloadResultSuccess).Inc()
+	log.Info("Reloaded changed file")
+}
+
+// fileModTime returns the modification time of file, following symlinks
+// such as those of Kubernetes secret volumes. It is zero if the file
+// cannot be read, so that a file that is briefly missing is not reloaded.
+func fileModTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadingCredentials resolves the credentials of a location again when
+// its credentials file changes. If the changed file does not yield
+// credentials, the previous ones are used until it changes again.
+type reloadingCredentials struct {
+	log  logrus.FieldLogger
+	file string
+	// sync, if set, updates file from where the credentials are stored
+	sync func() error
+	// loaded, if set, is called after the credentials of file were loaded
+	loaded func() error
+	// resolve returns the credentials provider for the current file.
+	resolve  func(ctx context.Context) (aws.CredentialsProvider, error)
+	interval time.Duration
+
+	mu       sync.Mutex
+	provider aws.CredentialsProvider
+	modTime  time.Time
+}
+
+// newReloadingCredentials returns a provider that starts with provider,
+// which was resolved from file.
+func newReloadingCredentials(log logrus.FieldLogger, file string, sync func() error, loaded func() error, provider aws.CredentialsProvider, resolve func(ctx context.Context) (aws.CredentialsProvider, error)) *aws.CredentialsCache {
+	return aws.NewCredentialsCache(&reloadingCredentials{
+		log:      log,
+		file:     file,
+		sync:     sync,
+		loaded:   loaded,
+		resolve:  resolve,
+		interval: credentialsReloadInterval,
+		provider: provider,
+		modTime:  fileModTime(file),
+	})
+}
+
+// Retrieve returns the credentials of the current file. They expire after
+// the reload interval at the latest, so that the credentials cache of the
+// SDK calls Retrieve again to check the file.
+func (r *reloadingCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sync != nil {
+		if err := r.sync(); err != nil {
+			reloadsTotal.WithLabelValues(reloadKindCredentials, reloadResultFailure).Inc()
+			r.log.WithError(err).Warn("Failed to refresh credentials, using the previous ones")
+		}
+	}
+	if modTime := fileModTime(r.file); !modTime.IsZero() && !modTime.Equal(r.modTime) {
+		provider, err := r.resolve(ctx)
+		if err == nil {
+			_, err = provider.Retrieve(ctx)
+		}
+		if err == nil {
+			r.provider = provider
+		}
+		// a file that cannot be loaded is tried again once it changes again
+		r.modTime = modTime
+		recordReload(r.log, reloadKindCredentials, r.file, err)
+		if r.loaded != nil {
+			if err := r.loaded(); err != nil {
+				r.log.WithError(err).Warn("Failed to clean up the credentials file")
+			}
+		}
+	}
+
+	creds, err := r.provider.Retrieve(ctx)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	if expires := time.Now().Add(r.interval); !creds.CanExpire || creds.Expires.After(expires) {
+		creds.CanExpire = true
+		creds.Expires = expires
+	}
+	return creds, nil
+}
+
+// rootCAs are the certificate authorities trusted for a location: the
+// system pool, the caCert of the location and the bundle in caCertFile.
+// The bundle is read again when the file changes, and the previous pool is
+// kept if the new bundle is invalid.
+type rootCAs struct {
+	log    logrus.FieldLogger
+	caCert string
+	file   string
+
+	mu      sync.Mutex
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+// newRootCAs returns the trusted authorities for caCert and caCertFile, or
+// nil if neither is set and the system pool should be used.
+func newRootCAs(log logrus.FieldLogger, caCert, caCertFile string) (*rootCAs, error) {
+	if caCert == "" && caCertFile == "" {
+		return nil, nil
+	}
+	r := &rootCAs{log: log, caCert: caCert, file: caCertFile}
+	modTime := fileModTime(caCertFile)
+	pool, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.pool, r.modTime = pool, modTime
+	return r, nil
+}
+
+func (r *rootCAs) load() (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		r.log.Warnf("Failed to load system cert pool, using empty cert pool, err: %v", err)
+		pool = x509.NewCertPool()
+	}
+	pool.AppendCertsFromPEM([]byte(r.caCert))
+	// the SDK only adds the bundle of AWS_CA_BUNDLE to the client it is
+	// configured with, not to those built when caCertFile changes
+	if bundle := os.Getenv("AWS_CA_BUNDLE"); bundle != "" && r.file != "" {
+		if pem, err := os.ReadFile(bundle); err == nil {
+			pool.AppendCertsFromPEM(pem)
+		}
+	}
+	if r.file != "" {
+		bundle, err := os.ReadFile(r.file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading %s", caCertFileKey)
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, errors.Errorf("%s %s contains no PEM certificates", caCertFileKey, r.file)
+		}
+	}
+	return pool, nil
+}
+
+// current returns the pool, reloading caCertFile if it changed.
+func (r *rootCAs) current() *x509.CertPool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == "" {
+		return r.pool
+	}
+	if modTime := fileModTime(r.file); !modTime.IsZero() && !modTime.Equal(r.modTime) {
+		pool, err := r.load()
+		if err == nil {
+			r.pool = pool
+		}
+		r.modTime = modTime
+		recordReload(r.log, reloadKindCACert, r.file, err)
+	}
+	return r.pool
+}
+
+// reloadingHTTPClient sends requests with a client built for the current
+// pool of roots, building it again when caCertFile changes. Replacing the
+// client, rather than the pool of a client in use, keeps the standard
+// verification of the server certificate.
+type reloadingHTTPClient struct {
+	roots *rootCAs
+	base  *awshttp.BuildableClient
+
+	mu     sync.Mutex
+	pool   *x509.CertPool
+	client *awshttp.BuildableClient
+}
+
+// newReloadingHTTPClient returns a client that starts with base, which trusts
+// the current pool of roots.
+func newReloadingHTTPClient(roots *rootCAs, base *awshttp.BuildableClient) *reloadingHTTPClient {
+	return &reloadingHTTPClient{roots: roots, base: base, pool: roots.current(), client: base}
+}
+
+func (c *reloadingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	pool := c.roots.current()
+
+	c.mu.Lock()
+	if pool != c.pool {
+		// the copy has its own transport and TLS config, so connections
+		// of the previous client are not affected
+		c.client = c.base.WithTransportOptions(func(tr *http.Transport) {
+			tr.TLSClientConfig.RootCAs = pool
+		})
+		c.pool = pool
+	}
+	client := c.client
+	c.mu.Unlock()
+
+	return client.Do(req)
+}
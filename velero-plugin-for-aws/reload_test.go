@@ -0,0 +1,141 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func reloads(kind, result string) float64 {
+	return testutil.ToFloat64(reloadsTotal.WithLabelValues(kind, result))
+}
+
+func TestReloadingCredentials(t *testing.T) {
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_PROFILE", "AWS_SHARED_CREDENTIALS_FILE",
+		"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_SESSION_NAME", "AWS_ROLE_ARN"} {
+		t.Setenv(env, "")
+	}
+	file := filepath.Join(t.TempDir(), "cloud")
+	modTime := time.Now().Add(-time.Hour)
+	writeFileAt(t, file, "[default]\naws_access_key_id = AKID1\naws_secret_access_key = SECRET1\n", modTime)
+
+	cfg, err := newConfigBuilder(newLogger()).WithRegion("us-east-1").WithCredentialsFile(file).Build()
+	require.NoError(t, err)
+	cache, ok := cfg.Credentials.(*aws.CredentialsCache)
+	require.True(t, ok)
+
+	creds, err := cache.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "AKID1", creds.AccessKeyID)
+	// static credentials expire so that the file is checked again
+	assert.True(t, creds.CanExpire)
+	assert.WithinDuration(t, time.Now().Add(credentialsReloadInterval), creds.Expires, 10*time.Second)
+
+	successes, failures := reloads(reloadKindCredentials, reloadResultSuccess), reloads(reloadKindCredentials, reloadResultFailure)
+
+	writeFileAt(t, file, "[default]\naws_access_key_id = AKID2\naws_secret_access_key = SECRET2\n", modTime.Add(time.Minute))
+	cache.Invalidate()
+	creds, err = cache.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "AKID2", creds.AccessKeyID)
+	assert.Equal(t, successes+1, reloads(reloadKindCredentials, reloadResultSuccess))
+
+	// a file without credentials keeps the previous ones, and is not tried
+	// again until it changes
+	writeFileAt(t, file, "[default]\nregion = us-east-1\n", modTime.Add(2*time.Minute))
+	for i := 0; i < 2; i++ {
+		cache.Invalidate()
+		creds, err = cache.Retrieve(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "AKID2", creds.AccessKeyID)
+	}
+	assert.Equal(t, failures+1, reloads(reloadKindCredentials, reloadResultFailure))
+
+	writeFileAt(t, file, "[default]\naws_access_key_id = AKID3\naws_secret_access_key = SECRET3\n", modTime.Add(3*time.Minute))
+	cache.Invalidate()
+	creds, err = cache.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "AKID3", creds.AccessKeyID)
+}
+
+func TestNewRootCAs(t *testing.T) {
+	roots, err := newRootCAs(newLogger(), "", "")
+	require.NoError(t, err)
+	assert.Nil(t, roots)
+
+	file := filepath.Join(t.TempDir(), "ca.crt")
+	writeFileAt(t, file, "not a certificate", time.Now())
+	_, err = newRootCAs(newLogger(), "", file)
+	assert.EqualError(t, err, "caCertFile "+file+" contains no PEM certificates")
+
+	_, err = newRootCAs(newLogger(), "", filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorContains(t, err, "error reading caCertFile")
+}
+
+func TestObjectStoreReloadsCACertFile(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverCA := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	otherCA := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newTestCA(t).cert.Raw}))
+
+	file := filepath.Join(t.TempDir(), "ca.crt")
+	modTime := time.Now().Add(-time.Hour)
+	writeFileAt(t, file, otherCA, modTime)
+
+	o := newObjectStore(newLogger())
+	require.NoError(t, o.Init(map[string]string{
+		bucketKey:           "bucket",
+		regionKey:           "us-east-1",
+		s3URLKey:            server.URL,
+		s3ForcePathStyleKey: "true",
+		caCertFileKey:       file,
+	}))
+	_, err := o.ObjectExists("bucket", "key")
+	assert.ErrorContains(t, err, "certificate signed by unknown authority")
+
+	successes, failures := reloads(reloadKindCACert, reloadResultSuccess), reloads(reloadKindCACert, reloadResultFailure)
+
+	writeFileAt(t, file, serverCA, modTime.Add(time.Minute))
+	exists, err := o.ObjectExists("bucket", "key")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, successes+1, reloads(reloadKindCACert, reloadResultSuccess))
+
+	// an invalid bundle keeps the previous one
+	writeFileAt(t, file, "not a certificate", modTime.Add(2*time.Minute))
+	server.CloseClientConnections()
+	exists, err = o.ObjectExists("bucket", "key")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, failures+1, reloads(reloadKindCACert, reloadResultFailure))
+}
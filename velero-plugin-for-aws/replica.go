@@ -0,0 +1,204 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	replicaBucketKey = "replicaBucket"
+	replicaRegionKey = "replicaRegion"
+	replicaS3URLKey  = "replicaS3Url"
+
+	// replicaFailureThreshold is the number of consecutive failed reads
+	// from the primary bucket after which reads go straight to the replica,
+	// for replicaCooldown.
+	replicaFailureThreshold = 3
+	replicaCooldown         = 30 * time.Second
+)
+
+// replicaSettings name a replica of the bucket, e.g. the destination of
+// S3 Cross-Region Replication, that reads fall back to.
+type replicaSettings struct {
+	bucket string
+	region string
+	s3URL  string
+}
+
+// parseReplicaSettings returns the replica settings of a location, or nil
+// if it has no replica.
+func parseReplicaSettings(config map[string]string) (*replicaSettings, error) {
+	settings := &replicaSettings{
+		bucket: config[replicaBucketKey],
+		region: config[replicaRegionKey],
+		s3URL:  config[replicaS3URLKey],
+	}
+	if *settings == (replicaSettings{}) {
+		return nil, nil
+	}
+	if settings.bucket == "" {
+		return nil, errors.Errorf("%s requires %s", firstSetKey(config, replicaRegionKey, replicaS3URLKey), replicaBucketKey)
+	}
+	if arn.IsARN(settings.bucket) {
+		return nil, errors.Errorf("%s cannot be an access point ARN", replicaBucketKey)
+	}
+	// the region of the replica cannot be looked up while the primary
+	// region is unavailable
+	if settings.region == "" && settings.s3URL == "" {
+		return nil, errors.Errorf("%s requires %s or %s", replicaBucketKey, replicaRegionKey, replicaS3URLKey)
+	}
+	if settings.s3URL != "" && !IsValidS3URLScheme(settings.s3URL) {
+		return nil, errors.Errorf("invalid %s %q, expected an http:// or https:// URL", replicaS3URLKey, settings.s3URL)
+	}
+	return settings, nil
+}
+
+// replicaBucket is the read-only replica of the bucket.
+type replicaBucket struct {
+	bucket  string
+	s3      s3Interface
+	breaker *circuitBreaker
+}
+
+// circuitBreaker stops reads from the primary bucket after it failed
+// repeatedly, and lets one read through again once the cooldown has passed.
+// Other reads go to the replica until that read has succeeded.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	// probing is set while the read let through after the cooldown has
+	// not finished
+	probing bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether the primary bucket should be tried. Every read that
+// it allows must be followed by success or failure.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+}
+
+// failure records a failed read and reports whether it opened the circuit.
+// A failed read after the cooldown opens it again right away.
+func (b *circuitBreaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures < b.threshold {
+		return false
+	}
+	b.openUntil = b.now().Add(b.cooldown)
+	return true
+}
+
+// isFailoverError reports whether a read from the primary bucket failed
+// because the bucket is unavailable, rather than because of the request:
+// the request could not be sent, or S3 returned a server error.
+func isFailoverError(err error) bool {
+	var sendErr *smithyhttp.RequestSendError
+	if errors.As(err, &sendErr) {
+		return true
+	}
+	var respErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() >= http.StatusInternalServerError
+}
+
+// withReplica calls read with the primary bucket and, if that fails because
+// the primary is unavailable, with the replica. Once the primary has failed
+// repeatedly, only the replica is read until the cooldown has passed. Writes
+// never go to the replica.
+func (o *ObjectStore) withReplica(ctx context.Context, log logrus.FieldLogger, bucket string, read func(client s3Interface, bucket string) error) error {
+	if o.replica == nil {
+		return read(o.s3, bucket)
+	}
+
+	if o.replica.breaker.allow() {
+		err := read(o.s3, bucket)
+		if !isFailoverError(err) {
+			o.replica.breaker.success()
+			return err
+		}
+		if o.replica.breaker.failure() {
+			log.WithError(err).Warnf("Primary bucket is unavailable, reading from replica bucket %s for the next %s", o.replica.bucket, o.replica.breaker.cooldown)
+		} else {
+			log.WithError(err).Warnf("Primary bucket is unavailable, reading from replica bucket %s", o.replica.bucket)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	err := read(o.replica.s3, o.replica.bucket)
+	return errors.Wrapf(err, "error reading from replica bucket %s", o.replica.bucket)
+}
+
+// newReplicaBucket returns the client of the replica, with the client
+// settings of the primary bucket in cfg.
+func newReplicaBucket(cfg aws.Config, settings *replicaSettings, forcePathStyle bool, signatureVersion string) (*replicaBucket, error) {
+	if settings.region != "" {
+		cfg.Region = settings.region
+	}
+	// the full slice expression keeps the primary's options unchanged
+	cfg.APIOptions = append(cfg.APIOptions[:len(cfg.APIOptions):len(cfg.APIOptions)], metricsAPIOptions(settings.bucket, cfg.Region)...)
+	cfg.APIOptions = append(cfg.APIOptions, tracingAPIOptions(cfg.Region)...)
+
+	client, err := newS3Client(cfg, settings.s3URL, forcePathStyle, signatureVersionOptions(signatureVersion, settings.bucket)...)
+	if err != nil {
+		return nil, err
+	}
+	return &replicaBucket{
+		bucket:  settings.bucket,
+		s3:      client,
+		breaker: newCircuitBreaker(replicaFailureThreshold, replicaCooldown),
+	}, nil
+}
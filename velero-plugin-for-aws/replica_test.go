@@ -0,0 +1,237 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReplicaSettings(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]string
+		expected    *replicaSettings
+		expectedErr string
+	}{
+		{
+			name:   "not configured",
+			config: map[string]string{},
+		},
+		{
+			name:     "region",
+			config:   map[string]string{replicaBucketKey: "backups-replica", replicaRegionKey: "us-west-2"},
+			expected: &replicaSettings{bucket: "backups-replica", region: "us-west-2"},
+		},
+		{
+			name:     "S3-compatible replica",
+			config:   map[string]string{replicaBucketKey: "backups", replicaS3URLKey: "https://minio-dr.local:9000"},
+			expected: &replicaSettings{bucket: "backups", s3URL: "https://minio-dr.local:9000"},
+		},
+		{
+			name:        "region without bucket",
+			config:      map[string]string{replicaRegionKey: "us-west-2"},
+			expectedErr: "replicaRegion requires replicaBucket",
+		},
+		{
+			name:        "bucket without region",
+			config:      map[string]string{replicaBucketKey: "backups-replica"},
+			expectedErr: "replicaBucket requires replicaRegion or replicaS3Url",
+		},
+		{
+			name:        "access point",
+			config:      map[string]string{replicaBucketKey: testAccessPointARN, replicaRegionKey: "us-west-2"},
+			expectedErr: "replicaBucket cannot be an access point ARN",
+		},
+		{
+			name:        "invalid URL",
+			config:      map[string]string{replicaBucketKey: "backups", replicaS3URLKey: "minio-dr.local:9000"},
+			expectedErr: `invalid replicaS3Url "minio-dr.local:9000", expected an http:// or https:// URL`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings, err := parseReplicaSettings(test.config)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, settings)
+		})
+	}
+}
+
+func TestIsFailoverError(t *testing.T) {
+	assert.True(t, isFailoverError(&smithyhttp.RequestSendError{Err: errors.New("connection refused")}))
+	assert.True(t, isFailoverError(newTestResponseError(http.StatusServiceUnavailable)))
+	assert.True(t, isFailoverError(newTestResponseError(http.StatusInternalServerError)))
+	assert.False(t, isFailoverError(newTestResponseError(http.StatusNotFound)))
+	assert.False(t, isFailoverError(newTestResponseError(http.StatusForbidden)))
+	assert.False(t, isFailoverError(errors.New("other")))
+	assert.False(t, isFailoverError(nil))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	assert.True(t, b.allow())
+	assert.False(t, b.failure())
+	assert.True(t, b.allow())
+	assert.True(t, b.failure())
+	assert.False(t, b.allow())
+
+	// one read is let through after the cooldown, and reopens the circuit
+	// if it fails
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow())
+	assert.False(t, b.allow())
+	assert.True(t, b.failure())
+	assert.False(t, b.allow())
+
+	// the other reads wait for the one let through to succeed
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow())
+	assert.False(t, b.allow())
+	b.success()
+	assert.True(t, b.allow())
+	assert.True(t, b.allow())
+	assert.False(t, b.failure())
+}
+
+func newReplicaObjectStore(primary, replica *mockS3) *ObjectStore {
+	return &ObjectStore{
+		log: newLogger(),
+		s3:  primary,
+		replica: &replicaBucket{
+			bucket:  "replica",
+			s3:      replica,
+			breaker: newCircuitBreaker(2, time.Minute),
+		},
+	}
+}
+
+func getObjectBucket(bucket string) interface{} {
+	return mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+		return aws.ToString(input.Bucket) == bucket
+	})
+}
+
+func TestGetObjectFailover(t *testing.T) {
+	primary, replica := new(mockS3), new(mockS3)
+	defer primary.AssertExpectations(t)
+	defer replica.AssertExpectations(t)
+	o := newReplicaObjectStore(primary, replica)
+
+	primary.On("GetObject", mock.Anything, getObjectBucket("bucket")).Return(&s3.GetObjectOutput{}, newTestResponseError(http.StatusServiceUnavailable)).Twice()
+
+	// the circuit opens after the second failure, so the third read goes
+	// straight to the replica
+	for i := 0; i < 3; i++ {
+		replica.On("GetObject", mock.Anything, getObjectBucket("replica")).Return(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("from replica"))}, nil).Once()
+		body, err := o.GetObject("bucket", "backups/b1/b1.tar.gz")
+		require.NoError(t, err)
+		data, err := io.ReadAll(body)
+		require.NoError(t, err)
+		assert.Equal(t, "from replica", string(data))
+	}
+}
+
+func TestReadFailoverErrors(t *testing.T) {
+	primary, replica := new(mockS3), new(mockS3)
+	defer primary.AssertExpectations(t)
+	defer replica.AssertExpectations(t)
+	o := newReplicaObjectStore(primary, replica)
+
+	// a missing object is not a reason to read the replica
+	primary.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, &types.NotFound{}).Once()
+	exists, err := o.ObjectExists("bucket", "missing")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// a missing object in the replica is reported as missing
+	primary.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, &smithyhttp.RequestSendError{Err: errors.New("connection refused")}).Once()
+	replica.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, &types.NotFound{}).Once()
+	exists, err = o.ObjectExists("bucket", "missing")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	primary.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{}, newTestResponseError(http.StatusServiceUnavailable)).Once()
+	replica.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{}, newTestResponseError(http.StatusServiceUnavailable)).Once()
+	_, err = o.GetObject("bucket", "key")
+	assert.ErrorContains(t, err, "error getting object key: error reading from replica bucket replica")
+}
+
+func TestListFailover(t *testing.T) {
+	primary, replica := new(mockS3), new(mockS3)
+	defer primary.AssertExpectations(t)
+	defer replica.AssertExpectations(t)
+	o := newReplicaObjectStore(primary, replica)
+
+	// the first page of the primary is not mixed with the replica's
+	primary.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return input.ContinuationToken == nil
+	})).Return(&s3.ListObjectsV2Output{
+		Contents:              []types.Object{{Key: aws.String("backups/b1/a")}},
+		IsTruncated:           aws.Bool(true),
+		NextContinuationToken: aws.String("next"),
+	}, nil).Once()
+	primary.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return aws.ToString(input.ContinuationToken) == "next"
+	})).Return(&s3.ListObjectsV2Output{}, newTestResponseError(http.StatusInternalServerError)).Once()
+	replica.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return aws.ToString(input.Bucket) == "replica"
+	})).Return(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("backups/b1/a")}, {Key: aws.String("backups/b1/b")}},
+	}, nil).Once()
+
+	keys, err := o.ListObjects("bucket", "backups/b1/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backups/b1/b", "backups/b1/a"}, keys)
+}
+
+func TestBackupStorageLocationPolicyReplica(t *testing.T) {
+	policy := newIAMPolicy()
+	require.NoError(t, backupStorageLocationPolicy(policy, map[string]string{
+		bucketKey:        "b",
+		regionKey:        "us-east-1",
+		prefixKey:        "velero",
+		replicaBucketKey: "b-replica",
+		replicaRegionKey: "us-west-2",
+	}))
+	assert.Equal(t, []string{"s3:GetObject"}, policy.statement(policyTarget{Sid: "S3ReplicaObjects", Resources: []string{"arn:aws:s3:::b-replica/velero/*"}}).Action)
+	assert.Equal(t, []string{"s3:ListBucket"}, policy.statement(policyTarget{
+		Sid:       "S3ReplicaListPrefix",
+		Resources: []string{"arn:aws:s3:::b-replica"},
+		Condition: iamCondition{}.with("StringLike", "s3:prefix", "velero/*"),
+	}).Action)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+)
+
+// s3EndpointVariant selects which of the AWS S3 endpoints a client uses.
+type s3EndpointVariant struct {
+	accelerate bool
+	dualStack  bool
+	fips       bool
+}
+
+func (v s3EndpointVariant) isDefault() bool {
+	return !v.accelerate && !v.dualStack && !v.fips
+}
+
+// validate rejects combinations of endpoint variants with each other and
+// with other settings that S3 does not support.
+func (v s3EndpointVariant) validate(bucket, s3URL string, forcePathStyle bool, bucketARN *bucketARN) error {
+	if v.isDefault() {
+		return nil
+	}
+	if s3URL != "" {
+		return errors.Errorf("%s, %s and %s cannot be used with %s", useAccelerateKey, useDualStackKey, useFIPSKey, s3URLKey)
+	}
+
+	if v.accelerate {
+		switch {
+		case v.fips:
+			return errors.Errorf("%s cannot be used with %s, S3 Transfer Acceleration has no FIPS endpoints", useAccelerateKey, useFIPSKey)
+		case forcePathStyle:
+			return errors.Errorf("%s cannot be used with %s", useAccelerateKey, s3ForcePathStyleKey)
+		case bucketARN != nil:
+			return errors.Errorf("%s cannot be used when the bucket is an access point ARN", useAccelerateKey)
+		case strings.Contains(bucket, "."):
+			return errors.Errorf("%s cannot be used with bucket %s, S3 Transfer Acceleration requires bucket names without dots", useAccelerateKey, bucket)
+		}
+	}
+
+	if bucketARN != nil && bucketARN.multiRegion {
+		return errors.Errorf("%s and %s cannot be used with multi-region access points", useDualStackKey, useFIPSKey)
+	}
+	return nil
+}
+
+// options returns the S3 client options that select the endpoint variant.
+// Variants that are not enabled are left unset so that they can still be
+// enabled through the shared config or environment.
+func (v s3EndpointVariant) options() []func(*s3.Options) {
+	if v.isDefault() {
+		return nil
+	}
+	return []func(*s3.Options){
+		func(o *s3.Options) {
+			o.UseAccelerate = v.accelerate
+			if v.dualStack {
+				o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
+			}
+			if v.fips {
+				o.EndpointOptions.UseFIPSEndpoint = aws.FIPSEndpointStateEnabled
+			}
+		},
+	}
+}
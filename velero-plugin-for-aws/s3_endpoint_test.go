@@ -0,0 +1,169 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3EndpointVariantValidate(t *testing.T) {
+	accessPoint, err := parseBucketARN(testAccessPointARN)
+	require.NoError(t, err)
+	multiRegion, err := parseBucketARN(testMultiRegionARN)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		variant        s3EndpointVariant
+		bucket         string
+		s3URL          string
+		forcePathStyle bool
+		bucketARN      *bucketARN
+		expectedErr    string
+	}{
+		{
+			name:           "default endpoint allows everything",
+			bucket:         "my.bucket",
+			s3URL:          "https://minio.example.com",
+			forcePathStyle: true,
+		},
+		{
+			name:    "dual-stack FIPS",
+			variant: s3EndpointVariant{dualStack: true, fips: true},
+			bucket:  "bucket",
+		},
+		{
+			name:      "dual-stack access point",
+			variant:   s3EndpointVariant{dualStack: true},
+			bucket:    testAccessPointARN,
+			bucketARN: accessPoint,
+		},
+		{
+			name:        "s3Url",
+			variant:     s3EndpointVariant{dualStack: true},
+			bucket:      "bucket",
+			s3URL:       "https://minio.example.com",
+			expectedErr: "useAccelerate, useDualStack and useFIPS cannot be used with s3Url",
+		},
+		{
+			name:        "accelerate with FIPS",
+			variant:     s3EndpointVariant{accelerate: true, fips: true},
+			bucket:      "bucket",
+			expectedErr: "useAccelerate cannot be used with useFIPS",
+		},
+		{
+			name:           "accelerate with path style",
+			variant:        s3EndpointVariant{accelerate: true},
+			bucket:         "bucket",
+			forcePathStyle: true,
+			expectedErr:    "useAccelerate cannot be used with s3ForcePathStyle",
+		},
+		{
+			name:        "accelerate with dotted bucket",
+			variant:     s3EndpointVariant{accelerate: true},
+			bucket:      "my.bucket",
+			expectedErr: "requires bucket names without dots",
+		},
+		{
+			name:        "accelerate with access point",
+			variant:     s3EndpointVariant{accelerate: true},
+			bucket:      testAccessPointARN,
+			bucketARN:   accessPoint,
+			expectedErr: "useAccelerate cannot be used when the bucket is an access point ARN",
+		},
+		{
+			name:        "FIPS with multi-region access point",
+			variant:     s3EndpointVariant{fips: true},
+			bucket:      testMultiRegionARN,
+			bucketARN:   multiRegion,
+			expectedErr: "cannot be used with multi-region access points",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.variant.validate(test.bucket, test.s3URL, test.forcePathStyle, test.bucketARN)
+			if test.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, test.expectedErr)
+			}
+		})
+	}
+}
+
+func TestS3EndpointVariantOptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		variant      s3EndpointVariant
+		expectedHost string
+	}{
+		{
+			name:         "default",
+			expectedHost: "bucket.s3.us-east-1.amazonaws.com",
+		},
+		{
+			name:         "accelerate",
+			variant:      s3EndpointVariant{accelerate: true},
+			expectedHost: "bucket.s3-accelerate.amazonaws.com",
+		},
+		{
+			name:         "accelerate dual-stack",
+			variant:      s3EndpointVariant{accelerate: true, dualStack: true},
+			expectedHost: "bucket.s3-accelerate.dualstack.amazonaws.com",
+		},
+		{
+			name:         "dual-stack",
+			variant:      s3EndpointVariant{dualStack: true},
+			expectedHost: "bucket.s3.dualstack.us-east-1.amazonaws.com",
+		},
+		{
+			name:         "FIPS",
+			variant:      s3EndpointVariant{fips: true},
+			expectedHost: "bucket.s3-fips.us-east-1.amazonaws.com",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var host string
+			client := newTestS3Client(t, func(req *http.Request) (*http.Response, error) {
+				host = req.URL.Host
+				return newTestResponse(req, http.StatusOK, ""), nil
+			})
+			client = s3.New(client.Options(), test.variant.options()...)
+
+			_, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedHost, host)
+
+			req, err := s3.NewPresignClient(client).PresignGetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+			require.NoError(t, err)
+			u, err := url.Parse(req.URL)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedHost, u.Host)
+		})
+	}
+}
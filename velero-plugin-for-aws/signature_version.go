@@ -0,0 +1,297 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	smithyauth "github.com/aws/smithy-go/auth"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/pkg/errors"
+)
+
+const (
+	// signatureVersion1 signs the signed URLs with SigV2 and every other
+	// request with SigV4, which is what "1" did in earlier versions of the
+	// plugin.
+	signatureVersion1  = "1"
+	signatureVersion2  = "2"
+	signatureVersion4  = "4"
+	signatureVersion4a = "4a"
+
+	// signingMiddlewareID is the ID of the SDK middleware that signs
+	// requests in the finalize step.
+	signingMiddlewareID = "Signing"
+)
+
+// sigV2SubResources are the query parameters that are part of the resource
+// being signed with SigV2.
+var sigV2SubResources = map[string]bool{
+	"acl": true, "cors": true, "delete": true, "encryption": true, "legal-hold": true,
+	"lifecycle": true, "location": true, "logging": true, "notification": true,
+	"object-lock": true, "partNumber": true, "policy": true, "replication": true,
+	"requestPayment": true, "restore": true, "retention": true, "tagging": true,
+	"torrent": true, "uploadId": true, "uploads": true, "versionId": true,
+	"versioning": true, "versions": true, "website": true,
+	"response-cache-control": true, "response-content-disposition": true,
+	"response-content-encoding": true, "response-content-language": true,
+	"response-content-type": true, "response-expires": true,
+}
+
+// parseSignatureVersion validates the signatureVersion config value.
+func parseSignatureVersion(version string) (string, error) {
+	switch version {
+	case "", signatureVersion4:
+		return signatureVersion4, nil
+	case signatureVersion1, signatureVersion2, signatureVersion4a:
+		return version, nil
+	}
+	return "", errors.Errorf("invalid %s %q, expected one of %q, %q, %q or %q", signatureVersionKey, version, signatureVersion1, signatureVersion2, signatureVersion4, signatureVersion4a)
+}
+
+// signsURLsWithSigV2 reports whether the signed URLs of version are signed
+// with SigV2.
+func signsURLsWithSigV2(version string) bool {
+	return version == signatureVersion1 || version == signatureVersion2
+}
+
+// signatureVersionOptions returns the S3 client options that sign requests
+// with the given signature version. bucket is the bucket the client is used
+// for, which SigV2 needs to sign virtual-hosted-style requests.
+func signatureVersionOptions(version, bucket string) []func(*s3.Options) {
+	switch version {
+	case signatureVersion2:
+		return []func(*s3.Options){
+			func(o *s3.Options) {
+				signer := &sigV2Signer{credentials: o.Credentials, bucket: bucket}
+				o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+					// Presign stacks have no signing middleware; they are
+					// signed by the presigner set in presignOptions instead.
+					if _, ok := stack.Finalize.Get(signingMiddlewareID); !ok {
+						return nil
+					}
+					_, err := stack.Finalize.Swap(signingMiddlewareID, signer)
+					return err
+				})
+			},
+		}
+	case signatureVersion4a:
+		return []func(*s3.Options){
+			func(o *s3.Options) {
+				o.AuthSchemeResolver = sigV4AAuthSchemeResolver{}
+			},
+		}
+	}
+	return nil
+}
+
+// presignOptions returns the presign client options for the given signature
+// version.
+func presignOptions(version, bucket string) []func(*s3.PresignOptions) {
+	if !signsURLsWithSigV2(version) {
+		return nil
+	}
+	return []func(*s3.PresignOptions){
+		func(o *s3.PresignOptions) {
+			o.Presigner = &sigV2Signer{bucket: bucket}
+		},
+	}
+}
+
+// sigV4AAuthSchemeResolver signs every S3 request with SigV4a for all
+// regions, as required by multi-region access points.
+type sigV4AAuthSchemeResolver struct{}
+
+func (sigV4AAuthSchemeResolver) ResolveAuthSchemes(context.Context, *s3.AuthResolverParameters) ([]*smithyauth.Option, error) {
+	var props smithy.Properties
+	smithyhttp.SetSigV4ASigningName(&props, "s3")
+	smithyhttp.SetSigV4ASigningRegions(&props, []string{"*"})
+	return []*smithyauth.Option{{SchemeID: smithyauth.SchemeIDSigV4A, SignerProperties: props}}, nil
+}
+
+// sigV2Signer signs requests with the legacy S3 signature version 2, which
+// is the only scheme some older S3-compatible appliances support. It is
+// used both as a finalize middleware for requests and as the presigner for
+// signed URLs.
+//
+// See https://docs.aws.amazon.com/AmazonS3/latest/userguide/RESTAuthentication.html
+type sigV2Signer struct {
+	credentials aws.CredentialsProvider
+	bucket      string
+}
+
+func (*sigV2Signer) ID() string {
+	return signingMiddlewareID
+}
+
+func (s *sigV2Signer) HandleFinalize(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (
+	out middleware.FinalizeOutput, metadata middleware.Metadata, err error,
+) {
+	req, ok := in.Request.(*smithyhttp.Request)
+	if !ok {
+		return out, metadata, errors.Errorf("unexpected request type %T", in.Request)
+	}
+	if s.credentials == nil {
+		return next.HandleFinalize(ctx, in)
+	}
+	creds, err := s.credentials.Retrieve(ctx)
+	if err != nil {
+		return out, metadata, errors.Wrap(err, "failed to retrieve credentials")
+	}
+	if creds.AccessKeyID == "" {
+		// anonymous credentials
+		return next.HandleFinalize(ctx, in)
+	}
+
+	req.Header.Del("X-Amz-Date")
+	req.Header.Del("Authorization")
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		req.Header.Get("Date"),
+	}, "\n") + "\n" + sigV2AmzHeaders(req.Header) + s.canonicalResource(req.URL.Host, req.URL.EscapedPath(), req.URL.Query())
+	req.Header.Set("Authorization", "AWS "+creds.AccessKeyID+":"+sigV2Sign(creds.SecretAccessKey, stringToSign))
+
+	return next.HandleFinalize(ctx, in)
+}
+
+// PresignHTTP implements v4.HTTPPresigner so the presign client creates
+// SigV2 query-string authenticated URLs.
+func (s *sigV2Signer) PresignHTTP(
+	ctx context.Context, creds aws.Credentials, r *http.Request,
+	payloadHash string, service string, region string, signingTime time.Time,
+	optFns ...func(*v4.SignerOptions),
+) (string, http.Header, error) {
+	query := r.URL.Query()
+	expiresIn, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "invalid presign expiry")
+	}
+	query.Del("X-Amz-Expires")
+	expires := strconv.FormatInt(signingTime.Unix()+expiresIn, 10)
+
+	if creds.SessionToken != "" {
+		query.Set("x-amz-security-token", creds.SessionToken)
+	}
+
+	signedHeaders := http.Header{}
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			signedHeaders[name] = values
+		}
+	}
+	amzHeaders := signedHeaders.Clone()
+	if creds.SessionToken != "" {
+		amzHeaders.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	stringToSign := strings.Join([]string{r.Method, "", "", expires}, "\n") + "\n" +
+		sigV2AmzHeaders(amzHeaders) + s.canonicalResource(r.URL.Host, r.URL.EscapedPath(), query)
+
+	query.Set("AWSAccessKeyId", creds.AccessKeyID)
+	query.Set("Expires", expires)
+	query.Set("Signature", sigV2Sign(creds.SecretAccessKey, stringToSign))
+
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	signedHeaders.Set("Host", r.Host)
+	return u.String(), signedHeaders, nil
+}
+
+// canonicalResource returns the CanonicalizedResource element of the SigV2
+// string to sign.
+func (s *sigV2Signer) canonicalResource(host, path string, query map[string][]string) string {
+	if path == "" {
+		path = "/"
+	}
+	// virtual-hosted-style requests sign the bucket as if it was in the path
+	if s.bucket != "" && strings.HasPrefix(host, s.bucket+".") {
+		path = "/" + s.bucket + path
+	}
+
+	var subResources []string
+	for name, values := range query {
+		if !sigV2SubResources[name] {
+			continue
+		}
+		if len(values) == 0 || values[0] == "" {
+			subResources = append(subResources, name)
+		} else {
+			subResources = append(subResources, name+"="+values[0])
+		}
+	}
+	if len(subResources) == 0 {
+		return path
+	}
+	sort.Strings(subResources)
+	return path + "?" + strings.Join(subResources, "&")
+}
+
+// sigV2AmzHeaders returns the CanonicalizedAmzHeaders element of the SigV2
+// string to sign.
+func sigV2AmzHeaders(header http.Header) string {
+	var names []string
+	values := map[string]string{}
+	for name, vals := range header {
+		lower := strings.ToLower(name)
+		if !strings.HasPrefix(lower, "x-amz-") {
+			continue
+		}
+		trimmed := make([]string, len(vals))
+		for i, v := range vals {
+			trimmed[i] = strings.TrimSpace(v)
+		}
+		if _, ok := values[lower]; !ok {
+			names = append(names, lower)
+			values[lower] = strings.Join(trimmed, ",")
+		} else {
+			values[lower] += "," + strings.Join(trimmed, ",")
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + values[name] + "\n")
+	}
+	return b.String()
+}
+
+func sigV2Sign(secretAccessKey, stringToSign string) string {
+	mac := hmac.New(sha1.New, []byte(secretAccessKey))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,178 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSignatureVersion(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    string
+		expectedErr bool
+	}{
+		{value: "", expected: signatureVersion4},
+		{value: "4", expected: signatureVersion4},
+		{value: "2", expected: signatureVersion2},
+		{value: "1", expected: signatureVersion1},
+		{value: "4a", expected: signatureVersion4a},
+		{value: "3", expectedErr: true},
+		{value: "v4", expectedErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			version, err := parseSignatureVersion(test.value)
+			if test.expectedErr {
+				assert.ErrorContains(t, err, "invalid signatureVersion")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, version)
+		})
+	}
+}
+
+func TestSigV2StringToSign(t *testing.T) {
+	signer := &sigV2Signer{bucket: "johnsmith"}
+
+	// example from the S3 REST authentication documentation
+	resource := signer.canonicalResource("johnsmith.s3.amazonaws.com", "/photos/puppy.jpg", nil)
+	assert.Equal(t, "/johnsmith/photos/puppy.jpg", resource)
+	assert.Equal(t, "bWq2s1WEIj+Ydj0vQ697zp+IXMU=", sigV2Sign("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY",
+		"GET\n\n\nTue, 27 Mar 2007 19:36:42 +0000\n"+resource))
+
+	// path-style requests already contain the bucket, and only
+	// sub-resources are part of the signed query string
+	resource = signer.canonicalResource("s3.example.com", "/johnsmith/key", url.Values{
+		"uploadId":   {"abc"},
+		"partNumber": {"2"},
+		"x-id":       {"UploadPart"},
+		"tagging":    {""},
+	})
+	assert.Equal(t, "/johnsmith/key?partNumber=2&tagging&uploadId=abc", resource)
+
+	assert.Equal(t, "x-amz-meta-a:1,2\nx-amz-security-token:token\n", sigV2AmzHeaders(http.Header{
+		"X-Amz-Security-Token": {"token"},
+		"X-Amz-Meta-A":         {" 1", "2 "},
+		"Content-Type":         {"text/plain"},
+	}))
+}
+
+func newSignatureVersionTestClient(t *testing.T, version string, do func(*http.Request) (*http.Response, error)) *s3.Client {
+	t.Helper()
+	cfg := aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		HTTPClient:  smithyhttp.ClientDoFunc(do),
+	}
+	client, err := newS3Client(cfg, "", false, signatureVersionOptions(version, "bucket")...)
+	require.NoError(t, err)
+	return client
+}
+
+func TestSigV2Signing(t *testing.T) {
+	var sent *http.Request
+	client := newSignatureVersionTestClient(t, signatureVersion2, func(req *http.Request) (*http.Response, error) {
+		sent = req
+		return newTestResponse(req, http.StatusOK, ""), nil
+	})
+
+	_, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+	require.NoError(t, err)
+
+	require.NotNil(t, sent)
+	assert.True(t, strings.HasPrefix(sent.Header.Get("Authorization"), "AWS AKID:"), sent.Header.Get("Authorization"))
+	assert.NotEmpty(t, sent.Header.Get("Date"))
+
+	stringToSign := "HEAD\n\n\n" + sent.Header.Get("Date") + "\n" + sigV2AmzHeaders(sent.Header) + "/bucket/key"
+	assert.Equal(t, "AWS AKID:"+sigV2Sign("SECRET", stringToSign), sent.Header.Get("Authorization"))
+}
+
+func TestSigV2Presign(t *testing.T) {
+	client := newSignatureVersionTestClient(t, signatureVersion2, nil)
+	presigner := s3.NewPresignClient(client, presignOptions(signatureVersion2, "bucket")...)
+
+	req, err := presigner.PresignGetObject(context.Background(), &s3.GetObjectInput{
+		Bucket:               aws.String("bucket"),
+		Key:                  aws.String("key"),
+		SSECustomerAlgorithm: aws.String("AES256"),
+	}, s3.WithPresignExpires(10*time.Minute))
+	require.NoError(t, err)
+
+	u, err := url.Parse(req.URL)
+	require.NoError(t, err)
+	query := u.Query()
+	assert.Equal(t, "AKID", query.Get("AWSAccessKeyId"))
+	assert.NotEmpty(t, query.Get("Expires"))
+	assert.NotEmpty(t, query.Get("Signature"))
+	assert.Empty(t, query.Get("X-Amz-Expires"))
+	assert.Empty(t, query.Get("X-Amz-Signature"))
+	assert.Equal(t, []string{"AES256"}, req.SignedHeader.Values("X-Amz-Server-Side-Encryption-Customer-Algorithm"))
+
+	stringToSign := "GET\n\n\n" + query.Get("Expires") + "\nx-amz-server-side-encryption-customer-algorithm:AES256\n/bucket/key"
+	assert.Equal(t, sigV2Sign("SECRET", stringToSign), query.Get("Signature"))
+}
+
+func TestSignatureVersion1OnlySignsURLsWithSigV2(t *testing.T) {
+	var sent *http.Request
+	client := newSignatureVersionTestClient(t, signatureVersion1, func(req *http.Request) (*http.Response, error) {
+		sent = req
+		return newTestResponse(req, http.StatusOK, ""), nil
+	})
+
+	_, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+	require.NoError(t, err)
+	require.NotNil(t, sent)
+	assert.True(t, strings.HasPrefix(sent.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "), sent.Header.Get("Authorization"))
+
+	presigner := s3.NewPresignClient(client, presignOptions(signatureVersion1, "bucket")...)
+	req, err := presigner.PresignGetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+	require.NoError(t, err)
+	u, err := url.Parse(req.URL)
+	require.NoError(t, err)
+	assert.NotEmpty(t, u.Query().Get("Signature"))
+	assert.Empty(t, u.Query().Get("X-Amz-Signature"))
+}
+
+func TestSigV4ASigning(t *testing.T) {
+	var sent *http.Request
+	client := newSignatureVersionTestClient(t, signatureVersion4a, func(req *http.Request) (*http.Response, error) {
+		sent = req
+		return newTestResponse(req, http.StatusOK, ""), nil
+	})
+
+	_, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+	require.NoError(t, err)
+
+	require.NotNil(t, sent)
+	assert.True(t, strings.HasPrefix(sent.Header.Get("Authorization"), "AWS4-ECDSA-P256-SHA256 "), sent.Header.Get("Authorization"))
+	assert.Equal(t, "*", sent.Header.Get("X-Amz-Region-Set"))
+}
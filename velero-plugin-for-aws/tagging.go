@@ -0,0 +1,372 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	taggingByPrefixKey = "taggingByPrefix"
+
+	// retagCommand is the first argument that sets the configured tags on
+	// the existing objects of a location instead of running the plugin
+	// server.
+	retagCommand = "retag"
+
+	// The limits S3 puts on the tags of an object.
+	maxTags           = 10
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+
+	// backupPlaceholder and kindPlaceholder are replaced in tag values by
+	// the name of the backup an object belongs to and by the top-level
+	// directory of the location it is in, e.g. "backups" or "kopia".
+	backupPlaceholder = "{backup}"
+	kindPlaceholder   = "{kind}"
+)
+
+var (
+	tagPlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+	// placeholderRemover leaves the part of a tag value that does not
+	// depend on the object.
+	placeholderRemover = strings.NewReplacer(backupPlaceholder, "", kindPlaceholder, "")
+)
+
+type objectTag struct {
+	key   string
+	value string
+}
+
+// objectTags is a tag set, in the order it was configured.
+type objectTags []objectTag
+
+// parseTags parses tags given in the URL query form of the x-amz-tagging
+// header, e.g. "team=backup&cost%20center=42".
+func parseTags(val string) (objectTags, error) {
+	if val == "" {
+		return nil, nil
+	}
+	pairs := strings.Split(val, "&")
+	if len(pairs) > maxTags {
+		return nil, errors.Errorf("S3 allows at most %d tags per object, got %d", maxTags, len(pairs))
+	}
+	tags := make(objectTags, 0, len(pairs))
+	for _, pair := range pairs {
+		rawKey, rawValue, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, errors.Errorf("invalid tag %q, expected key=value", pair)
+		}
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid tag key %q", rawKey)
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value of tag %q", key)
+		}
+
+		switch {
+		case key == "":
+			return nil, errors.Errorf("invalid tag %q, the key is empty", pair)
+		case utf8.RuneCountInString(key) > maxTagKeyLength:
+			return nil, errors.Errorf("tag key %q is longer than %d characters", key, maxTagKeyLength)
+		// placeholders are checked again once they are replaced
+		case utf8.RuneCountInString(placeholderRemover.Replace(value)) > maxTagValueLength:
+			return nil, errors.Errorf("value of tag %q is longer than %d characters", key, maxTagValueLength)
+		case tags.index(key) >= 0:
+			return nil, errors.Errorf("tag %q is set more than once", key)
+		}
+		for _, placeholder := range tagPlaceholder.FindAllString(value, -1) {
+			if placeholder != backupPlaceholder && placeholder != kindPlaceholder {
+				return nil, errors.Errorf("unknown placeholder %s in the value of tag %q", placeholder, key)
+			}
+		}
+		tags = append(tags, objectTag{key: key, value: value})
+	}
+	return tags, nil
+}
+
+func (t objectTags) index(key string) int {
+	for i, tag := range t {
+		if tag.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// with returns t with the tags of other added, replacing the values of the
+// tags t already has.
+func (t objectTags) with(other objectTags) objectTags {
+	tags := append(objectTags(nil), t...)
+	for _, tag := range other {
+		if i := tags.index(tag.key); i >= 0 {
+			tags[i].value = tag.value
+		} else {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// encode returns t in the URL query form of the x-amz-tagging header.
+func (t objectTags) encode() string {
+	pairs := make([]string, len(t))
+	for i, tag := range t {
+		pairs[i] = escapeTag(tag.key) + "=" + escapeTag(tag.value)
+	}
+	return strings.Join(pairs, "&")
+}
+
+// escapeTag escapes s for the x-amz-tagging header. Spaces are escaped as
+// "%20" rather than "+", which S3 would keep as is.
+func escapeTag(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func (t objectTags) tagSet() []types.Tag {
+	tagSet := make([]types.Tag, len(t))
+	for i, tag := range t {
+		tagSet[i] = types.Tag{Key: aws.String(tag.key), Value: aws.String(tag.value)}
+	}
+	return tagSet
+}
+
+// prefixTags are the tags of the objects under a prefix of the location,
+// including the tags set for every object.
+type prefixTags struct {
+	prefix string
+	tags   objectTags
+}
+
+// objectTagging are the tags set on objects when they are written. A nil
+// *objectTagging sets no tags.
+type objectTagging struct {
+	// root is the prefix of the location, which the prefixes and the
+	// placeholders are relative to.
+	root     string
+	tags     objectTags
+	prefixes []prefixTags
+}
+
+// newObjectTagging returns the tagging configured by tagging and
+// taggingByPrefix, or nil if neither is set. taggingByPrefix adds tags to
+// the objects under prefixes of the location, given as entries separated
+// by ";", e.g. "backups/:retention=long;kopia/:retention=short". The tags
+// of the longest matching prefix are used.
+func newObjectTagging(config map[string]string) (*objectTagging, error) {
+	tags, err := parseTags(config[taggingKey])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", taggingKey)
+	}
+	tagging := &objectTagging{root: locationRoot(config[prefixKey]), tags: tags}
+
+	if val := config[taggingByPrefixKey]; val != "" {
+		for _, entry := range strings.Split(val, ";") {
+			prefix, val, ok := strings.Cut(strings.TrimSpace(entry), ":")
+			if !ok || prefix == "" {
+				return nil, errors.Errorf("invalid %s entry %q, expected prefix:tags", taggingByPrefixKey, entry)
+			}
+			prefixTagSet, err := parseTags(val)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid %s of prefix %s", taggingByPrefixKey, prefix)
+			}
+			for _, other := range tagging.prefixes {
+				if other.prefix == prefix {
+					return nil, errors.Errorf("%s sets prefix %s more than once", taggingByPrefixKey, prefix)
+				}
+			}
+			merged := tags.with(prefixTagSet)
+			if len(merged) > maxTags {
+				return nil, errors.Errorf("S3 allows at most %d tags per object, %s and %s set %d for prefix %s", maxTags, taggingKey, taggingByPrefixKey, len(merged), prefix)
+			}
+			tagging.prefixes = append(tagging.prefixes, prefixTags{prefix: prefix, tags: merged})
+		}
+		sort.SliceStable(tagging.prefixes, func(i, j int) bool {
+			return len(tagging.prefixes[i].prefix) > len(tagging.prefixes[j].prefix)
+		})
+	}
+
+	if len(tagging.tags) == 0 && len(tagging.prefixes) == 0 {
+		return nil, nil
+	}
+	return tagging, nil
+}
+
+// locationRoot returns the prefix of a location as the prefix of its keys,
+// e.g. "velero/" for "velero", or "" if the location has no prefix.
+func locationRoot(prefix string) string {
+	root := strings.Trim(prefix, "/")
+	if root != "" {
+		root += "/"
+	}
+	return root
+}
+
+// forKey returns the tags of key, with the placeholders in their values
+// replaced.
+func (t *objectTagging) forKey(key string) (objectTags, error) {
+	if t == nil {
+		return nil, nil
+	}
+	relative, ok := strings.CutPrefix(key, t.root)
+	if !ok {
+		// e.g. a trash outside the location
+		relative = ""
+	}
+
+	tags := t.tags
+	for _, p := range t.prefixes {
+		if ok && strings.HasPrefix(relative, p.prefix) {
+			tags = p.tags
+			break
+		}
+	}
+
+	var kind, backup string
+	parts := strings.SplitN(relative, "/", 3)
+	if len(parts) > 1 {
+		kind = parts[0]
+	}
+	if kind == "backups" && len(parts) == 3 {
+		backup = parts[1]
+	}
+	replacer := strings.NewReplacer(backupPlaceholder, backup, kindPlaceholder, kind)
+
+	rendered := make(objectTags, len(tags))
+	for i, tag := range tags {
+		value := replacer.Replace(tag.value)
+		if utf8.RuneCountInString(value) > maxTagValueLength {
+			return nil, errors.Errorf("value of tag %q of object %s is longer than %d characters", tag.key, key, maxTagValueLength)
+		}
+		rendered[i] = objectTag{key: tag.key, value: value}
+	}
+	return rendered, nil
+}
+
+// header returns the x-amz-tagging header of key, or "" if it has no tags.
+func (t *objectTagging) header(key string) (string, error) {
+	tags, err := t.forKey(key)
+	return tags.encode(), err
+}
+
+// optionalString returns nil for "", so that empty headers are not sent.
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+// retag replaces the tags of the objects under prefix with the configured
+// ones, e.g. after tagging was changed. Objects hidden from Velero keep
+// their tags. It returns the number of objects that were, or with dryRun
+// would be, retagged.
+func (o *ObjectStore) retag(ctx context.Context, bucket, prefix string, dryRun bool) (int, error) {
+	if o.tagging == nil {
+		return 0, errors.Errorf("neither %s nor %s is set", taggingKey, taggingByPrefixKey)
+	}
+
+	retagged := 0
+	err := o.eachObject(ctx, bucket, prefix, func(obj objectInfo) error {
+		if o.hidden(obj.Key) {
+			return nil
+		}
+		log := o.log.WithFields(logrus.Fields{"bucket": bucket, "key": obj.Key})
+		tags, err := o.tagging.forKey(obj.Key)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			log.WithField("tags", tags.encode()).Info("Would retag object")
+			retagged++
+			return nil
+		}
+
+		_, err = o.s3.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+			Bucket:              aws.String(bucket),
+			Key:                 aws.String(obj.Key),
+			Tagging:             &types.Tagging{TagSet: tags.tagSet()},
+			RequestPayer:        o.requestPayer,
+			ExpectedBucketOwner: o.expectedBucketOwner,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error setting tags of object %s", obj.Key)
+		}
+		log.WithField("tags", tags.encode()).Info("Retagged object")
+		retagged++
+		return nil
+	})
+	return retagged, err
+}
+
+// runRetag sets the configured tags on the existing objects of a location
+// and returns the process exit code.
+func runRetag(args []string, stdout, stderr io.Writer) int {
+	flags := pflag.NewFlagSet(retagCommand, pflag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		bslFile         = flags.String("backup-location", "", `path to a BackupStorageLocation YAML file, or "-" for stdin`)
+		credentialsFile = flags.String("credentials-file", "", "path to an AWS credentials file, as referenced by the location's credential")
+		prefix          = flags.String("prefix", "", `only retag the objects under this prefix of the location, e.g. "backups/"`)
+		dryRun          = flags.Bool("dry-run", false, "count the objects that would be retagged without changing them")
+		logLevel        = flags.String("log-level", "warning", "level of the plugin logs written to stderr")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: velero-plugin-for-aws %s [flags]\n\nReplaces the tags of the objects of a location with the ones set by %s and %s.\n\n", retagCommand, taggingKey, taggingByPrefixKey)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *bslFile == "" {
+		fmt.Fprintln(stderr, "--backup-location is required")
+		return 2
+	}
+
+	o, config, err := initBackupStorageLocation(*bslFile, *credentialsFile, *logLevel, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	count, err := o.retag(context.Background(), config[bucketKey], locationRoot(config[prefixKey])+*prefix, *dryRun)
+	if *dryRun {
+		fmt.Fprintf(stdout, "Would retag %d objects\n", count)
+	} else {
+		fmt.Fprintf(stdout, "Retagged %d objects\n", count)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,248 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		name        string
+		tagging     string
+		expected    objectTags
+		expectedErr string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:     "one tag",
+			tagging:  "team=backup",
+			expected: objectTags{{key: "team", value: "backup"}},
+		},
+		{
+			name:     "URL-encoded, in order",
+			tagging:  "zone=a&cost%20center=r%26d&empty=",
+			expected: objectTags{{key: "zone", value: "a"}, {key: "cost center", value: "r&d"}, {key: "empty"}},
+		},
+		{
+			name:     "placeholders",
+			tagging:  "backup={backup}&kind=velero-{kind}",
+			expected: objectTags{{key: "backup", value: "{backup}"}, {key: "kind", value: "velero-{kind}"}},
+		},
+		{
+			name:        "too many tags",
+			tagging:     "a=1&b=2&c=3&d=4&e=5&f=6&g=7&h=8&i=9&j=10&k=11",
+			expectedErr: "S3 allows at most 10 tags per object, got 11",
+		},
+		{
+			name:        "no value",
+			tagging:     "team=backup&owner",
+			expectedErr: `invalid tag "owner", expected key=value`,
+		},
+		{
+			name:        "empty key",
+			tagging:     "=backup",
+			expectedErr: `invalid tag "=backup", the key is empty`,
+		},
+		{
+			name:        "key set twice",
+			tagging:     "team=a&team=b",
+			expectedErr: `tag "team" is set more than once`,
+		},
+		{
+			name:        "value too long",
+			tagging:     "team=" + strings.Repeat("é", 257),
+			expectedErr: `value of tag "team" is longer than 256 characters`,
+		},
+		{
+			name:     "placeholders do not count towards the value length",
+			tagging:  "backup=" + strings.Repeat("x", 256) + "{backup}",
+			expected: objectTags{{key: "backup", value: strings.Repeat("x", 256) + "{backup}"}},
+		},
+		{
+			name:        "invalid escape",
+			tagging:     "team=%zz",
+			expectedErr: `invalid value of tag "team": invalid URL escape "%zz"`,
+		},
+		{
+			name:        "unknown placeholder",
+			tagging:     "restore={restore}",
+			expectedErr: `unknown placeholder {restore} in the value of tag "restore"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tags, err := parseTags(test.tagging)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, tags)
+		})
+	}
+}
+
+func TestObjectTaggingForKey(t *testing.T) {
+	tagging, err := newObjectTagging(map[string]string{
+		prefixKey:          "/velero/",
+		taggingKey:         "team=backup&velero.io/backup={backup}&kind={kind}",
+		taggingByPrefixKey: "backups/:retention=long; kopia/:retention=short&team=storage;backups/daily-:retention=short",
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{key: "velero/backups/b1/b1.tar.gz", expected: "team=backup&velero.io%2Fbackup=b1&kind=backups&retention=long"},
+		{key: "velero/backups/daily-1/daily-1.tar.gz", expected: "team=backup&velero.io%2Fbackup=daily-1&kind=backups&retention=short"},
+		{key: "velero/kopia/default/p1", expected: "team=storage&velero.io%2Fbackup=&kind=kopia&retention=short"},
+		{key: "velero/restores/r1/restore-r1-logs.gz", expected: "team=backup&velero.io%2Fbackup=&kind=restores"},
+		{key: "velero/backups", expected: "team=backup&velero.io%2Fbackup=&kind="},
+		{key: "trash/velero/backups/b1/b1.tar.gz", expected: "team=backup&velero.io%2Fbackup=&kind="},
+	}
+	for _, test := range tests {
+		header, err := tagging.header(test.key)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, header, test.key)
+	}
+
+	var none *objectTagging
+	header, err := none.header("velero/backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+	assert.Empty(t, header)
+}
+
+func TestObjectTaggingRenderedValueLength(t *testing.T) {
+	// the placeholder leaves room for backup names up to 6 characters
+	tagging, err := newObjectTagging(map[string]string{taggingKey: "backup=" + strings.Repeat("x", 250) + "{backup}"})
+	require.NoError(t, err)
+
+	header, err := tagging.header("backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+	assert.Equal(t, "backup="+strings.Repeat("x", 250)+"b1", header)
+
+	_, err = tagging.header("backups/backup-1/backup-1.tar.gz")
+	assert.EqualError(t, err, `value of tag "backup" of object backups/backup-1/backup-1.tar.gz is longer than 256 characters`)
+
+	o := &ObjectStore{log: newLogger(), tagging: tagging}
+	err = o.PutObject("bucket", "backups/backup-1/backup-1.tar.gz", strings.NewReader("data"))
+	assert.EqualError(t, err, `value of tag "backup" of object backups/backup-1/backup-1.tar.gz is longer than 256 characters`)
+}
+
+func TestNewObjectTagging(t *testing.T) {
+	tagging, err := newObjectTagging(map[string]string{prefixKey: "velero"})
+	require.NoError(t, err)
+	assert.Nil(t, tagging)
+
+	tests := []struct {
+		name        string
+		config      map[string]string
+		expectedErr string
+	}{
+		{
+			name:        "invalid tagging",
+			config:      map[string]string{taggingKey: "team"},
+			expectedErr: `invalid tagging: invalid tag "team", expected key=value`,
+		},
+		{
+			name:        "no prefix",
+			config:      map[string]string{taggingByPrefixKey: "retention=long"},
+			expectedErr: `invalid taggingByPrefix entry "retention=long", expected prefix:tags`,
+		},
+		{
+			name:        "invalid prefix tags",
+			config:      map[string]string{taggingByPrefixKey: "backups/:retention"},
+			expectedErr: `invalid taggingByPrefix of prefix backups/: invalid tag "retention", expected key=value`,
+		},
+		{
+			name:        "prefix set twice",
+			config:      map[string]string{taggingByPrefixKey: "backups/:a=1;backups/:b=2"},
+			expectedErr: "taggingByPrefix sets prefix backups/ more than once",
+		},
+		{
+			name:        "too many tags with the prefix",
+			config:      map[string]string{taggingKey: "a=1&b=2&c=3&d=4&e=5&f=6&g=7&h=8&i=9", taggingByPrefixKey: "backups/:a=0&j=10&k=11"},
+			expectedErr: "S3 allows at most 10 tags per object, tagging and taggingByPrefix set 11 for prefix backups/",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newObjectTagging(test.config)
+			assert.EqualError(t, err, test.expectedErr)
+		})
+	}
+}
+
+func TestPutObjectTagging(t *testing.T) {
+	var taggings []string
+	client := newTestS3Client(t, func(req *http.Request) (*http.Response, error) {
+		taggings = append(taggings, req.Header.Get("X-Amz-Tagging"))
+		return newTestResponse(req, http.StatusOK, ""), nil
+	})
+	o := &ObjectStore{log: newLogger(), s3: client, s3Uploader: manager.NewUploader(client)}
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", strings.NewReader("data")))
+	o.tagging = &objectTagging{tags: objectTags{{key: "backup", value: backupPlaceholder}}}
+	require.NoError(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", strings.NewReader("data")))
+	assert.Equal(t, []string{"", "backup=b1"}, taggings)
+}
+
+func TestRetag(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	tagging, err := newObjectTagging(map[string]string{prefixKey: "velero", taggingKey: "velero.io/backup={backup}"})
+	require.NoError(t, err)
+	o := &ObjectStore{log: newLogger(), s3: s, tagging: tagging, trash: &trashSettings{prefix: "velero/.trash/"}}
+
+	listPages(s, "velero/",
+		[]types.Object{{Key: aws.String("velero/.trash/velero/backups/b0/b0.tar.gz")}, {Key: aws.String("velero/backups/b1/b1.tar.gz")}},
+		[]types.Object{{Key: aws.String("velero/backups/b2/b2.tar.gz")}},
+	)
+	for _, backup := range []string{"b1", "b2"} {
+		key := "velero/backups/" + backup + "/" + backup + ".tar.gz"
+		s.On("PutObjectTagging", mock.Anything, mock.MatchedBy(func(input *s3.PutObjectTaggingInput) bool {
+			return aws.ToString(input.Key) == key
+		})).Return(&s3.PutObjectTaggingOutput{}, nil).Once().Run(func(args mock.Arguments) {
+			input := args.Get(1).(*s3.PutObjectTaggingInput)
+			assert.Equal(t, []types.Tag{{Key: aws.String("velero.io/backup"), Value: aws.String(backup)}}, input.Tagging.TagSet)
+		})
+	}
+
+	retagged, err := o.retag(context.Background(), "bucket", "velero/", false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, retagged)
+
+	o.tagging = nil
+	_, err = o.retag(context.Background(), "bucket", "velero/", true)
+	assert.EqualError(t, err, "neither tagging nor taggingByPrefix is set")
+}
@@ -0,0 +1,217 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// tracingEndpointEnvVar enables tracing when set to the host:port of an
+	// OTLP gRPC collector, such as "localhost:4317".
+	tracingEndpointEnvVar = "VELERO_AWS_TRACING_ENDPOINT"
+	tracerName            = "github.com/vmware-tanzu/velero-plugin-for-aws"
+
+	// tracingShutdownTimeout bounds how long pending spans are flushed for
+	// before the plugin exits.
+	tracingShutdownTimeout = 5 * time.Second
+)
+
+// tracer is nil unless tracing has been enabled with initTracing.
+var tracer trace.Tracer
+
+// initTracing configures spans to be exported to the OTLP collector at
+// endpoint. The returned function flushes pending spans and must be called
+// before the process exits.
+func initTracing(endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracegrpc.New(context.Background(),
+		otlptracegrpc.WithEndpoint(endpoint),
+		otlptracegrpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating OTLP exporter for %s", endpoint)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("velero-plugin-for-aws"))),
+	)
+	tracer = provider.Tracer(tracerName)
+	return provider.Shutdown, nil
+}
+
+// shutdownTracingOnSignal flushes pending spans and exits once a signal is
+// received from signals. Velero usually stops plugins by signalling or
+// killing them rather than by letting the plugin server return, so flushing
+// spans after it returns is not enough.
+func shutdownTracingOnSignal(shutdown func(context.Context) error, signals <-chan os.Signal, exit func(int), log logrus.FieldLogger) {
+	sig := <-signals
+	flushTracing(shutdown, log)
+	code := 1
+	if s, ok := sig.(syscall.Signal); ok {
+		code = 128 + int(s)
+	}
+	exit(code)
+}
+
+// flushTracing flushes pending spans and stops exporting them.
+func flushTracing(shutdown func(context.Context) error, log logrus.FieldLogger) {
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		log.WithError(err).Warn("Error flushing spans")
+	}
+}
+
+// startSpan starts a span for a plugin method. When tracing is disabled it
+// returns ctx unchanged along with a no-op span.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if tracer == nil {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingAPIOptions returns the middleware that creates a span for every
+// SDK operation and every attempt of it, or nil when tracing is disabled.
+func tracingAPIOptions(region string) []func(*middleware.Stack) error {
+	if tracer == nil {
+		return nil
+	}
+	return []func(*middleware.Stack) error{
+		func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(&operationTracing{region: region}, middleware.After)
+		},
+		func(stack *middleware.Stack) error {
+			return stack.Finalize.Insert(attemptTracing{}, "Retry", middleware.After)
+		},
+	}
+}
+
+// operationTracing wraps an SDK operation, including all of its retries, in
+// a client span.
+type operationTracing struct {
+	region string
+}
+
+func (*operationTracing) ID() string {
+	return "VeleroOperationTracing"
+}
+
+func (t *operationTracing) HandleInitialize(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (
+	out middleware.InitializeOutput, metadata middleware.Metadata, err error,
+) {
+	service := awsmiddleware.GetServiceID(ctx)
+	operation := awsmiddleware.GetOperationName(ctx)
+	ctx, span := tracer.Start(ctx, service+"."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.RPCSystemKey.String("aws-api"),
+			semconv.RPCService(service),
+			semconv.RPCMethod(operation),
+			semconv.CloudRegion(t.region),
+		),
+	)
+	defer func() { endSpan(span, err) }()
+
+	out, metadata, err = next.HandleInitialize(ctx, in)
+	if requestID, ok := awsmiddleware.GetRequestIDMetadata(metadata); ok {
+		span.SetAttributes(semconv.AWSRequestID(requestID))
+	}
+	return out, metadata, err
+}
+
+// attemptTracing creates a span for each attempt of an SDK operation, so
+// time spent in retries and backoff is visible.
+type attemptTracing struct{}
+
+func (attemptTracing) ID() string {
+	return "VeleroAttemptTracing"
+}
+
+func (attemptTracing) HandleFinalize(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (
+	out middleware.FinalizeOutput, metadata middleware.Metadata, err error,
+) {
+	ctx, span := tracer.Start(ctx, "Attempt", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+
+	if req, ok := in.Request.(*smithyhttp.Request); ok {
+		span.SetAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			attribute.String("server.address", req.URL.Host),
+		)
+	}
+
+	out, metadata, err = next.HandleFinalize(ctx, in)
+
+	if resp, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	}
+	if requestID, ok := awsmiddleware.GetRequestIDMetadata(metadata); ok {
+		span.SetAttributes(semconv.AWSRequestID(requestID))
+	}
+	if hostID, ok := s3.GetHostIDMetadata(metadata); ok {
+		span.SetAttributes(attribute.String("aws.extended_request_id", hostID))
+	}
+	return out, metadata, err
+}
+
+func bucketAttr(bucket string) attribute.KeyValue {
+	return semconv.AWSS3Bucket(bucket)
+}
+
+func keyAttr(key string) attribute.KeyValue {
+	return semconv.AWSS3Key(key)
+}
+
+func prefixAttr(prefix string) attribute.KeyValue {
+	return attribute.String("aws.s3.prefix", prefix)
+}
+
+func snapshotIDAttr(snapshotID string) attribute.KeyValue {
+	return attribute.String("aws.ec2.snapshot_id", snapshotID)
+}
+
+func volumeIDAttr(volumeID string) attribute.KeyValue {
+	return attribute.String("aws.ec2.volume_id", volumeID)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracerName)
+	defer func() { tracer = nil }()
+
+	client := newTestS3Client(t, func(req *http.Request) (*http.Response, error) {
+		resp := newTestResponse(req, http.StatusOK, "")
+		resp.Header.Set("X-Amz-Request-Id", "req-123")
+		return resp, nil
+	}, tracingAPIOptions("us-east-1")...)
+
+	o := &ObjectStore{
+		log: newLogger(),
+		s3:  client,
+	}
+	_, err := o.ObjectExists("b", "k")
+	require.NoError(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+
+	attempt, operation, method := spans[0], spans[1], spans[2]
+	assert.Equal(t, "Attempt", attempt.Name())
+	assert.Equal(t, "S3.HeadObject", operation.Name())
+	assert.Equal(t, "ObjectStore.ObjectExists", method.Name())
+
+	assert.Equal(t, operation.SpanContext().SpanID(), attempt.Parent().SpanID())
+	assert.Equal(t, method.SpanContext().SpanID(), operation.Parent().SpanID())
+
+	assert.Contains(t, attempt.Attributes(), attribute.String("aws.request_id", "req-123"))
+	assert.Contains(t, attempt.Attributes(), attribute.Int("http.response.status_code", http.StatusOK))
+	assert.Contains(t, operation.Attributes(), attribute.String("aws.request_id", "req-123"))
+	assert.Contains(t, method.Attributes(), attribute.String("aws.s3.key", "k"))
+}
+
+func TestShutdownTracingOnSignal(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	flushed, exitCode := false, 0
+	signals <- syscall.SIGTERM
+	shutdownTracingOnSignal(func(ctx context.Context) error {
+		_, ok := ctx.Deadline()
+		assert.True(t, ok)
+		flushed = true
+		return nil
+	}, signals, func(code int) { exitCode = code }, newLogger())
+
+	assert.True(t, flushed)
+	assert.Equal(t, 128+int(syscall.SIGTERM), exitCode)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	httpProxyKey             = "httpProxy"
+	httpsProxyKey            = "httpsProxy"
+	noProxyKey               = "noProxy"
+	maxIdleConnsKey          = "maxIdleConns"
+	dialTimeoutKey           = "dialTimeout"
+	responseHeaderTimeoutKey = "responseHeaderTimeout"
+)
+
+// transportSettings configure the HTTP transport of a location's clients.
+// Zero values keep the defaults of the AWS SDK.
+type transportSettings struct {
+	// proxy is nil unless one of the proxy keys is set, in which case the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are
+	// ignored for the location.
+	proxy                 *httpproxy.Config
+	maxIdleConns          int
+	dialTimeout           time.Duration
+	responseHeaderTimeout time.Duration
+}
+
+func parseTransportSettings(config map[string]string) (transportSettings, error) {
+	var settings transportSettings
+
+	httpProxy, httpsProxy, noProxy := config[httpProxyKey], config[httpsProxyKey], config[noProxyKey]
+	for _, key := range []string{httpProxyKey, httpsProxyKey} {
+		if err := validateProxyURL(config[key]); err != nil {
+			return transportSettings{}, errors.Wrapf(err, "invalid %s", key)
+		}
+	}
+	if httpProxy != "" || httpsProxy != "" || noProxy != "" {
+		settings.proxy = &httpproxy.Config{HTTPProxy: httpProxy, HTTPSProxy: httpsProxy, NoProxy: noProxy}
+	}
+
+	if val := config[maxIdleConnsKey]; val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 {
+			return transportSettings{}, errors.Errorf("could not parse %s %q (expected a positive integer)", maxIdleConnsKey, val)
+		}
+		settings.maxIdleConns = n
+	}
+
+	var err error
+	if settings.dialTimeout, err = parsePositiveDuration(config, dialTimeoutKey); err != nil {
+		return transportSettings{}, err
+	}
+	if settings.responseHeaderTimeout, err = parsePositiveDuration(config, responseHeaderTimeoutKey); err != nil {
+		return transportSettings{}, err
+	}
+
+	return settings, nil
+}
+
+func parsePositiveDuration(config map[string]string, key string) (time.Duration, error) {
+	val := config[key]
+	if val == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("could not parse %s %q (expected a positive duration, e.g. \"30s\")", key, val)
+	}
+	return d, nil
+}
+
+// validateProxyURL checks a proxy the way httpproxy reads it: a URL, or a
+// host and port that is taken as an http:// URL.
+func validateProxyURL(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return errors.Errorf("unsupported proxy scheme %q, expected http, https or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.Errorf("proxy URL %q has no host", proxy)
+	}
+	return nil
+}
+
+func (s transportSettings) applyTransport(tr *http.Transport) {
+	if s.proxy != nil {
+		proxyFunc := s.proxy.ProxyFunc()
+		tr.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+	if s.maxIdleConns > 0 {
+		// the plugin talks to a single endpoint per client, so the per-host
+		// limit is the one that matters
+		tr.MaxIdleConns = s.maxIdleConns
+		tr.MaxIdleConnsPerHost = s.maxIdleConns
+	}
+	if s.responseHeaderTimeout > 0 {
+		tr.ResponseHeaderTimeout = s.responseHeaderTimeout
+	}
+}
+
+func (s transportSettings) applyDialer(d *net.Dialer) {
+	if s.dialTimeout > 0 {
+		d.Timeout = s.dialTimeout
+	}
+}
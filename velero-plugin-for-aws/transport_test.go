@@ -0,0 +1,156 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTransportSettings(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]string
+		expectedErr string
+	}{
+		{
+			name:   "empty",
+			config: map[string]string{},
+		},
+		{
+			name: "all set",
+			config: map[string]string{
+				httpProxyKey:             "proxy.corp:3128",
+				httpsProxyKey:            "https://proxy.corp:3129",
+				noProxyKey:               "minio.local,10.0.0.0/8",
+				maxIdleConnsKey:          "50",
+				dialTimeoutKey:           "5s",
+				responseHeaderTimeoutKey: "1m",
+			},
+		},
+		{
+			name:        "unsupported proxy scheme",
+			config:      map[string]string{httpsProxyKey: "ftp://proxy.corp"},
+			expectedErr: `invalid httpsProxy: unsupported proxy scheme "ftp", expected http, https or socks5`,
+		},
+		{
+			name:        "proxy without host",
+			config:      map[string]string{httpProxyKey: "http://"},
+			expectedErr: `invalid httpProxy: proxy URL "http://" has no host`,
+		},
+		{
+			name:        "invalid maxIdleConns",
+			config:      map[string]string{maxIdleConnsKey: "0"},
+			expectedErr: `could not parse maxIdleConns "0" (expected a positive integer)`,
+		},
+		{
+			name:        "invalid dialTimeout",
+			config:      map[string]string{dialTimeoutKey: "5"},
+			expectedErr: `could not parse dialTimeout "5" (expected a positive duration, e.g. "30s")`,
+		},
+		{
+			name:        "negative responseHeaderTimeout",
+			config:      map[string]string{responseHeaderTimeoutKey: "-1s"},
+			expectedErr: `could not parse responseHeaderTimeout "-1s" (expected a positive duration, e.g. "30s")`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseTransportSettings(test.config)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestTransportSettingsApply(t *testing.T) {
+	settings, err := parseTransportSettings(map[string]string{
+		httpsProxyKey:            "proxy.corp:3128",
+		noProxyKey:               "minio.local",
+		maxIdleConnsKey:          "50",
+		dialTimeoutKey:           "5s",
+		responseHeaderTimeoutKey: "1m",
+	})
+	require.NoError(t, err)
+
+	tr := &http.Transport{}
+	settings.applyTransport(tr)
+	assert.Equal(t, 50, tr.MaxIdleConns)
+	assert.Equal(t, 50, tr.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Minute, tr.ResponseHeaderTimeout)
+
+	proxy := func(rawURL string) *url.URL {
+		req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+		require.NoError(t, err)
+		proxyURL, err := tr.Proxy(req)
+		require.NoError(t, err)
+		return proxyURL
+	}
+	assert.Equal(t, "http://proxy.corp:3128", proxy("https://bucket.s3.amazonaws.com/key").String())
+	assert.Nil(t, proxy("https://minio.local/bucket/key"))
+	// only httpsProxy is set, and the environment is ignored
+	assert.Nil(t, proxy("http://bucket.s3.amazonaws.com/key"))
+
+	d := &net.Dialer{}
+	settings.applyDialer(d)
+	assert.Equal(t, 5*time.Second, d.Timeout)
+
+	// unset settings keep the transport defaults
+	tr = &http.Transport{MaxIdleConns: 100}
+	transportSettings{}.applyTransport(tr)
+	assert.Equal(t, 100, tr.MaxIdleConns)
+	assert.Nil(t, tr.Proxy)
+}
+
+func TestObjectStoreUsesHTTPProxy(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a proxy receives the absolute URL of the request
+		proxied = append(proxied, r.URL.String())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	o := newObjectStore(newLogger())
+	require.NoError(t, o.Init(map[string]string{
+		bucketKey:           "bucket",
+		regionKey:           "us-east-1",
+		s3URLKey:            "http://minio.invalid:9000",
+		s3ForcePathStyleKey: "true",
+		httpProxyKey:        proxy.URL,
+		checksumAlgKey:      "",
+	}))
+
+	exists, err := o.ObjectExists("bucket", "key")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, []string{"http://minio.invalid:9000/bucket/key"}, proxied)
+}
@@ -0,0 +1,309 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	trashPrefixKey    = "trashPrefix"
+	trashRetentionKey = "trashRetention"
+
+	defaultTrashRetention = 7 * 24 * time.Hour
+	// trashExpiresTagKey is the tag of an object in the trash that holds
+	// the RFC 3339 time after which it is purged.
+	trashExpiresTagKey = "velero.io/trash-expires-at"
+
+	// trashCommand is the first argument that purges or restores objects
+	// in the trash instead of running the plugin server.
+	trashCommand = "trash"
+)
+
+// trashSettings make DeleteObject move objects under a trash prefix of the
+// bucket, from where they are purged once the retention has passed.
+type trashSettings struct {
+	// prefix ends with a slash.
+	prefix    string
+	retention time.Duration
+}
+
+// parseTrashSettings returns the trash settings of a location, or nil if
+// deleted objects are not kept.
+func parseTrashSettings(config map[string]string) (*trashSettings, error) {
+	prefix := strings.Trim(config[trashPrefixKey], "/")
+	if prefix == "" {
+		if config[trashRetentionKey] != "" {
+			return nil, errors.Errorf("%s requires %s", trashRetentionKey, trashPrefixKey)
+		}
+		return nil, nil
+	}
+	settings := &trashSettings{prefix: prefix + "/", retention: defaultTrashRetention}
+
+	// purging the trash would delete the backups of the location
+	if err := checkOutsideLocation(config, trashPrefixKey, settings.prefix); err != nil {
+		return nil, err
+	}
+
+	retention, err := parsePositiveDuration(config, trashRetentionKey)
+	if err != nil {
+		return nil, err
+	}
+	if retention > 0 {
+		settings.retention = retention
+	}
+	return settings, nil
+}
+
+// contains reports whether key or common prefix is in the trash.
+func (t *trashSettings) contains(key string) bool {
+	return t != nil && strings.HasPrefix(key, t.prefix)
+}
+
+// trashTagging returns the tags of key when it is moved to the trash at
+// now: its configured tags and the expiry.
+func (o *ObjectStore) trashTagging(key string, now time.Time) (string, error) {
+	expires := url.Values{trashExpiresTagKey: {now.Add(o.trash.retention).UTC().Format(time.RFC3339)}}.Encode()
+	tagging, err := o.tagging.header(key)
+	if err != nil || tagging == "" {
+		return expires, err
+	}
+	return tagging + "&" + expires, nil
+}
+
+// copyObject copies an object on the server, keeping its metadata and
+// replacing its tags. The copy is encrypted like objects written by
+// PutObject. Objects larger than 5 GiB cannot be copied with CopyObject.
+func (o *ObjectStore) copyObject(ctx context.Context, log logrus.FieldLogger, bucket, from, to, tagging string) error {
+	sourceKey, head, err := o.headObject(ctx, log, bucket, from)
+	if err != nil {
+		return errors.Wrapf(err, "error reading object %s", from)
+	}
+	if aws.ToInt64(head.ContentLength) > maxCopyObjectSize {
+		return errors.Errorf("object %s is larger than 5 GiB and cannot be copied with CopyObject", from)
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:                    aws.String(bucket),
+		Key:                       aws.String(to),
+		CopySource:                aws.String(copySource(bucket, from)),
+		MetadataDirective:         types.MetadataDirectiveCopy,
+		TaggingDirective:          types.TaggingDirectiveReplace,
+		Tagging:                   optionalString(tagging),
+		RequestPayer:              o.requestPayer,
+		ExpectedBucketOwner:       o.expectedBucketOwner,
+		ExpectedSourceBucketOwner: o.expectedBucketOwner,
+	}
+	switch {
+	case o.kmsKeyID != "":
+		input.ServerSideEncryption = "aws:kms"
+		input.SSEKMSKeyId = &o.kmsKeyID
+	case o.sseCustomerKey != "":
+		setCustomerKey(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5, o.customerKeys()[0])
+	case o.serverSideEncryption != "":
+		input.ServerSideEncryption = types.ServerSideEncryption(o.serverSideEncryption)
+	}
+	setCustomerKey(&input.CopySourceSSECustomerAlgorithm, &input.CopySourceSSECustomerKey, &input.CopySourceSSECustomerKeyMD5, sourceKey)
+
+	_, err = o.s3.CopyObject(ctx, input)
+	return errors.Wrapf(err, "error copying object %s to %s", from, to)
+}
+
+// moveToTrash copies key under the trash prefix and then deletes it. An
+// object that does not exist is not an error, as with DeleteObject.
+func (o *ObjectStore) moveToTrash(ctx context.Context, log logrus.FieldLogger, bucket, key string) error {
+	trashKey := o.trash.prefix + key
+	tagging, err := o.trashTagging(key, time.Now())
+	if err != nil {
+		return err
+	}
+	err = o.copyObject(ctx, log, bucket, key, trashKey, tagging)
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		log.Debug("Object doesn't exist, nothing to move to the trash")
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error moving object %s to the trash", key)
+	}
+	if err := o.deleteObject(ctx, log, bucket, key); err != nil {
+		return err
+	}
+	log.WithField("trashKey", trashKey).Info("Moved object to the trash")
+	return nil
+}
+
+// trashExpiry returns when an object in the trash expires. Objects without
+// the expiry tag, e.g. ones whose tags were changed, expire the retention
+// after they were moved to the trash.
+func (o *ObjectStore) trashExpiry(ctx context.Context, log logrus.FieldLogger, bucket string, obj objectInfo) (time.Time, error) {
+	output, err := o.s3.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket:              aws.String(bucket),
+		Key:                 aws.String(obj.Key),
+		RequestPayer:        o.requestPayer,
+		ExpectedBucketOwner: o.expectedBucketOwner,
+	})
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "error getting tags of object %s", obj.Key)
+	}
+	for _, tag := range output.TagSet {
+		if aws.ToString(tag.Key) != trashExpiresTagKey {
+			continue
+		}
+		expires, err := time.Parse(time.RFC3339, aws.ToString(tag.Value))
+		if err == nil {
+			return expires, nil
+		}
+		log.WithError(err).Warnf("Invalid %s tag", trashExpiresTagKey)
+	}
+	return obj.LastModified.Add(o.trash.retention), nil
+}
+
+// purgeTrash permanently deletes the objects in the trash that expired
+// before now. It returns the number of objects that were deleted.
+func (o *ObjectStore) purgeTrash(bucket string, now time.Time) (int, error) {
+	if o.trash == nil {
+		return 0, errors.Errorf("%s is not set", trashPrefixKey)
+	}
+	ctx := context.Background()
+
+	purged := 0
+	err := o.eachObject(ctx, bucket, o.trash.prefix, func(obj objectInfo) error {
+		log := o.log.WithFields(logrus.Fields{"bucket": bucket, "key": obj.Key})
+		expires, err := o.trashExpiry(ctx, log, bucket, obj)
+		if err != nil {
+			return err
+		}
+		if now.Before(expires) {
+			return nil
+		}
+		if err := o.deleteObject(ctx, log, bucket, obj.Key); err != nil {
+			return err
+		}
+		if o.mirror != nil {
+			key := strings.TrimPrefix(obj.Key, o.trash.prefix)
+			if err := o.purgeFromMirror(ctx, log.WithField("key", key), bucket, key); err != nil {
+				return err
+			}
+		}
+		log.WithField("expiredAt", expires).Info("Purged object from the trash")
+		purged++
+		return nil
+	})
+	return purged, err
+}
+
+// restoreFromTrash moves the objects in the trash whose original key starts
+// with prefix back to their original key, with the configured tags. It
+// returns the number of objects that were restored.
+func (o *ObjectStore) restoreFromTrash(bucket, prefix string) (int, error) {
+	if o.trash == nil {
+		return 0, errors.Errorf("%s is not set", trashPrefixKey)
+	}
+	ctx := context.Background()
+
+	restored := 0
+	err := o.eachObject(ctx, bucket, o.trash.prefix+prefix, func(obj objectInfo) error {
+		trashKey := obj.Key
+		key := strings.TrimPrefix(trashKey, o.trash.prefix)
+		log := o.log.WithFields(logrus.Fields{"bucket": bucket, "key": key})
+
+		tagging, err := o.tagging.header(key)
+		if err != nil {
+			return err
+		}
+		if err := o.copyObject(ctx, log, bucket, trashKey, key, tagging); err != nil {
+			return errors.Wrapf(err, "error restoring object %s from the trash", key)
+		}
+		if err := o.deleteObject(ctx, log, bucket, trashKey); err != nil {
+			return err
+		}
+		log.Info("Restored object from the trash")
+		restored++
+		return nil
+	})
+	return restored, err
+}
+
+// runTrash purges the trash of a location, or restores the objects of a
+// backup from it, and returns the process exit code.
+func runTrash(args []string, stdout, stderr io.Writer) int {
+	flags := pflag.NewFlagSet(trashCommand, pflag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		bslFile         = flags.String("backup-location", "", `path to a BackupStorageLocation YAML file, or "-" for stdin`)
+		credentialsFile = flags.String("credentials-file", "", "path to an AWS credentials file, as referenced by the location's credential")
+		backup          = flags.String("backup", "", "name of the backup to restore, for restore")
+		logLevel        = flags.String("log-level", "warning", "level of the plugin logs written to stderr")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: velero-plugin-for-aws %s purge|restore [flags]\n\n"+
+			"purge deletes the objects whose retention has passed from the trash of a location.\n"+
+			"restore moves the objects of a backup from the trash back to the location.\n\n", trashCommand)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || (flags.Arg(0) != "purge" && flags.Arg(0) != "restore") {
+		flags.Usage()
+		return 2
+	}
+	action := flags.Arg(0)
+	if *bslFile == "" {
+		fmt.Fprintln(stderr, "--backup-location is required")
+		return 2
+	}
+	if action == "restore" && *backup == "" {
+		fmt.Fprintln(stderr, "--backup is required for restore")
+		return 2
+	}
+
+	o, config, err := initBackupStorageLocation(*bslFile, *credentialsFile, *logLevel, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	var count int
+	if action == "purge" {
+		count, err = o.purgeTrash(config[bucketKey], time.Now())
+		fmt.Fprintf(stdout, "Purged %d objects from the trash\n", count)
+	} else {
+		prefix := path.Join(config[prefixKey], "backups", *backup) + "/"
+		count, err = o.restoreFromTrash(config[bucketKey], prefix)
+		fmt.Fprintf(stdout, "Restored %d objects of backup %s from the trash\n", count, *backup)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,269 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func headKey(key string) interface{} {
+	return mock.MatchedBy(func(input *s3.HeadObjectInput) bool {
+		return aws.ToString(input.Key) == key
+	})
+}
+
+func deleteKey(key string) interface{} {
+	return mock.MatchedBy(func(input *s3.DeleteObjectInput) bool {
+		return aws.ToString(input.Key) == key
+	})
+}
+
+func TestParseTrashSettings(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]string
+		expected    *trashSettings
+		expectedErr string
+	}{
+		{
+			name:   "not configured",
+			config: map[string]string{},
+		},
+		{
+			name:     "default retention",
+			config:   map[string]string{trashPrefixKey: "/trash/", prefixKey: "velero"},
+			expected: &trashSettings{prefix: "trash/", retention: defaultTrashRetention},
+		},
+		{
+			name:     "no location prefix",
+			config:   map[string]string{trashPrefixKey: "trash", trashRetentionKey: "72h"},
+			expected: &trashSettings{prefix: "trash/", retention: 72 * time.Hour},
+		},
+		{
+			name:     "trash under the location prefix",
+			config:   map[string]string{trashPrefixKey: "velero/trash", prefixKey: "velero"},
+			expected: &trashSettings{prefix: "velero/trash/", retention: defaultTrashRetention},
+		},
+		{
+			name:        "location prefix under the trash",
+			config:      map[string]string{trashPrefixKey: "velero", prefixKey: "velero/prod"},
+			expectedErr: `trashPrefix "velero" contains the prefix "velero/prod" of the backup storage location`,
+		},
+		{
+			name:        "retention without trash",
+			config:      map[string]string{trashRetentionKey: "72h"},
+			expectedErr: "trashRetention requires trashPrefix",
+		},
+		{
+			name:        "invalid retention",
+			config:      map[string]string{trashPrefixKey: "trash", trashRetentionKey: "7d"},
+			expectedErr: `could not parse trashRetention "7d" (expected a positive duration, e.g. "30s")`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings, err := parseTrashSettings(test.config)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, settings)
+		})
+	}
+}
+
+func TestDeleteObjectMovesToTrash(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := &ObjectStore{
+		log:     newLogger(),
+		s3:      s,
+		tagging: &objectTagging{tags: objectTags{{key: "team", value: "backup"}}},
+		trash:   &trashSettings{prefix: "trash/", retention: time.Hour},
+	}
+
+	s.On("HeadObject", mock.Anything, headKey("velero/backups/b1/b1.tar.gz")).Return(&s3.HeadObjectOutput{ContentLength: aws.Int64(10)}, nil)
+	var tagging string
+	s.On("CopyObject", mock.Anything, mock.MatchedBy(func(input *s3.CopyObjectInput) bool {
+		tagging = aws.ToString(input.Tagging)
+		return aws.ToString(input.Key) == "trash/velero/backups/b1/b1.tar.gz" &&
+			aws.ToString(input.CopySource) == "bucket/velero%2Fbackups%2Fb1%2Fb1.tar.gz" &&
+			input.MetadataDirective == types.MetadataDirectiveCopy &&
+			input.TaggingDirective == types.TaggingDirectiveReplace
+	})).Return(&s3.CopyObjectOutput{}, nil)
+	s.On("DeleteObject", mock.Anything, deleteKey("velero/backups/b1/b1.tar.gz")).Return(&s3.DeleteObjectOutput{}, nil)
+
+	before := time.Now()
+	require.NoError(t, o.DeleteObject("bucket", "velero/backups/b1/b1.tar.gz"))
+
+	require.True(t, strings.HasPrefix(tagging, "team=backup&velero.io%2Ftrash-expires-at="), tagging)
+	expires, err := time.Parse(time.RFC3339, strings.ReplaceAll(strings.SplitN(tagging, "=", 3)[2], "%3A", ":"))
+	require.NoError(t, err)
+	assert.WithinDuration(t, before.Add(time.Hour), expires, 2*time.Second)
+}
+
+func TestDeleteObjectMovesToTrashErrors(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := &ObjectStore{log: newLogger(), s3: s, trash: &trashSettings{prefix: "trash/", retention: time.Hour}}
+
+	// an object that does not exist is deleted
+	s.On("HeadObject", mock.Anything, headKey("missing")).Return(&s3.HeadObjectOutput{}, &types.NotFound{})
+	assert.NoError(t, o.DeleteObject("bucket", "missing"))
+
+	s.On("HeadObject", mock.Anything, headKey("large")).Return(&s3.HeadObjectOutput{ContentLength: aws.Int64(maxCopyObjectSize + 1)}, nil)
+	assert.EqualError(t, o.DeleteObject("bucket", "large"), "error moving object large to the trash: object large is larger than 5 GiB and cannot be copied with CopyObject")
+
+	s.AssertNotCalled(t, "DeleteObject", mock.Anything, mock.Anything)
+}
+
+func TestListTrashIsHidden(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := &ObjectStore{log: newLogger(), s3: s, trash: &trashSettings{prefix: "velero/trash/"}}
+
+	s.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return input.Delimiter != nil
+	})).Return(&s3.ListObjectsV2Output{
+		CommonPrefixes: []types.CommonPrefix{{Prefix: aws.String("velero/backups/")}, {Prefix: aws.String("velero/trash/")}},
+	}, nil)
+	s.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return input.Delimiter == nil
+	})).Return(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("velero/backups/b1/b1.tar.gz")}, {Key: aws.String("velero/trash/velero/backups/b2/b2.tar.gz")}},
+	}, nil)
+
+	prefixes, err := o.ListCommonPrefixes("bucket", "velero/", "/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"velero/backups/"}, prefixes)
+
+	keys, err := o.ListObjects("bucket", "velero/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"velero/backups/b1/b1.tar.gz"}, keys)
+}
+
+func TestPurgeTrash(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := &ObjectStore{log: newLogger(), s3: s, trash: &trashSettings{prefix: "trash/", retention: time.Hour}}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	s.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return aws.ToString(input.Prefix) == "trash/"
+	})).Return(&s3.ListObjectsV2Output{
+		Contents: []types.Object{
+			{Key: aws.String("trash/expired")},
+			{Key: aws.String("trash/kept")},
+			{Key: aws.String("trash/untagged-old"), LastModified: aws.Time(now.Add(-2 * time.Hour))},
+			{Key: aws.String("trash/untagged-new"), LastModified: aws.Time(now.Add(-time.Minute))},
+		},
+	}, nil)
+	tags := func(key string, tagSet ...types.Tag) {
+		s.On("GetObjectTagging", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectTaggingInput) bool {
+			return aws.ToString(input.Key) == key
+		})).Return(&s3.GetObjectTaggingOutput{TagSet: tagSet}, nil)
+	}
+	tags("trash/expired", types.Tag{Key: aws.String(trashExpiresTagKey), Value: aws.String("2026-10-18T11:00:00Z")})
+	tags("trash/kept", types.Tag{Key: aws.String(trashExpiresTagKey), Value: aws.String("2026-10-18T13:00:00Z")})
+	tags("trash/untagged-old")
+	tags("trash/untagged-new", types.Tag{Key: aws.String("team"), Value: aws.String("backup")})
+	s.On("DeleteObject", mock.Anything, deleteKey("trash/expired")).Return(&s3.DeleteObjectOutput{}, nil)
+	s.On("DeleteObject", mock.Anything, deleteKey("trash/untagged-old")).Return(&s3.DeleteObjectOutput{}, nil)
+
+	purged, err := o.purgeTrash("bucket", now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+}
+
+func TestTrashKeepsMirrorCopyUntilPurged(t *testing.T) {
+	s, mirror := new(mockS3), new(mockS3)
+	defer s.AssertExpectations(t)
+	defer mirror.AssertExpectations(t)
+	o := &ObjectStore{
+		log:    newLogger(),
+		s3:     s,
+		trash:  &trashSettings{prefix: "trash/", retention: time.Hour},
+		mirror: &objectMirror{bucket: "mirror", s3: mirror},
+	}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	// the mirror copy is kept while the object is in the trash
+	s.On("HeadObject", mock.Anything, headKey("backups/b1/b1.tar.gz")).Return(&s3.HeadObjectOutput{ContentLength: aws.Int64(10)}, nil).Once()
+	s.On("CopyObject", mock.Anything, mock.Anything).Return(&s3.CopyObjectOutput{}, nil).Once()
+	s.On("DeleteObject", mock.Anything, deleteKey("backups/b1/b1.tar.gz")).Return(&s3.DeleteObjectOutput{}, nil).Once()
+	require.NoError(t, o.DeleteObject("bucket", "backups/b1/b1.tar.gz"))
+
+	// and deleted when it is purged, unless the key was written again
+	s.On("ListObjectsV2", mock.Anything, mock.Anything).Return(&s3.ListObjectsV2Output{
+		Contents: []types.Object{
+			{Key: aws.String("trash/backups/b1/b1.tar.gz"), LastModified: aws.Time(now.Add(-2 * time.Hour))},
+			{Key: aws.String("trash/backups/b2/b2.tar.gz"), LastModified: aws.Time(now.Add(-2 * time.Hour))},
+		},
+	}, nil)
+	s.On("GetObjectTagging", mock.Anything, mock.Anything).Return(&s3.GetObjectTaggingOutput{}, nil)
+	s.On("DeleteObject", mock.Anything, deleteKey("trash/backups/b1/b1.tar.gz")).Return(&s3.DeleteObjectOutput{}, nil)
+	s.On("DeleteObject", mock.Anything, deleteKey("trash/backups/b2/b2.tar.gz")).Return(&s3.DeleteObjectOutput{}, nil)
+	s.On("HeadObject", mock.Anything, headKey("backups/b1/b1.tar.gz")).Return(&s3.HeadObjectOutput{}, &types.NotFound{})
+	s.On("HeadObject", mock.Anything, headKey("backups/b2/b2.tar.gz")).Return(&s3.HeadObjectOutput{}, nil)
+	mirror.On("DeleteObject", mock.Anything, deleteKey("backups/b1/b1.tar.gz")).Return(&s3.DeleteObjectOutput{}, nil).Once()
+
+	purged, err := o.purgeTrash("bucket", now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+}
+
+func TestRestoreFromTrash(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := &ObjectStore{log: newLogger(), s3: s, tagging: &objectTagging{tags: objectTags{{key: "team", value: "backup"}}}, trash: &trashSettings{prefix: "trash/", retention: time.Hour}}
+
+	s.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return aws.ToString(input.Prefix) == "trash/velero/backups/b1/"
+	})).Return(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("trash/velero/backups/b1/b1.tar.gz")}},
+	}, nil)
+	s.On("HeadObject", mock.Anything, headKey("trash/velero/backups/b1/b1.tar.gz")).Return(&s3.HeadObjectOutput{ContentLength: aws.Int64(10)}, nil)
+	s.On("CopyObject", mock.Anything, mock.MatchedBy(func(input *s3.CopyObjectInput) bool {
+		return aws.ToString(input.Key) == "velero/backups/b1/b1.tar.gz" &&
+			aws.ToString(input.CopySource) == "bucket/trash%2Fvelero%2Fbackups%2Fb1%2Fb1.tar.gz" &&
+			aws.ToString(input.Tagging) == "team=backup"
+	})).Return(&s3.CopyObjectOutput{}, nil)
+	s.On("DeleteObject", mock.Anything, deleteKey("trash/velero/backups/b1/b1.tar.gz")).Return(&s3.DeleteObjectOutput{}, nil)
+
+	restored, err := o.restoreFromTrash("bucket", "velero/backups/b1/")
+	require.NoError(t, err)
+	assert.Equal(t, 1, restored)
+}
+
+func TestTrashRequiresTrashPrefix(t *testing.T) {
+	o := &ObjectStore{log: newLogger()}
+	_, err := o.purgeTrash("bucket", time.Now())
+	assert.EqualError(t, err, "trashPrefix is not set")
+	_, err = o.restoreFromTrash("bucket", "")
+	assert.EqualError(t, err, "trashPrefix is not set")
+}
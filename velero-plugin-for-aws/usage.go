@@ -0,0 +1,197 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// usageCommand is the first argument that reports the storage used by a
+// location instead of running the plugin server.
+const usageCommand = "usage"
+
+// usageReport is the storage used by a backup storage location.
+type usageReport struct {
+	Bucket string       `json:"bucket"`
+	Prefix string       `json:"prefix,omitempty"`
+	Total  *prefixStats `json:"total"`
+	// Directories are the top-level directories of the location, e.g.
+	// "backups" and "kopia".
+	Directories map[string]*prefixStats `json:"directories,omitempty"`
+	Backups     map[string]*prefixStats `json:"backups,omitempty"`
+	Trash       *prefixStats            `json:"trash,omitempty"`
+}
+
+// locationUsage lists the objects under prefix, the prefix of a location,
+// once and sums them up by top-level directory and by backup. Objects hidden
+// from Velero are left out, and the trash is summed up on its own.
+func (o *ObjectStore) locationUsage(ctx context.Context, bucket, prefix string) (*usageReport, error) {
+	root := locationRoot(prefix)
+	report := &usageReport{
+		Bucket:      bucket,
+		Prefix:      strings.TrimSuffix(root, "/"),
+		Total:       &prefixStats{},
+		Directories: map[string]*prefixStats{},
+		Backups:     map[string]*prefixStats{},
+	}
+	add := func(stats map[string]*prefixStats, name string, obj objectInfo) {
+		if stats[name] == nil {
+			stats[name] = &prefixStats{}
+		}
+		stats[name].add(obj)
+	}
+
+	err := o.eachObject(ctx, bucket, root, func(obj objectInfo) error {
+		if o.hidden(obj.Key) {
+			return nil
+		}
+		report.Total.add(obj)
+		parts := strings.SplitN(strings.TrimPrefix(obj.Key, root), "/", 3)
+		if len(parts) == 1 {
+			return nil
+		}
+		add(report.Directories, parts[0], obj)
+		if parts[0] == "backups" && len(parts) == 3 {
+			add(report.Backups, parts[1], obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if o.trash != nil {
+		if report.Trash, err = o.statPrefix(ctx, bucket, o.trash.prefix); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func (r *usageReport) writeText(w io.Writer) {
+	location := r.Bucket
+	if r.Prefix != "" {
+		location += "/" + r.Prefix
+	}
+	fmt.Fprintf(w, "%s: %s\n", location, r.Total)
+	for _, class := range sortedKeys(r.Total.StorageClasses) {
+		fmt.Fprintf(w, "  %-20s  %s\n", class, formatBytes(r.Total.StorageClasses[class]))
+	}
+	if len(r.Directories) > 0 {
+		fmt.Fprintln(w, "\nDirectories:")
+		for _, name := range sortedKeys(r.Directories) {
+			fmt.Fprintf(w, "  %-20s  %s\n", name, r.Directories[name])
+		}
+	}
+	if len(r.Backups) > 0 {
+		fmt.Fprintln(w, "\nBackups:")
+		for _, name := range sortedKeys(r.Backups) {
+			fmt.Fprintf(w, "  %-40s  %s\n", name, r.Backups[name])
+		}
+	}
+	if r.Trash != nil {
+		fmt.Fprintf(w, "\nTrash: %s\n", r.Trash)
+	}
+}
+
+func (s *prefixStats) String() string {
+	if s.Objects == 1 {
+		return fmt.Sprintf("1 object, %s", formatBytes(s.Bytes))
+	}
+	return fmt.Sprintf("%d objects, %s", s.Objects, formatBytes(s.Bytes))
+}
+
+// formatBytes formats n with a binary unit, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runUsage reports the storage used by a location and returns the process
+// exit code.
+func runUsage(args []string, stdout, stderr io.Writer) int {
+	flags := pflag.NewFlagSet(usageCommand, pflag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		bslFile         = flags.String("backup-location", "", `path to a BackupStorageLocation YAML file, or "-" for stdin`)
+		credentialsFile = flags.String("credentials-file", "", "path to an AWS credentials file, as referenced by the location's credential")
+		output          = flags.StringP("output", "o", "text", `output format, "text" or "json"`)
+		logLevel        = flags.String("log-level", "warning", "level of the plugin logs written to stderr")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: velero-plugin-for-aws %s [flags]\n\nReports the number and size of the objects of a location, by directory and by backup.\n\n", usageCommand)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *bslFile == "" {
+		fmt.Fprintln(stderr, "--backup-location is required")
+		return 2
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(stderr, "invalid --output %q, expected \"text\" or \"json\"\n", *output)
+		return 2
+	}
+
+	o, config, err := initBackupStorageLocation(*bslFile, *credentialsFile, *logLevel, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	report, err := o.locationUsage(context.Background(), config[bucketKey], config[prefixKey])
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	} else {
+		report.writeText(stdout)
+	}
+	return 0
+}
@@ -0,0 +1,185 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	versionedDeletesKey   = "versionedDeletes"
+	readDeletedObjectsKey = "readDeletedObjects"
+
+	// maxDeleteObjects is the most objects a DeleteObjects request can
+	// delete.
+	maxDeleteObjects = 1000
+)
+
+// objectVersions returns the versions and delete markers of key, newest
+// first.
+func (o *ObjectStore) objectVersions(ctx context.Context, bucket, key string) ([]types.ObjectVersion, []types.DeleteMarkerEntry, error) {
+	input := &s3.ListObjectVersionsInput{
+		Bucket:              aws.String(bucket),
+		Prefix:              aws.String(key),
+		RequestPayer:        o.requestPayer,
+		ExpectedBucketOwner: o.expectedBucketOwner,
+	}
+
+	var versions []types.ObjectVersion
+	var markers []types.DeleteMarkerEntry
+	p := s3.NewListObjectVersionsPaginator(o.s3, input)
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error listing versions of object %s", key)
+		}
+		// the prefix also matches longer keys
+		for _, version := range page.Versions {
+			if aws.ToString(version.Key) == key {
+				versions = append(versions, version)
+			}
+		}
+		for _, marker := range page.DeleteMarkers {
+			if aws.ToString(marker.Key) == key {
+				markers = append(markers, marker)
+			}
+		}
+	}
+	return versions, markers, nil
+}
+
+// mfaDeleteEnabled reports whether deleting versions in bucket requires an
+// MFA token, which the plugin cannot provide. The result is kept for the
+// lifetime of the object store.
+func (o *ObjectStore) mfaDeleteEnabled(ctx context.Context, bucket string) (bool, error) {
+	o.versioningMu.Lock()
+	defer o.versioningMu.Unlock()
+
+	if enabled, ok := o.mfaDelete[bucket]; ok {
+		return enabled, nil
+	}
+	output, err := o.s3.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{
+		Bucket:              aws.String(bucket),
+		ExpectedBucketOwner: o.expectedBucketOwner,
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "error getting versioning configuration of bucket %s", bucket)
+	}
+	if o.mfaDelete == nil {
+		o.mfaDelete = map[string]bool{}
+	}
+	o.mfaDelete[bucket] = output.MFADelete == types.MFADeleteStatusEnabled
+	return o.mfaDelete[bucket], nil
+}
+
+// deleteAllVersions deletes every version and delete marker of key, so that
+// a deleted object no longer takes up space in a versioned bucket.
+func (o *ObjectStore) deleteAllVersions(ctx context.Context, log logrus.FieldLogger, bucket, key string) (bool, error) {
+	mfaDelete, err := o.mfaDeleteEnabled(ctx, bucket)
+	if err != nil {
+		return false, err
+	}
+	if mfaDelete {
+		log.Warnf("Bucket has MFA delete enabled, so %s cannot delete the versions of the object and only a delete marker is added", versionedDeletesKey)
+		return false, nil
+	}
+
+	versions, markers, err := o.objectVersions(ctx, bucket, key)
+	if err != nil {
+		return false, err
+	}
+	var objects []types.ObjectIdentifier
+	for _, version := range versions {
+		objects = append(objects, types.ObjectIdentifier{Key: version.Key, VersionId: version.VersionId})
+	}
+	for _, marker := range markers {
+		objects = append(objects, types.ObjectIdentifier{Key: marker.Key, VersionId: marker.VersionId})
+	}
+
+	for len(objects) > 0 {
+		batch := objects
+		if len(batch) > maxDeleteObjects {
+			batch = batch[:maxDeleteObjects]
+		}
+		objects = objects[len(batch):]
+
+		output, err := o.s3.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket:              aws.String(bucket),
+			Delete:              &types.Delete{Objects: batch, Quiet: aws.Bool(true)},
+			RequestPayer:        o.requestPayer,
+			ExpectedBucketOwner: o.expectedBucketOwner,
+		})
+		if err != nil {
+			return false, errors.Wrapf(err, "error deleting versions of object %s", key)
+		}
+		if len(output.Errors) > 0 {
+			failed := output.Errors[0]
+			return false, errors.Errorf("error deleting version %s of object %s: %s: %s", aws.ToString(failed.VersionId), key,
+				aws.ToString(failed.Code), aws.ToString(failed.Message))
+		}
+	}
+	log.WithFields(logrus.Fields{"versions": len(versions), "deleteMarkers": len(markers)}).Debug("Deleted all versions of object")
+	return true, nil
+}
+
+// getLatestVersion reads the newest version of key that is not a delete
+// marker, for an object that has been deleted in a versioned bucket.
+// notFound is the error of reading the current object, which is returned if
+// the object has no versions, e.g. because it never existed.
+func (o *ObjectStore) getLatestVersion(ctx context.Context, log logrus.FieldLogger, bucket, key string, notFound error) (io.ReadCloser, error) {
+	versions, _, err := o.objectVersions(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, errors.Wrapf(notFound, "error getting object %s", key)
+	}
+	latest := versions[0]
+
+	var output *s3.GetObjectOutput
+	object := o.headObjectInput(bucket, key)
+	object.VersionId = latest.VersionId
+	err = o.withCustomerKeys(ctx, log, o.s3, object, func(ck customerKey) error {
+		input := &s3.GetObjectInput{
+			Bucket:              aws.String(bucket),
+			Key:                 aws.String(key),
+			VersionId:           latest.VersionId,
+			RequestPayer:        o.requestPayer,
+			ExpectedBucketOwner: o.expectedBucketOwner,
+		}
+		setCustomerKey(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5, ck)
+
+		var err error
+		output, err = o.s3.GetObject(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting version %s of object %s", aws.ToString(latest.VersionId), key)
+	}
+	log.WithFields(logrus.Fields{
+		"versionId":    aws.ToString(latest.VersionId),
+		"lastModified": aws.ToTime(latest.LastModified),
+	}).Warn("Object is deleted, reading its latest version")
+	return output.Body, nil
+}
@@ -0,0 +1,175 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func listVersionsInput(key string) interface{} {
+	return mock.MatchedBy(func(input *s3.ListObjectVersionsInput) bool {
+		return aws.ToString(input.Prefix) == key
+	})
+}
+
+func TestDeleteObjectVersions(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := &ObjectStore{log: newLogger(), s3: s, versionedDeletes: true}
+
+	s.On("GetBucketVersioning", mock.Anything, mock.Anything).Return(&s3.GetBucketVersioningOutput{Status: types.BucketVersioningStatusEnabled}, nil).Once()
+	// two pages, with a version of a longer key that must be kept
+	s.On("ListObjectVersions", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectVersionsInput) bool {
+		return input.KeyMarker == nil
+	})).Return(&s3.ListObjectVersionsOutput{
+		Versions: []types.ObjectVersion{
+			{Key: aws.String("backups/b1/b1.tar.gz"), VersionId: aws.String("v2")},
+			{Key: aws.String("backups/b1/b1.tar.gz"), VersionId: aws.String("v1")},
+		},
+		IsTruncated:         aws.Bool(true),
+		NextKeyMarker:       aws.String("backups/b1/b1.tar.gz"),
+		NextVersionIdMarker: aws.String("v1"),
+	}, nil).Twice()
+	s.On("ListObjectVersions", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectVersionsInput) bool {
+		return aws.ToString(input.VersionIdMarker) == "v1"
+	})).Return(&s3.ListObjectVersionsOutput{
+		Versions:      []types.ObjectVersion{{Key: aws.String("backups/b1/b1.tar.gz.bak"), VersionId: aws.String("v9")}},
+		DeleteMarkers: []types.DeleteMarkerEntry{{Key: aws.String("backups/b1/b1.tar.gz"), VersionId: aws.String("m1")}},
+	}, nil).Twice()
+
+	var deleted []string
+	s.On("DeleteObjects", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		for _, object := range args.Get(1).(*s3.DeleteObjectsInput).Delete.Objects {
+			deleted = append(deleted, aws.ToString(object.Key)+"@"+aws.ToString(object.VersionId))
+		}
+	}).Return(&s3.DeleteObjectsOutput{}, nil).Twice()
+
+	require.NoError(t, o.DeleteObject("bucket", "backups/b1/b1.tar.gz"))
+	assert.Equal(t, []string{"backups/b1/b1.tar.gz@v2", "backups/b1/b1.tar.gz@v1", "backups/b1/b1.tar.gz@m1"}, deleted)
+
+	// the versioning configuration is only read once
+	require.NoError(t, o.DeleteObject("bucket", "backups/b1/b1.tar.gz"))
+}
+
+func TestDeleteObjectVersionsBatches(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := &ObjectStore{log: newLogger(), s3: s, versionedDeletes: true}
+
+	var versions []types.ObjectVersion
+	for i := 0; i < maxDeleteObjects+1; i++ {
+		versions = append(versions, types.ObjectVersion{Key: aws.String("k"), VersionId: aws.String(fmt.Sprint(i))})
+	}
+	s.On("GetBucketVersioning", mock.Anything, mock.Anything).Return(&s3.GetBucketVersioningOutput{}, nil)
+	s.On("ListObjectVersions", mock.Anything, listVersionsInput("k")).Return(&s3.ListObjectVersionsOutput{Versions: versions}, nil)
+	s.On("DeleteObjects", mock.Anything, mock.MatchedBy(func(input *s3.DeleteObjectsInput) bool {
+		return len(input.Delete.Objects) == maxDeleteObjects
+	})).Return(&s3.DeleteObjectsOutput{}, nil).Once()
+	s.On("DeleteObjects", mock.Anything, mock.MatchedBy(func(input *s3.DeleteObjectsInput) bool {
+		return len(input.Delete.Objects) == 1
+	})).Return(&s3.DeleteObjectsOutput{
+		Errors: []types.Error{{Key: aws.String("k"), VersionId: aws.String("1000"), Code: aws.String("AccessDenied"), Message: aws.String("Access Denied")}},
+	}, nil).Once()
+
+	assert.EqualError(t, o.DeleteObject("bucket", "k"), "error deleting version 1000 of object k: AccessDenied: Access Denied")
+}
+
+func TestDeleteObjectVersionsWithMFADelete(t *testing.T) {
+	s := new(mockS3)
+	defer s.AssertExpectations(t)
+	o := &ObjectStore{log: newLogger(), s3: s, versionedDeletes: true}
+
+	s.On("GetBucketVersioning", mock.Anything, mock.Anything).Return(&s3.GetBucketVersioningOutput{
+		Status:    types.BucketVersioningStatusEnabled,
+		MFADelete: types.MFADeleteStatusEnabled,
+	}, nil)
+	s.On("DeleteObject", mock.Anything, mock.Anything).Return(&s3.DeleteObjectOutput{}, nil)
+
+	require.NoError(t, o.DeleteObject("bucket", "k"))
+	s.AssertNotCalled(t, "ListObjectVersions", mock.Anything, mock.Anything)
+}
+
+func TestGetDeletedObject(t *testing.T) {
+	tests := []struct {
+		name               string
+		readDeletedObjects bool
+		versions           []types.ObjectVersion
+		expectedBody       string
+		expectedErr        string
+	}{
+		{
+			name:        "disabled",
+			expectedErr: "error getting object k: NoSuchKey: ",
+		},
+		{
+			name:               "latest version",
+			readDeletedObjects: true,
+			versions: []types.ObjectVersion{
+				{Key: aws.String("k"), VersionId: aws.String("v2")},
+				{Key: aws.String("k"), VersionId: aws.String("v1")},
+			},
+			expectedBody: "v2",
+		},
+		{
+			name:               "never existed",
+			readDeletedObjects: true,
+			expectedErr:        "error getting object k: NoSuchKey: ",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := new(mockS3)
+			defer s.AssertExpectations(t)
+			o := &ObjectStore{log: newLogger(), s3: s, readDeletedObjects: test.readDeletedObjects}
+
+			s.On("GetObject", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+				return input.VersionId == nil
+			})).Return(&s3.GetObjectOutput{}, &types.NoSuchKey{}).Once()
+			if test.readDeletedObjects {
+				s.On("ListObjectVersions", mock.Anything, listVersionsInput("k")).Return(&s3.ListObjectVersionsOutput{Versions: test.versions}, nil)
+			}
+			if test.expectedBody != "" {
+				s.On("GetObject", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+					return aws.ToString(input.VersionId) == test.expectedBody
+				})).Return(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(test.expectedBody))}, nil).Once()
+			}
+
+			body, err := o.GetObject("bucket", "k")
+			if test.expectedErr != "" {
+				assert.ErrorContains(t, err, test.expectedErr)
+				var noSuchKey *types.NoSuchKey
+				assert.ErrorAs(t, err, &noSuchKey)
+				return
+			}
+			require.NoError(t, err)
+			data, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedBody, string(data))
+		})
+	}
+}
@@ -21,10 +21,12 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/smithy-go"
 
 	"github.com/pkg/errors"
@@ -52,6 +54,9 @@ type VolumeSnapshotter struct {
 	log         logrus.FieldLogger
 	ec2         *ec2.Client
 	ebsKmsKeyId string
+	// permissionReport is the result of the permission check, if it was
+	// enabled with validatePermissions.
+	permissionReport *permissionReport
 }
 
 func newVolumeSnapshotter(logger logrus.FieldLogger) *VolumeSnapshotter {
@@ -59,7 +64,8 @@ func newVolumeSnapshotter(logger logrus.FieldLogger) *VolumeSnapshotter {
 }
 
 func (b *VolumeSnapshotter) Init(config map[string]string) error {
-	if err := veleroplugin.ValidateVolumeSnapshotterConfigKeys(config, regionKey, credentialProfileKey, credentialsFileKey, enableSharedConfigKey, ebsKmsKeyIDKey); err != nil {
+	if err := veleroplugin.ValidateVolumeSnapshotterConfigKeys(config, regionKey, credentialProfileKey, credentialsFileKey, credentialsSecretKey, enableSharedConfigKey, ebsKmsKeyIDKey, validatePermissionsKey,
+		httpProxyKey, httpsProxyKey, noProxyKey, maxIdleConnsKey, dialTimeoutKey, responseHeaderTimeoutKey); err != nil {
 		return err
 	}
 
@@ -71,23 +77,54 @@ func (b *VolumeSnapshotter) Init(config map[string]string) error {
 	if region == "" {
 		return errors.Errorf("missing %s in aws configuration", regionKey)
 	}
+
+	validatePermissions := false
+	if val := config[validatePermissionsKey]; val != "" {
+		var err error
+		if validatePermissions, err = strconv.ParseBool(val); err != nil {
+			return errors.Wrapf(err, "could not parse %s (expected bool)", validatePermissionsKey)
+		}
+	}
+	transport, err := parseTransportSettings(config)
+	if err != nil {
+		return err
+	}
+	secretCreds, err := locationSecretCredentials(config)
+	if err != nil {
+		return err
+	}
 	cfg, err := newConfigBuilder(b.log).
 		WithRegion(region).
 		WithProfile(credentialProfile).
-		WithCredentialsFile(credentialsFile).Build()
+		WithCredentialsFile(credentialsFile).
+		WithCredentialsSecret(secretCreds).
+		WithTransportSettings(transport).Build()
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	cfg.APIOptions = append(cfg.APIOptions, metricsAPIOptions("", region)...)
+	cfg.APIOptions = append(cfg.APIOptions, tracingAPIOptions(region)...)
 	b.ec2 = ec2.NewFromConfig(cfg)
+
+	if validatePermissions {
+		b.permissionReport = b.checkPermissions(context.Background(), region, kms.NewFromConfig(cfg))
+		b.permissionReport.log(b.log.WithField("region", region))
+		if err := b.permissionReport.err(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (volumeID string, err error) {
+	ctx, span := startSpan(context.Background(), "VolumeSnapshotter.CreateVolumeFromSnapshot", snapshotIDAttr(snapshotID))
+	defer func() { endSpan(span, err) }()
+
 	// describe the snapshot so we can apply its tags to the volume
 	descSnapInput := &ec2.DescribeSnapshotsInput{
 		SnapshotIds: []string{snapshotID},
 	}
-	descSnapOutput, err := b.ec2.DescribeSnapshots(context.Background(), descSnapInput)
+	descSnapOutput, err := b.ec2.DescribeSnapshots(ctx, descSnapInput)
 	if err != nil {
 		b.log.Infof("failed to describe snap shot: %v", err)
 
@@ -125,7 +162,7 @@ func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, vol
 		input.Iops = &iops32
 	}
 
-	output, err := b.ec2.CreateVolume(context.Background(), input)
+	output, err := b.ec2.CreateVolume(ctx, input)
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
@@ -133,8 +170,11 @@ func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, vol
 	return *output.VolumeId, nil
 }
 
-func (b *VolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
-	volumeInfo, err := b.describeVolume(volumeID)
+func (b *VolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (_ string, _ *int64, err error) {
+	ctx, span := startSpan(context.Background(), "VolumeSnapshotter.GetVolumeInfo", volumeIDAttr(volumeID))
+	defer func() { endSpan(span, err) }()
+
+	volumeInfo, err := b.describeVolume(ctx, volumeID)
 	if err != nil {
 		return "", nil, err
 	}
@@ -154,12 +194,12 @@ func (b *VolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *i
 	return volumeType, &iops64, nil
 }
 
-func (b *VolumeSnapshotter) describeVolume(volumeID string) (types.Volume, error) {
+func (b *VolumeSnapshotter) describeVolume(ctx context.Context, volumeID string) (types.Volume, error) {
 	input := &ec2.DescribeVolumesInput{
 		VolumeIds: []string{volumeID},
 	}
 
-	output, err := b.ec2.DescribeVolumes(context.Background(), input)
+	output, err := b.ec2.DescribeVolumes(ctx, input)
 	if err != nil {
 		return types.Volume{}, errors.WithStack(err)
 	}
@@ -170,14 +210,17 @@ func (b *VolumeSnapshotter) describeVolume(volumeID string) (types.Volume, error
 	return output.Volumes[0], nil
 }
 
-func (b *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
+func (b *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (_ string, err error) {
+	ctx, span := startSpan(context.Background(), "VolumeSnapshotter.CreateSnapshot", volumeIDAttr(volumeID))
+	defer func() { endSpan(span, err) }()
+
 	// describe the volume so we can copy its tags to the snapshot
-	volumeInfo, err := b.describeVolume(volumeID)
+	volumeInfo, err := b.describeVolume(ctx, volumeID)
 	if err != nil {
 		return "", err
 	}
 
-	res, err := b.ec2.CreateSnapshot(context.Background(), &ec2.CreateSnapshotInput{
+	res, err := b.ec2.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
 		VolumeId: &volumeID,
 		TagSpecifications: []types.TagSpecification{
 			{
@@ -242,11 +285,14 @@ func ec2Tag(key, val string) types.Tag {
 	return types.Tag{Key: &key, Value: &val}
 }
 
-func (b *VolumeSnapshotter) DeleteSnapshot(snapshotID string) error {
+func (b *VolumeSnapshotter) DeleteSnapshot(snapshotID string) (err error) {
+	ctx, span := startSpan(context.Background(), "VolumeSnapshotter.DeleteSnapshot", snapshotIDAttr(snapshotID))
+	defer func() { endSpan(span, err) }()
+
 	input := &ec2.DeleteSnapshotInput{
 		SnapshotId: &snapshotID,
 	}
-	_, err := b.ec2.DeleteSnapshot(context.Background(), input)
+	_, err = b.ec2.DeleteSnapshot(ctx, input)
 
 	// if it's a NotFound error, we don't need to return an error
 	// since the snapshot is not there.
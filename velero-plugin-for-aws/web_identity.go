@@ -0,0 +1,162 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/pkg/errors"
+)
+
+const (
+	stsURLKey               = "stsUrl"
+	webIdentityTokenFileKey = "webIdentityTokenFile"
+	webIdentityAudienceKey  = "webIdentityAudience"
+	webIdentityRoleARNKey   = "webIdentityRoleArn"
+
+	webIdentitySessionName = "velero-plugin-for-aws"
+	// webIdentityExpiryWindow is how long before they expire temporary
+	// credentials are refreshed, so that no request is signed with
+	// credentials that expire while it is retried.
+	webIdentityExpiryWindow = 5 * time.Minute
+)
+
+// webIdentitySettings configure temporary credentials from
+// AssumeRoleWithWebIdentity, e.g. with the STS of MinIO or Ceph and a
+// projected service account token.
+type webIdentitySettings struct {
+	stsURL    string
+	tokenFile string
+	audience  string
+	roleARN   string
+}
+
+// parseWebIdentitySettings returns the web identity settings of a location,
+// or nil if it uses none.
+func parseWebIdentitySettings(config map[string]string) (*webIdentitySettings, error) {
+	settings := &webIdentitySettings{
+		stsURL:    config[stsURLKey],
+		tokenFile: config[webIdentityTokenFileKey],
+		audience:  config[webIdentityAudienceKey],
+		roleARN:   config[webIdentityRoleARNKey],
+	}
+	if *settings == (webIdentitySettings{}) {
+		return nil, nil
+	}
+	if settings.tokenFile == "" {
+		return nil, errors.Errorf("%s requires %s", firstSetKey(config, stsURLKey, webIdentityAudienceKey, webIdentityRoleARNKey), webIdentityTokenFileKey)
+	}
+	if settings.stsURL != "" && !IsValidS3URLScheme(settings.stsURL) {
+		return nil, errors.Errorf("invalid %s %q, expected an http:// or https:// URL", stsURLKey, settings.stsURL)
+	}
+	for _, key := range []string{credentialsFileKey, credentialsSecretKey} {
+		if config[key] != "" {
+			return nil, errors.Errorf("%s cannot be used with %s", webIdentityTokenFileKey, key)
+		}
+	}
+	return settings, nil
+}
+
+func firstSetKey(config map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if config[key] != "" {
+			return key
+		}
+	}
+	return ""
+}
+
+// provider returns credentials that are obtained from STS with the client
+// settings of cfg, and refreshed before they expire.
+func (s *webIdentitySettings) provider(cfg aws.Config) *aws.CredentialsCache {
+	client := sts.NewFromConfig(cfg, func(o *sts.Options) {
+		if s.stsURL != "" {
+			o.BaseEndpoint = aws.String(s.stsURL)
+		}
+	})
+	token := webIdentityToken{file: s.tokenFile, audience: s.audience}
+	provider := stscreds.NewWebIdentityRoleProvider(client, s.roleARN, token, func(o *stscreds.WebIdentityRoleOptions) {
+		o.RoleSessionName = webIdentitySessionName
+	})
+	return aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = webIdentityExpiryWindow
+	})
+}
+
+// webIdentityToken reads the token from its file for each request to STS,
+// since the kubelet rotates projected service account tokens.
+type webIdentityToken struct {
+	file     string
+	audience string
+}
+
+func (t webIdentityToken) GetIdentityToken() ([]byte, error) {
+	token, err := os.ReadFile(t.file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", webIdentityTokenFileKey)
+	}
+	token = bytes.TrimSpace(token)
+	if t.audience == "" {
+		return token, nil
+	}
+
+	audiences, err := tokenAudiences(token)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", webIdentityTokenFileKey)
+	}
+	for _, audience := range audiences {
+		if audience == t.audience {
+			return token, nil
+		}
+	}
+	return nil, errors.Errorf("the token in %s is not for %s %q but for %q", t.file, webIdentityAudienceKey, t.audience, audiences)
+}
+
+// tokenAudiences returns the aud claim of a JWT, which is a string or a
+// list of strings. The token is verified by STS, not here.
+func tokenAudiences(token []byte) ([]string, error) {
+	parts := bytes.Split(token, []byte("."))
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(string(parts[1]))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var claims struct {
+		Audience json.RawMessage `json:"aud"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var audience string
+	if err := json.Unmarshal(claims.Audience, &audience); err == nil {
+		return []string{audience}, nil
+	}
+	var audiences []string
+	if err := json.Unmarshal(claims.Audience, &audiences); err != nil {
+		return nil, errors.New("the token has no aud claim")
+	}
+	return audiences, nil
+}
@@ -0,0 +1,190 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testJWT returns an unsigned JWT with the given claims.
+func testJWT(claims string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	return encode([]byte(`{"alg":"RS256"}`)) + "." + encode([]byte(claims)) + "." + encode([]byte("signature"))
+}
+
+func TestParseWebIdentitySettings(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]string
+		expected    *webIdentitySettings
+		expectedErr string
+	}{
+		{
+			name:   "not configured",
+			config: map[string]string{},
+		},
+		{
+			name: "custom STS",
+			config: map[string]string{
+				stsURLKey:               "https://minio.local:9000",
+				webIdentityTokenFileKey: "/var/run/secrets/minio/token",
+				webIdentityAudienceKey:  "minio",
+			},
+			expected: &webIdentitySettings{stsURL: "https://minio.local:9000", tokenFile: "/var/run/secrets/minio/token", audience: "minio"},
+		},
+		{
+			name:        "STS without token",
+			config:      map[string]string{stsURLKey: "https://minio.local:9000"},
+			expectedErr: "stsUrl requires webIdentityTokenFile",
+		},
+		{
+			name:        "invalid STS URL",
+			config:      map[string]string{stsURLKey: "minio.local:9000", webIdentityTokenFileKey: "/token"},
+			expectedErr: `invalid stsUrl "minio.local:9000", expected an http:// or https:// URL`,
+		},
+		{
+			name:        "with a credentials file",
+			config:      map[string]string{webIdentityTokenFileKey: "/token", credentialsFileKey: "/credentials/cloud"},
+			expectedErr: "webIdentityTokenFile cannot be used with credentialsFile",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings, err := parseWebIdentitySettings(test.config)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, settings)
+		})
+	}
+}
+
+func TestWebIdentityToken(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		writeFileAt(t, file, content, time.Now())
+		return file
+	}
+	single := write("single", testJWT(`{"aud":"minio","sub":"system:serviceaccount:velero:velero"}`)+"\n")
+	list := write("list", testJWT(`{"aud":["sts.amazonaws.com","minio"]}`))
+	none := write("none", testJWT(`{"sub":"velero"}`))
+
+	token, err := webIdentityToken{file: single}.GetIdentityToken()
+	require.NoError(t, err)
+	assert.NotContains(t, string(token), "\n")
+
+	_, err = webIdentityToken{file: single, audience: "minio"}.GetIdentityToken()
+	assert.NoError(t, err)
+	_, err = webIdentityToken{file: list, audience: "minio"}.GetIdentityToken()
+	assert.NoError(t, err)
+	_, err = webIdentityToken{file: single, audience: "ceph"}.GetIdentityToken()
+	assert.EqualError(t, err, fmt.Sprintf(`the token in %s is not for webIdentityAudience "ceph" but for ["minio"]`, single))
+	_, err = webIdentityToken{file: none, audience: "minio"}.GetIdentityToken()
+	assert.EqualError(t, err, "error parsing webIdentityTokenFile: the token has no aud claim")
+	_, err = webIdentityToken{file: filepath.Join(dir, "missing")}.GetIdentityToken()
+	assert.ErrorContains(t, err, "error reading webIdentityTokenFile")
+}
+
+func TestObjectStoreWebIdentity(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	token := testJWT(`{"aud":"minio"}`)
+	writeFileAt(t, tokenFile, token, time.Now())
+
+	var (
+		mu          sync.Mutex
+		assumed     int
+		expiration  time.Time
+		accessKeyID string
+	)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodPost && r.URL.Path == "/" {
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "AssumeRoleWithWebIdentity", r.PostForm.Get("Action"))
+			assert.Equal(t, token, r.PostForm.Get("WebIdentityToken"))
+			assert.Equal(t, "arn:minio:iam:::role/velero", r.PostForm.Get("RoleArn"))
+			assert.Equal(t, webIdentitySessionName, r.PostForm.Get("RoleSessionName"))
+			assumed++
+			fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>TEMP%d</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, assumed, expiration.UTC().Format(time.RFC3339))
+			return
+		}
+		accessKeyID = strings.TrimPrefix(strings.Split(r.Header.Get("Authorization"), "/")[0], "AWS4-HMAC-SHA256 Credential=")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverCA := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	init := func() *ObjectStore {
+		o := newObjectStore(newLogger())
+		require.NoError(t, o.Init(map[string]string{
+			bucketKey:               "bucket",
+			regionKey:               "us-east-1",
+			s3URLKey:                server.URL,
+			s3ForcePathStyleKey:     "true",
+			caCertKey:               serverCA,
+			stsURLKey:               server.URL,
+			webIdentityTokenFileKey: tokenFile,
+			webIdentityAudienceKey:  "minio",
+			webIdentityRoleARNKey:   "arn:minio:iam:::role/velero",
+		}))
+		return o
+	}
+
+	// credentials valid for an hour are reused
+	expiration = time.Now().Add(time.Hour)
+	o := init()
+	for i := 0; i < 2; i++ {
+		_, err := o.ObjectExists("bucket", "key")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, assumed)
+	assert.Equal(t, "TEMP1", accessKeyID)
+
+	// credentials within the expiry window are refreshed before use
+	expiration = time.Now().Add(webIdentityExpiryWindow - time.Minute)
+	o = init()
+	_, err := o.ObjectExists("bucket", "key")
+	require.NoError(t, err)
+	assert.Equal(t, 3, assumed)
+	assert.Equal(t, "TEMP3", accessKeyID)
+}